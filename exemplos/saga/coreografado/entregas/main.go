@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"saga/choreography"
+	"saga/ids"
+	"saga/protocol"
+)
+
+// Event representa um evento de domínio publicado por um serviço
+type Event = choreography.Event
+
+// Delivery representa uma entrega
+type Delivery struct {
+	ID             string    `json:"id"`
+	SagaID         string    `json:"saga_id"`
+	OrderID        string    `json:"order_id"`
+	Address        string    `json:"address"`
+	ScheduledDate  time.Time `json:"scheduled_date"`
+	Status         string    `json:"status"`
+	TrackingNumber string    `json:"tracking_number"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// DeliveryService gerencia entregas
+type DeliveryService struct{}
+
+func main() {
+	log.Println("Iniciando Serviço de Entregas (coreografado)...")
+
+	// Banco, Kafka, idempotência e dead-letter ficam com a biblioteca
+	r, err := choreography.New(choreography.Config{Name: "entregas"})
+	if err != nil {
+		log.Fatal("Erro ao iniciar serviço:", err)
+	}
+
+	// Inicializar schema
+	if err := initSchema(r.DB); err != nil {
+		log.Fatal("Erro ao inicializar schema:", err)
+	}
+
+	service := &DeliveryService{}
+
+	// Pagamentos processados, que liberam o agendamento da entrega
+	r.React("pagamentos-events", "PaymentProcessed", choreography.Step{
+		Command:      protocol.CommandScheduleDelivery,
+		FailureEvent: "DeliveryFailed",
+	}, service.scheduleDelivery)
+
+	r.Run()
+}
+
+func initSchema(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id VARCHAR(100) PRIMARY KEY,
+		saga_id VARCHAR(100) NOT NULL,
+		order_id VARCHAR(100) NOT NULL,
+		address TEXT NOT NULL,
+		scheduled_date TIMESTAMP NOT NULL,
+		status VARCHAR(50) NOT NULL,
+		tracking_number VARCHAR(100),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_saga_id ON deliveries(saga_id);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_deliveries_tracking_number ON deliveries(tracking_number);
+	`
+
+	_, err := db.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Schema do banco inicializado")
+	return nil
+}
+
+// scheduleDelivery agenda a entrega após o pagamento (mockado). É a última
+// etapa: DeliveryScheduled leva o serviço de pedidos a concluir o pedido.
+func (s *DeliveryService) scheduleDelivery(tx *sql.Tx, cause *Event) (*Event, error) {
+	address, _ := cause.Data["address"].(string)
+	if strings.TrimSpace(address) == "" {
+		log.Printf("❌ Pedido sem endereço de entrega (SAGA: %s)", cause.SagaID)
+		return choreography.NewEvent("DeliveryFailed", cause, "Endereço de entrega ausente"), nil
+	}
+
+	scheduledDate := time.Now().Add(48 * time.Hour) // 2 dias a partir de agora
+
+	delivery := &Delivery{
+		ID:             ids.New(),
+		SagaID:         cause.SagaID,
+		OrderID:        cause.OrderID,
+		Address:        address,
+		ScheduledDate:  scheduledDate,
+		Status:         "SCHEDULED",
+		TrackingNumber: ids.NewWithPrefix("TRK"),
+		CreatedAt:      time.Now(),
+	}
+
+	// Persistir no banco
+	_, err := tx.Exec(
+		`INSERT INTO deliveries (id, saga_id, order_id, address, scheduled_date, status, tracking_number)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		delivery.ID, delivery.SagaID, delivery.OrderID, delivery.Address,
+		delivery.ScheduledDate, delivery.Status, delivery.TrackingNumber,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao salvar entrega: %w", err)
+	}
+
+	log.Printf("Entrega agendada: %s (SAGA: %s)", delivery.TrackingNumber, delivery.SagaID)
+
+	event := choreography.NewEvent("DeliveryScheduled", cause, "Entrega agendada com sucesso")
+	event.Data["delivery_id"] = delivery.ID
+	event.Data["tracking_number"] = delivery.TrackingNumber
+	event.Data["scheduled_date"] = delivery.ScheduledDate.Format(time.RFC3339)
+	return event, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"saga/choreography"
+	"saga/ids"
+	"saga/protocol"
+)
+
+// Event representa um evento de domínio publicado por um serviço
+type Event = choreography.Event
+
+// LineItem é um item do pedido, acumulado em data.items pelo serviço de pedidos
+type LineItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+// StockReservation representa uma reserva de estoque
+type StockReservation struct {
+	ID        string    `json:"id"`
+	SagaID    string    `json:"saga_id"`
+	ProductID string    `json:"product_id"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StockService gerencia o estoque
+type StockService struct{}
+
+func main() {
+	log.Println("Iniciando Serviço de Estoque (coreografado)...")
+
+	// Banco, Kafka, idempotência e dead-letter ficam com a biblioteca
+	r, err := choreography.New(choreography.Config{Name: "estoque"})
+	if err != nil {
+		log.Fatal("Erro ao iniciar serviço:", err)
+	}
+
+	// Inicializar schema
+	if err := initSchema(r.DB); err != nil {
+		log.Fatal("Erro ao inicializar schema:", err)
+	}
+
+	service := &StockService{}
+
+	// Pedidos criados e eventos de pagamento que exigem liberar o estoque
+	reserve := choreography.Step{Command: protocol.CommandReserveStock, FailureEvent: "StockReservationFailed"}
+	release := choreography.Step{Command: protocol.CommandReleaseStock, FailureEvent: "StockReleaseFailed"}
+	r.React("pedidos-events", "OrderCreated", reserve, service.reserveStock)
+	r.React("pagamentos-events", "PaymentFailed", release, service.releaseStock)
+	r.React("pagamentos-events", "PaymentRefunded", release, service.releaseStock)
+
+	r.Run()
+}
+
+func initSchema(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS stock_reservations (
+		id VARCHAR(100) PRIMARY KEY,
+		saga_id VARCHAR(100) NOT NULL,
+		product_id VARCHAR(100) NOT NULL,
+		quantity INTEGER NOT NULL,
+		status VARCHAR(50) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_saga_id ON stock_reservations(saga_id);
+
+	-- Uma reserva por produto em cada SAGA
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_reservations_saga_product ON stock_reservations(saga_id, product_id);
+	`
+
+	_, err := db.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Schema do banco inicializado")
+	return nil
+}
+
+// reserveStock reserva o estoque do pedido criado (mockado), com uma reserva
+// por item gravada na transação do evento: ou todos os itens são reservados
+// e o evento registrado como processado, ou nada fica gravado
+func (s *StockService) reserveStock(tx *sql.Tx, cause *Event) (*Event, error) {
+	var items []LineItem
+	if err := decodeData(cause.Data, "items", &items); err != nil || len(items) == 0 {
+		log.Printf("❌ Pedido sem itens válidos (SAGA: %s): %v", cause.SagaID, err)
+		return choreography.NewEvent("StockReservationFailed", cause, "Pedido sem itens"), nil
+	}
+
+	for _, item := range items {
+		if item.ProductID == "" || item.Quantity <= 0 {
+			log.Printf("❌ Item inválido (SAGA: %s): %+v", cause.SagaID, item)
+			return choreography.NewEvent("StockReservationFailed", cause, "Item inválido no pedido"), nil
+		}
+	}
+
+	reservationIDs, err := s.saveReservations(tx, cause.SagaID, items)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao salvar reserva: %w", err)
+	}
+
+	log.Printf("Estoque reservado: %d item(ns) (SAGA: %s)", len(items), cause.SagaID)
+
+	event := choreography.NewEvent("StockReserved", cause, "Estoque reservado com sucesso")
+	event.Data["reservation_ids"] = reservationIDs
+	return event, nil
+}
+
+// saveReservations grava as reservas dos itens na transação do evento
+func (s *StockService) saveReservations(tx *sql.Tx, sagaID string, items []LineItem) ([]string, error) {
+	reservationIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		reservation := &StockReservation{
+			ID:        ids.New(),
+			SagaID:    sagaID,
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			Status:    "RESERVED",
+			CreatedAt: time.Now(),
+		}
+
+		_, err := tx.Exec(
+			`INSERT INTO stock_reservations (id, saga_id, product_id, quantity, status)
+			 VALUES ($1, $2, $3, $4, $5)`,
+			reservation.ID, reservation.SagaID, reservation.ProductID,
+			reservation.Quantity, reservation.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reservationIDs = append(reservationIDs, reservation.ID)
+	}
+
+	return reservationIDs, nil
+}
+
+// releaseStock libera o estoque quando o pagamento falha ou é estornado
+// (compensação). StockReleased leva o serviço de pedidos a cancelar o pedido.
+// Um erro no banco faz o evento ser tentado de novo e, esgotadas as
+// tentativas, desviado para o dead-letter para intervenção manual.
+func (s *StockService) releaseStock(tx *sql.Tx, cause *Event) (*Event, error) {
+	_, err := tx.Exec(
+		"UPDATE stock_reservations SET status = 'RELEASED' WHERE saga_id = $1",
+		cause.SagaID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao liberar estoque: %w", err)
+	}
+
+	log.Printf("Estoque liberado (SAGA: %s). Causa: %s", cause.SagaID, cause.Message)
+	return choreography.NewEvent("StockReleased", cause, cause.Message), nil
+}
+
+// decodeData lê o campo key dos dados acumulados do evento em v
+func decodeData(data map[string]interface{}, key string, v interface{}) error {
+	value, ok := data[key]
+	if !ok {
+		return fmt.Errorf("campo %s ausente", key)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"saga/choreography"
+	"saga/ids"
+	"saga/protocol"
+)
+
+// Event representa um evento de domínio publicado por um serviço
+type Event = choreography.Event
+
+// Payment representa um pagamento
+type Payment struct {
+	ID            string    `json:"id"`
+	SagaID        string    `json:"saga_id"`
+	OrderID       string    `json:"order_id"`
+	Amount        float64   `json:"amount"`
+	Status        string    `json:"status"`
+	TransactionID string    `json:"transaction_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// PaymentService gerencia pagamentos
+type PaymentService struct{}
+
+func main() {
+	log.Println("Iniciando Serviço de Pagamentos (coreografado)...")
+
+	// Banco, Kafka, idempotência e dead-letter ficam com a biblioteca
+	r, err := choreography.New(choreography.Config{Name: "pagamentos"})
+	if err != nil {
+		log.Fatal("Erro ao iniciar serviço:", err)
+	}
+
+	// Inicializar schema
+	if err := initSchema(r.DB); err != nil {
+		log.Fatal("Erro ao inicializar schema:", err)
+	}
+
+	service := &PaymentService{}
+
+	// Estoque reservado e falhas de entrega que exigem o estorno
+	r.React("estoque-events", "StockReserved", choreography.Step{
+		Command:      protocol.CommandProcessPayment,
+		FailureEvent: "PaymentFailed",
+	}, service.processPayment)
+	r.React("entregas-events", "DeliveryFailed", choreography.Step{
+		Command:      protocol.CommandCancelPayment,
+		FailureEvent: "PaymentRefundFailed",
+	}, service.refundPayment)
+
+	r.Run()
+}
+
+func initSchema(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS payments (
+		id VARCHAR(100) PRIMARY KEY,
+		saga_id VARCHAR(100) NOT NULL,
+		order_id VARCHAR(100) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		status VARCHAR(50) NOT NULL,
+		transaction_id VARCHAR(100),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_saga_id ON payments(saga_id);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_transaction_id ON payments(transaction_id);
+	`
+
+	_, err := db.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Schema do banco inicializado")
+	return nil
+}
+
+// processPayment processa o pagamento após a reserva do estoque (mockado)
+func (s *PaymentService) processPayment(tx *sql.Tx, cause *Event) (*Event, error) {
+	amount, _ := cause.Data["total_amount"].(float64)
+	cardNumber, _ := cause.Data["card_number"].(string)
+	if amount <= 0 || cardNumber == "" {
+		log.Printf("❌ Pedido sem valor ou cartão (SAGA: %s)", cause.SagaID)
+		return choreography.NewEvent("PaymentFailed", cause, "Dados de pagamento ausentes"), nil
+	}
+
+	// Cartões terminados em 0002 são recusados, como no gateway fake do
+	// exemplo orquestrado
+	if strings.HasSuffix(cardNumber, "0002") {
+		log.Printf("Cartão recusado (SAGA: %s)", cause.SagaID)
+		return choreography.NewEvent("PaymentFailed", cause, "Cartão recusado"), nil
+	}
+
+	payment := &Payment{
+		ID:            ids.New(),
+		SagaID:        cause.SagaID,
+		OrderID:       cause.OrderID,
+		Amount:        amount,
+		Status:        "APPROVED",
+		TransactionID: ids.NewWithPrefix("TXN"),
+		CreatedAt:     time.Now(),
+	}
+
+	// Persistir no banco
+	_, err := tx.Exec(
+		`INSERT INTO payments (id, saga_id, order_id, amount, status, transaction_id)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		payment.ID, payment.SagaID, payment.OrderID,
+		payment.Amount, payment.Status, payment.TransactionID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao salvar pagamento: %w", err)
+	}
+
+	log.Printf("Pagamento aprovado: R$ %.2f (SAGA: %s)", payment.Amount, payment.SagaID)
+
+	event := choreography.NewEvent("PaymentProcessed", cause, "Pagamento processado com sucesso")
+	event.Data["payment_id"] = payment.ID
+	event.Data["transaction_id"] = payment.TransactionID
+	return event, nil
+}
+
+// refundPayment estorna o pagamento quando a entrega não pôde ser agendada
+// (compensação). PaymentRefunded leva o estoque a ser liberado. Um erro no
+// banco faz o evento ser tentado de novo e, esgotadas as tentativas,
+// desviado para o dead-letter para intervenção manual.
+func (s *PaymentService) refundPayment(tx *sql.Tx, cause *Event) (*Event, error) {
+	_, err := tx.Exec(
+		"UPDATE payments SET status = 'REFUNDED' WHERE saga_id = $1",
+		cause.SagaID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao estornar pagamento: %w", err)
+	}
+
+	log.Printf("Pagamento estornado (SAGA: %s). Causa: %s", cause.SagaID, cause.Message)
+	return choreography.NewEvent("PaymentRefunded", cause, cause.Message), nil
+}
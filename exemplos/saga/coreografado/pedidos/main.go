@@ -0,0 +1,418 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"saga/choreography"
+	"saga/deadletter"
+	"saga/ids"
+	"saga/protocol"
+)
+
+// Tópicos usados pelo serviço. O tópico de entrada e o de conclusão são os
+// mesmos da versão orquestrada, para que o simulador funcione nas duas.
+const (
+	startTopic     = "pedido-saga-pedido-processar"
+	completedTopic = "pedido-saga-pedido-processado"
+)
+
+// Event representa um evento de domínio publicado por um serviço
+type Event = choreography.Event
+
+// OrderRequest é o pedido enviado pelo simulador, no mesmo formato da versão
+// orquestrada
+type OrderRequest struct {
+	OrderID    string     `json:"order_id"`
+	CustomerID string     `json:"customer_id"`
+	Items      []LineItem `json:"items"`
+	CardNumber string     `json:"card_number"`
+	Address    string     `json:"address"`
+}
+
+// LineItem é um item do pedido
+type LineItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+// PricedItem é um item do pedido com o preço unitário do catálogo
+type PricedItem struct {
+	ProductID string  `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+}
+
+// Order representa um pedido
+type Order struct {
+	ID          string       `json:"id"`
+	SagaID      string       `json:"saga_id"`
+	CustomerID  string       `json:"customer_id"`
+	Items       []PricedItem `json:"items"`
+	TotalAmount float64      `json:"total_amount"`
+	Status      string       `json:"status"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// CatalogProduct é um produto do catálogo de preços
+type CatalogProduct struct {
+	ID    string
+	Name  string
+	Price float64
+}
+
+// seedCatalog é o catálogo inicial de preços, o mesmo da versão orquestrada.
+// O valor do pedido é sempre calculado a partir dele.
+var seedCatalog = []CatalogProduct{
+	{ID: "PROD-001", Name: "Notebook", Price: 3499.00},
+	{ID: "PROD-002", Name: "Monitor", Price: 899.90},
+	{ID: "PROD-003", Name: "Teclado", Price: 99.99},
+	{ID: "PROD-004", Name: "Mouse", Price: 49.90},
+	{ID: "PROD-005", Name: "Headset", Price: 299.99},
+}
+
+// OrderService gerencia pedidos
+type OrderService struct {
+	producer sarama.SyncProducer
+	reactor  *choreography.Reactor
+}
+
+func main() {
+	log.Println("Iniciando Serviço de Pedidos (coreografado)...")
+
+	// Banco, Kafka, idempotência e dead-letter ficam com a biblioteca
+	r, err := choreography.New(choreography.Config{Name: "pedidos"})
+	if err != nil {
+		log.Fatal("Erro ao iniciar serviço:", err)
+	}
+
+	// Inicializar schema
+	if err := initSchema(r.DB); err != nil {
+		log.Fatal("Erro ao inicializar schema:", err)
+	}
+
+	service := &OrderService{
+		producer: r.Producer,
+		reactor:  r,
+	}
+
+	// Pedidos do simulador, no mesmo payload da versão orquestrada, e os
+	// eventos de estoque e entregas que encerram a SAGA
+	r.Handle(startTopic, service.handleOrderRequest)
+	cancel := choreography.Step{Command: protocol.CommandCancelOrder}
+	r.React("estoque-events", "StockReservationFailed", cancel, service.cancelOrder)
+	r.React("estoque-events", "StockReleased", cancel, service.cancelOrder)
+	r.React("entregas-events", "DeliveryScheduled", choreography.Step{}, service.completeOrder)
+
+	// A conclusão é repassada no mesmo formato da versão orquestrada
+	r.Forward("OrderCompleted", service.publishOrderProcessed)
+
+	r.Run()
+}
+
+func initSchema(db *sql.DB) error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS orders (
+		id VARCHAR(100) PRIMARY KEY,
+		saga_id VARCHAR(100) NOT NULL,
+		customer_id VARCHAR(100) NOT NULL,
+		product_id VARCHAR(100) NOT NULL,
+		quantity INTEGER NOT NULL,
+		total_amount DECIMAL(10,2) NOT NULL,
+		status VARCHAR(50) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		finished_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_saga_id ON orders(saga_id);
+
+	-- Cada SAGA pertence a um único pedido
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_saga_id ON orders(saga_id);
+
+	-- Pedidos com vários itens: produto e quantidade ficam em order_items
+	ALTER TABLE orders ALTER COLUMN product_id DROP NOT NULL;
+	ALTER TABLE orders ALTER COLUMN quantity DROP NOT NULL;
+
+	CREATE TABLE IF NOT EXISTS order_items (
+		order_id VARCHAR(100) NOT NULL REFERENCES orders(id),
+		product_id VARCHAR(100) NOT NULL,
+		quantity INTEGER NOT NULL CHECK (quantity > 0),
+		unit_price DECIMAL(10,2) NOT NULL,
+		PRIMARY KEY (order_id, product_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS catalog (
+		id VARCHAR(100) PRIMARY KEY,
+		name VARCHAR(200) NOT NULL,
+		price DECIMAL(10,2) NOT NULL CHECK (price > 0)
+	);
+	`
+
+	_, err := db.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	// Cadastrar o catálogo inicial sem sobrescrever preços já existentes
+	for _, p := range seedCatalog {
+		_, err := db.Exec(
+			"INSERT INTO catalog (id, name, price) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
+			p.ID, p.Name, p.Price,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Println("Schema do banco inicializado")
+	return nil
+}
+
+// handleOrderRequest registra o pedido recebido do simulador. O pedido é
+// reivindicado em processed_events com a chave do pedido, na transação que o
+// grava: se a publicação falhar, a nova tentativa republica o mesmo evento em
+// vez de ignorar o pedido já registrado.
+func (s *OrderService) handleOrderRequest(data []byte) error {
+	var req OrderRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return deadletter.Permanent(fmt.Errorf("erro ao deserializar pedido: %w", err))
+	}
+	if req.OrderID == "" {
+		req.OrderID = ids.New()
+	}
+
+	request := &Event{
+		EventID:   "pedido:" + req.OrderID,
+		EventType: "OrderRequested",
+		SagaID:    ids.New(),
+		OrderID:   req.OrderID,
+	}
+
+	validate := choreography.Step{Command: protocol.CommandValidateOrder, FailureEvent: "OrderRejected"}
+	return s.reactor.Process(request, validate, func(tx *sql.Tx, cause *Event) (*Event, error) {
+		return s.createOrder(tx, &req, cause.SagaID)
+	})
+}
+
+// createOrder registra o pedido recebido e inicia a SAGA publicando
+// OrderCreated. O valor vem do catálogo; pedidos inválidos ou com produtos
+// fora do catálogo são recusados com OrderRejected.
+func (s *OrderService) createOrder(tx *sql.Tx, req *OrderRequest, sagaID string) (*Event, error) {
+	order := &Order{
+		ID:         req.OrderID,
+		SagaID:     sagaID,
+		CustomerID: req.CustomerID,
+		Status:     "CREATED",
+		CreatedAt:  time.Now(),
+	}
+
+	event := &Event{
+		EventID:   ids.New(),
+		SagaID:    order.SagaID,
+		OrderID:   order.ID,
+		Data:      make(map[string]interface{}),
+		Timestamp: time.Now(),
+	}
+
+	if err := req.validate(); err != nil {
+		log.Printf("❌ Pedido %s inválido: %v", order.ID, err)
+		event.EventType = "OrderRejected"
+		event.Message = err.Error()
+		return event, nil
+	}
+
+	created, err := s.saveOrder(tx, order, req.Items)
+	var unknown *errUnknownProduct
+	if errors.As(err, &unknown) {
+		log.Printf("❌ Pedido %s recusado: %v", order.ID, unknown)
+		event.EventType = "OrderRejected"
+		event.Message = unknown.Error()
+		return event, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("erro ao salvar pedido: %w", err)
+	}
+	if !created {
+		log.Printf("Pedido %s já registrado, ignorando", order.ID)
+		return nil, nil
+	}
+
+	log.Printf("Pedido %s criado com %d item(ns), R$ %.2f, iniciando SAGA %s",
+		order.ID, len(order.Items), order.TotalAmount, order.SagaID)
+
+	event.EventType = "OrderCreated"
+	event.Message = "Pedido criado"
+	event.Data["saga_id"] = order.SagaID
+	event.Data["order_id"] = order.ID
+	event.Data["customer_id"] = order.CustomerID
+	event.Data["items"] = order.Items
+	event.Data["total_amount"] = order.TotalAmount
+	event.Data["card_number"] = req.CardNumber
+	event.Data["address"] = req.Address
+	return event, nil
+}
+
+// validate confere os campos obrigatórios e os itens do pedido
+func (r *OrderRequest) validate() error {
+	switch {
+	case r.CustomerID == "":
+		return fmt.Errorf("Pedido sem customer_id")
+	case len(r.Items) == 0:
+		return fmt.Errorf("Pedido sem itens")
+	case r.CardNumber == "":
+		return fmt.Errorf("Pedido sem card_number")
+	case r.Address == "":
+		return fmt.Errorf("Pedido sem address")
+	}
+
+	seen := make(map[string]bool)
+	for i, item := range r.Items {
+		if item.ProductID == "" {
+			return fmt.Errorf("items[%d]: product_id obrigatório", i)
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("items[%d]: quantity deve ser positiva", i)
+		}
+		if seen[item.ProductID] {
+			return fmt.Errorf("items[%d]: produto %s repetido", i, item.ProductID)
+		}
+		seen[item.ProductID] = true
+	}
+	return nil
+}
+
+// errUnknownProduct indica um item cujo produto não está no catálogo
+type errUnknownProduct struct {
+	ProductID string
+}
+
+func (e *errUnknownProduct) Error() string {
+	return fmt.Sprintf("Produto %s não cadastrado no catálogo", e.ProductID)
+}
+
+// saveOrder precifica os itens pelo catálogo e grava o pedido com eles na
+// transação do pedido recebido. O id do pedido é a chave: uma reentrega do
+// mesmo pedido não inicia outra SAGA e retorna false.
+func (s *OrderService) saveOrder(tx *sql.Tx, order *Order, items []LineItem) (bool, error) {
+	var total int64
+	for _, item := range items {
+		var price float64
+		err := tx.QueryRow("SELECT price FROM catalog WHERE id = $1", item.ProductID).Scan(&price)
+		if err == sql.ErrNoRows {
+			return false, &errUnknownProduct{ProductID: item.ProductID}
+		}
+		if err != nil {
+			return false, err
+		}
+
+		order.Items = append(order.Items, PricedItem{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			UnitPrice: price,
+		})
+		total += int64(math.Round(price*100)) * int64(item.Quantity)
+	}
+	order.TotalAmount = float64(total) / 100
+
+	result, err := tx.Exec(
+		`INSERT INTO orders (id, saga_id, customer_id, total_amount, status)
+		 VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING`,
+		order.ID, order.SagaID, order.CustomerID, order.TotalAmount, order.Status,
+	)
+	if err != nil {
+		return false, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+
+	for _, item := range order.Items {
+		_, err := tx.Exec(
+			"INSERT INTO order_items (order_id, product_id, quantity, unit_price) VALUES ($1, $2, $3, $4)",
+			order.ID, item.ProductID, item.Quantity, item.UnitPrice,
+		)
+		if err != nil {
+			return false, fmt.Errorf("erro ao salvar item %s: %w", item.ProductID, err)
+		}
+	}
+
+	return true, nil
+}
+
+// cancelOrder cancela o pedido quando o estoque não foi reservado ou foi
+// liberado pela compensação
+func (s *OrderService) cancelOrder(tx *sql.Tx, cause *Event) (*Event, error) {
+	duration, err := finishOrder(tx, cause.OrderID, "CANCELLED")
+	if err != nil {
+		return nil, fmt.Errorf("erro ao cancelar pedido: %w", err)
+	}
+
+	log.Printf("Pedido %s cancelado após %dms (SAGA: %s). Causa: %s",
+		cause.OrderID, duration.Milliseconds(), cause.SagaID, cause.Message)
+
+	event := choreography.NewEvent("OrderCancelled", cause, "Pedido cancelado")
+	event.Data["duration_ms"] = duration.Milliseconds()
+	return event, nil
+}
+
+// completeOrder conclui o pedido após o agendamento da entrega. Publicado
+// OrderCompleted, o pedido é repassado ao tópico de conclusão.
+func (s *OrderService) completeOrder(tx *sql.Tx, cause *Event) (*Event, error) {
+	duration, err := finishOrder(tx, cause.OrderID, "COMPLETED")
+	if err != nil {
+		return nil, fmt.Errorf("erro ao concluir pedido: %w", err)
+	}
+
+	log.Printf("SAGA %s concluída com sucesso em %dms!", cause.SagaID, duration.Milliseconds())
+
+	event := choreography.NewEvent("OrderCompleted", cause, "Pedido concluído")
+	event.Data["duration_ms"] = duration.Milliseconds()
+	return event, nil
+}
+
+// finishOrder grava o status final do pedido e retorna o tempo total da SAGA
+func finishOrder(tx *sql.Tx, orderID, status string) (time.Duration, error) {
+	var seconds float64
+	err := tx.QueryRow(
+		`UPDATE orders SET status = $1, finished_at = CURRENT_TIMESTAMP WHERE id = $2
+		 RETURNING EXTRACT(EPOCH FROM (finished_at - created_at))`,
+		status, orderID,
+	).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// publishOrderProcessed publica o pedido concluído no tópico de conclusão
+func (s *OrderService) publishOrderProcessed(event *Event) error {
+	processed := map[string]interface{}{
+		"saga_id":   event.SagaID,
+		"order_id":  event.OrderID,
+		"status":    "COMPLETED",
+		"timestamp": time.Now().Format(time.RFC3339),
+		"data":      event.Data,
+	}
+
+	data, err := json.Marshal(processed)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: completedTopic,
+		Key:   sarama.StringEncoder(event.SagaID),
+		Value: sarama.ByteEncoder(data),
+	})
+	if err != nil {
+		return fmt.Errorf("erro ao publicar pedido processado: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+// Comando dlq inspeciona os tópicos de dead-letter dos serviços da SAGA e
+// republica mensagens no tópico de origem depois que a causa foi corrigida.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IBM/sarama"
+	"saga/deadletter"
+)
+
+// idleTimeout encerra a leitura de uma partição que não recebe mensagens
+const idleTimeout = 2 * time.Second
+
+// DeadLetter é uma mensagem lida de um tópico de dead-letter
+type DeadLetter struct {
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	// Headers originais, sem os headers acrescentados no desvio
+	Headers []sarama.RecordHeader
+	// Dados da falha, lidos dos headers dlq.*
+	Failure map[string]string
+}
+
+// OriginalTopic retorna o tópico de onde a mensagem foi desviada
+func (d *DeadLetter) OriginalTopic() string {
+	return d.Failure[deadletter.HeaderOriginalTopic]
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Uso: dlq [-brokers host:porta] <comando> [opções]
+
+Comandos:
+  topics                                 lista os tópicos de dead-letter
+  list -topic T                          lista as mensagens do tópico
+  show -topic T -partition P -offset O   mostra a mensagem com headers e valor
+  republish -topic T [-partition P -offset O | -all]
+                                         publica a(s) mensagem(ns) no tópico original
+`)
+}
+
+func main() {
+	brokers := flag.String("brokers", getEnv("KAFKA_BROKERS", "localhost:9092"), "brokers Kafka separados por vírgula")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	addrs := strings.Split(*brokers, ",")
+	command, args := flag.Arg(0), flag.Args()[1:]
+
+	var err error
+	switch command {
+	case "topics":
+		err = listTopics(addrs)
+	case "list":
+		err = listMessages(addrs, args)
+	case "show":
+		err = showMessage(addrs, args)
+	case "republish":
+		err = republish(addrs, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listTopics mostra os tópicos de dead-letter existentes no cluster
+func listTopics(addrs []string) error {
+	consumer, err := sarama.NewConsumer(addrs, sarama.NewConfig())
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	topics, err := consumer.Topics()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if strings.HasSuffix(topic, deadletter.TopicSuffix) {
+			fmt.Println(topic)
+		}
+	}
+	return nil
+}
+
+// listMessages mostra um resumo de cada mensagem do tópico
+func listMessages(addrs []string, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	topic := flags.String("topic", "", "tópico de dead-letter (ex: estoque-group-dlq)")
+	flags.Parse(args)
+	if *topic == "" {
+		return fmt.Errorf("informe -topic")
+	}
+
+	messages, err := readDeadLetters(addrs, *topic)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTIÇÃO\tOFFSET\tORIGEM\tTENTATIVAS\tFALHOU EM\tERRO")
+	for _, m := range messages {
+		origin := fmt.Sprintf("%s[%s]@%s", m.OriginalTopic(),
+			m.Failure[deadletter.HeaderOriginalPartition], m.Failure[deadletter.HeaderOriginalOffset])
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", m.Partition, m.Offset, origin,
+			m.Failure[deadletter.HeaderAttempts], m.Failure[deadletter.HeaderFailedAt],
+			truncate(m.Failure[deadletter.HeaderError], 80))
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d mensagem(ns) em %s\n", len(messages), *topic)
+	return nil
+}
+
+// showMessage mostra os headers e o valor original de uma mensagem
+func showMessage(addrs []string, args []string) error {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	topic := flags.String("topic", "", "tópico de dead-letter")
+	partition := flags.Int("partition", 0, "partição da mensagem no dead-letter")
+	offset := flags.Int64("offset", -1, "offset da mensagem no dead-letter")
+	flags.Parse(args)
+	if *topic == "" || *offset < 0 {
+		return fmt.Errorf("informe -topic e -offset")
+	}
+
+	m, err := findDeadLetter(addrs, *topic, int32(*partition), *offset)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Falha:")
+	keys := make([]string, 0, len(m.Failure))
+	for k := range m.Failure {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %s: %s\n", k, m.Failure[k])
+	}
+
+	fmt.Println("Headers originais:")
+	for _, h := range m.Headers {
+		fmt.Printf("  %s: %s\n", h.Key, h.Value)
+	}
+	if m.Key != nil {
+		fmt.Printf("Chave: %s\n", m.Key)
+	}
+	fmt.Printf("Valor:\n%s\n", m.Value)
+	return nil
+}
+
+// republish publica no tópico original uma mensagem, ou todas com -all, com
+// os bytes e headers originais. O dead-letter não é alterado: a mensagem
+// continua lá como registro da falha.
+func republish(addrs []string, args []string) error {
+	flags := flag.NewFlagSet("republish", flag.ExitOnError)
+	topic := flags.String("topic", "", "tópico de dead-letter")
+	partition := flags.Int("partition", 0, "partição da mensagem no dead-letter")
+	offset := flags.Int64("offset", -1, "offset da mensagem no dead-letter")
+	all := flags.Bool("all", false, "republicar todas as mensagens do tópico")
+	flags.Parse(args)
+	if *topic == "" || (*offset < 0 && !*all) {
+		return fmt.Errorf("informe -topic e -offset, ou -all")
+	}
+
+	var messages []*DeadLetter
+	if *all {
+		var err error
+		if messages, err = readDeadLetters(addrs, *topic); err != nil {
+			return err
+		}
+	} else {
+		m, err := findDeadLetter(addrs, *topic, int32(*partition), *offset)
+		if err != nil {
+			return err
+		}
+		messages = []*DeadLetter{m}
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+
+	producer, err := sarama.NewSyncProducer(addrs, config)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	for _, m := range messages {
+		if m.OriginalTopic() == "" {
+			log.Printf("Mensagem %d@%d sem tópico de origem, ignorada", m.Partition, m.Offset)
+			continue
+		}
+
+		msg := &sarama.ProducerMessage{
+			Topic:   m.OriginalTopic(),
+			Value:   sarama.ByteEncoder(m.Value),
+			Headers: m.Headers,
+		}
+		if m.Key != nil {
+			msg.Key = sarama.ByteEncoder(m.Key)
+		}
+
+		if _, _, err := producer.SendMessage(msg); err != nil {
+			return fmt.Errorf("erro ao republicar %d@%d: %w", m.Partition, m.Offset, err)
+		}
+		fmt.Printf("Mensagem %d@%d republicada em %s\n", m.Partition, m.Offset, m.OriginalTopic())
+	}
+	return nil
+}
+
+// findDeadLetter lê a mensagem na partição e offset informados
+func findDeadLetter(addrs []string, topic string, partition int32, offset int64) (*DeadLetter, error) {
+	consumer, err := sarama.NewConsumer(addrs, sarama.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(topic, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	select {
+	case msg := <-pc.Messages():
+		if msg.Offset != offset {
+			return nil, fmt.Errorf("mensagem %d@%d não encontrada em %s", partition, offset, topic)
+		}
+		return newDeadLetter(msg), nil
+	case <-time.After(idleTimeout):
+		return nil, fmt.Errorf("mensagem %d@%d não encontrada em %s", partition, offset, topic)
+	}
+}
+
+// readDeadLetters lê todas as mensagens do tópico, partição a partição, do
+// início até o fim atual
+func readDeadLetters(addrs []string, topic string) ([]*DeadLetter, error) {
+	consumer, err := sarama.NewConsumer(addrs, sarama.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*DeadLetter
+	for _, partition := range partitions {
+		pc, err := consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, err
+		}
+
+	read:
+		for {
+			select {
+			case msg := <-pc.Messages():
+				messages = append(messages, newDeadLetter(msg))
+				if msg.Offset+1 >= pc.HighWaterMarkOffset() {
+					break read
+				}
+			case <-time.After(idleTimeout):
+				break read
+			}
+		}
+		pc.Close()
+	}
+	return messages, nil
+}
+
+// newDeadLetter separa os headers originais dos dados da falha
+func newDeadLetter(msg *sarama.ConsumerMessage) *DeadLetter {
+	d := &DeadLetter{
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Failure:   make(map[string]string),
+	}
+	for _, h := range msg.Headers {
+		if h == nil {
+			continue
+		}
+		if deadletter.IsDeadLetterHeader(string(h.Key)) {
+			d.Failure[string(h.Key)] = string(h.Value)
+			continue
+		}
+		d.Headers = append(d.Headers, *h)
+	}
+	return d
+}
+
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-3]) + "..."
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"saga/ids"
+	"saga/participant"
+	"saga/protocol"
+)
+
+// Carrier é a fronteira com a transportadora. O serviço só conhece esta
+// interface; o adaptador é escolhido na inicialização.
+type Carrier interface {
+	// Name identifica a transportadora nos eventos de entrega
+	Name() string
+	// Schedule agenda a coleta e retorna o código de rastreio e a data prevista
+	Schedule(ctx context.Context, req ShipmentRequest) (*Shipment, error)
+	// Cancel cancela uma entrega ainda não despachada. Uma entrega despachada
+	// passa a ser devolvida ao remetente e Cancel retorna ErrReturnRequested;
+	// uma entrega já realizada retorna ErrAlreadyDelivered.
+	Cancel(ctx context.Context, trackingNumber string) error
+	// CancelReference cancela, como Cancel, a reserva feita com a referência
+	// do agendamento, para quando o código de rastreio não foi registrado.
+	// Sem reserva para a referência, não faz nada.
+	CancelReference(ctx context.Context, reference string) error
+	// Track consulta o status da entrega na transportadora
+	Track(ctx context.Context, delivery *Delivery) (*TrackingUpdate, error)
+}
+
+// ErrReturnRequested indica que a entrega já saiu para entrega e não pode mais
+// ser cancelada: a transportadora a devolve ao remetente
+var ErrReturnRequested = errors.New("entrega já despachada, devolução ao remetente solicitada")
+
+// ErrAlreadyDelivered indica que a entrega já foi realizada
+var ErrAlreadyDelivered = errors.New("entrega já realizada")
+
+// ShipmentRequest contém os dados enviados no agendamento
+type ShipmentRequest struct {
+	Reference string
+	OrderID   string
+	Address   string
+}
+
+// Shipment é a entrega aceita pela transportadora
+type Shipment struct {
+	TrackingNumber string
+	ScheduledDate  time.Time
+}
+
+// TrackingUpdate é o status informado pela transportadora
+type TrackingUpdate struct {
+	Status string
+	Reason string
+}
+
+// RejectedError indica que a transportadora recusou a entrega (endereço não
+// atendido, sem capacidade). É uma resposta definitiva: a SAGA é compensada.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("Entrega recusada pela transportadora: %s", e.Reason)
+}
+
+// newCarrier cria a transportadora simulada, configurada pelas variáveis CARRIER_*
+func newCarrier(db *sql.DB) (Carrier, error) {
+	carrier := &fakeCarrier{db: db}
+
+	var err error
+	if carrier.capacity, err = strconv.Atoi(participant.Env("CARRIER_DAILY_CAPACITY", "20")); err != nil {
+		return nil, fmt.Errorf("CARRIER_DAILY_CAPACITY inválido: %w", err)
+	}
+	if carrier.horizonDays, err = strconv.Atoi(participant.Env("CARRIER_HORIZON_DAYS", "5")); err != nil {
+		return nil, fmt.Errorf("CARRIER_HORIZON_DAYS inválido: %w", err)
+	}
+	if carrier.rejectAddress, err = regexp.Compile(participant.Env("CARRIER_REJECT_ADDRESS", `(?i)zona rural|caixa postal`)); err != nil {
+		return nil, fmt.Errorf("CARRIER_REJECT_ADDRESS inválido: %w", err)
+	}
+	if carrier.returnAddress, err = regexp.Compile(participant.Env("CARRIER_RETURN_ADDRESS", `(?i)ausente`)); err != nil {
+		return nil, fmt.Errorf("CARRIER_RETURN_ADDRESS inválido: %w", err)
+	}
+	if carrier.dispatchAfter, err = time.ParseDuration(participant.Env("CARRIER_DISPATCH_AFTER", "30s")); err != nil {
+		return nil, fmt.Errorf("CARRIER_DISPATCH_AFTER inválido: %w", err)
+	}
+	if carrier.deliverAfter, err = time.ParseDuration(participant.Env("CARRIER_DELIVER_AFTER", "60s")); err != nil {
+		return nil, fmt.Errorf("CARRIER_DELIVER_AFTER inválido: %w", err)
+	}
+
+	if err := carrier.initSchema(); err != nil {
+		return nil, fmt.Errorf("erro ao criar tabela da transportadora: %w", err)
+	}
+
+	log.Printf("Transportadora simulada: %d entrega(s) por dia, despacho após %s, entrega após %s",
+		carrier.capacity, carrier.dispatchAfter, carrier.deliverAfter)
+	return carrier, nil
+}
+
+// fakeCarrier simula uma transportadora. O agendamento é feito para o
+// primeiro dia, a partir de dois dias, com capacidade livre; endereços que
+// casam com rejectAddress são recusados. O ciclo de vida é acelerado: a
+// entrega é despachada dispatchAfter depois do agendamento e entregue (ou
+// devolvida, se o endereço casar com returnAddress ou se o cancelamento
+// chegou depois do despacho) deliverAfter depois dele.
+//
+// As reservas ficam em carrier_bookings, no banco do serviço, fora da
+// transação dos comandos: como numa transportadora real, sobrevivem a
+// reinícios e são compartilhadas pelas réplicas do serviço.
+type fakeCarrier struct {
+	db            *sql.DB
+	capacity      int
+	horizonDays   int
+	rejectAddress *regexp.Regexp
+	returnAddress *regexp.Regexp
+	dispatchAfter time.Duration
+	deliverAfter  time.Duration
+}
+
+// carrierLockKey identifica o advisory lock que serializa os agendamentos
+// entre as réplicas, para que a capacidade do dia seja respeitada
+const carrierLockKey = "fake-carrier-bookings"
+
+func (c *fakeCarrier) initSchema() error {
+	_, err := c.db.Exec(`
+	CREATE TABLE IF NOT EXISTS carrier_bookings (
+		tracking_number VARCHAR(100) PRIMARY KEY,
+		reference VARCHAR(100) NOT NULL UNIQUE,
+		address TEXT NOT NULL,
+		day DATE NOT NULL,
+		scheduled_date TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		return_requested_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_carrier_bookings_day ON carrier_bookings(day);
+	`)
+	return err
+}
+
+func (c *fakeCarrier) Name() string {
+	return "fake"
+}
+
+// Schedule reserva o primeiro dia com capacidade livre. Um novo agendamento
+// da mesma referência (o comando reexecutado) recebe a reserva já feita.
+func (c *fakeCarrier) Schedule(ctx context.Context, req ShipmentRequest) (*Shipment, error) {
+	if c.rejectAddress.MatchString(req.Address) {
+		return nil, &RejectedError{Reason: fmt.Sprintf("endereço não atendido: %s", req.Address)}
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", carrierLockKey); err != nil {
+		return nil, err
+	}
+
+	shipment := &Shipment{}
+	err = tx.QueryRow(
+		"SELECT tracking_number, scheduled_date FROM carrier_bookings WHERE reference = $1",
+		req.Reference,
+	).Scan(&shipment.TrackingNumber, &shipment.ScheduledDate)
+	if err == nil {
+		return shipment, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	first := time.Now().Add(48 * time.Hour)
+	for day := 0; day < c.horizonDays; day++ {
+		date := first.AddDate(0, 0, day)
+		key := date.Format("2006-01-02")
+
+		if c.capacity > 0 {
+			var booked int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM carrier_bookings WHERE day = $1", key).Scan(&booked); err != nil {
+				return nil, err
+			}
+			if booked >= c.capacity {
+				continue
+			}
+		}
+
+		shipment.TrackingNumber = ids.NewWithPrefix("TRK")
+		shipment.ScheduledDate = date
+		_, err := tx.Exec(
+			`INSERT INTO carrier_bookings (tracking_number, reference, address, day, scheduled_date, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6)`,
+			shipment.TrackingNumber, req.Reference, req.Address, key, shipment.ScheduledDate, time.Now(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return shipment, nil
+	}
+
+	return nil, &RejectedError{Reason: fmt.Sprintf("sem capacidade de entrega nos próximos %d dias", c.horizonDays)}
+}
+
+// Cancel remove a reserva ainda não despachada, liberando a capacidade do
+// dia. Depois do despacho a reserva é mantida e marcada para devolução.
+func (c *fakeCarrier) Cancel(ctx context.Context, trackingNumber string) error {
+	var createdAt time.Time
+	var returnRequested bool
+	err := c.db.QueryRowContext(ctx,
+		"SELECT created_at, return_requested_at IS NOT NULL FROM carrier_bookings WHERE tracking_number = $1",
+		trackingNumber,
+	).Scan(&createdAt, &returnRequested)
+	if err == sql.ErrNoRows {
+		// Reserva já cancelada
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	elapsed := time.Since(createdAt)
+	switch {
+	case returnRequested:
+		return ErrReturnRequested
+	case elapsed >= c.deliverAfter:
+		return ErrAlreadyDelivered
+	case elapsed >= c.dispatchAfter:
+		_, err := c.db.ExecContext(ctx,
+			"UPDATE carrier_bookings SET return_requested_at = CURRENT_TIMESTAMP WHERE tracking_number = $1",
+			trackingNumber,
+		)
+		if err != nil {
+			return err
+		}
+		return ErrReturnRequested
+	}
+
+	_, err = c.db.ExecContext(ctx, "DELETE FROM carrier_bookings WHERE tracking_number = $1", trackingNumber)
+	return err
+}
+
+// CancelReference localiza a reserva pela referência e a cancela com Cancel
+func (c *fakeCarrier) CancelReference(ctx context.Context, reference string) error {
+	var trackingNumber string
+	err := c.db.QueryRowContext(ctx,
+		"SELECT tracking_number FROM carrier_bookings WHERE reference = $1", reference,
+	).Scan(&trackingNumber)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.Cancel(ctx, trackingNumber)
+}
+
+// Track deriva o status do tempo decorrido desde o agendamento registrado na
+// reserva. Entregas sem reserva, agendadas antes de as reservas serem
+// gravadas, usam o horário da própria entrega.
+func (c *fakeCarrier) Track(ctx context.Context, delivery *Delivery) (*TrackingUpdate, error) {
+	createdAt := delivery.CreatedAt
+	var returnRequested bool
+	err := c.db.QueryRowContext(ctx,
+		"SELECT created_at, return_requested_at IS NOT NULL FROM carrier_bookings WHERE tracking_number = $1",
+		delivery.TrackingNumber,
+	).Scan(&createdAt, &returnRequested)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	elapsed := time.Since(createdAt)
+
+	switch {
+	case elapsed >= c.deliverAfter && returnRequested:
+		return &TrackingUpdate{Status: protocol.DeliveryStatusReturned, Reason: "devolução solicitada pelo remetente"}, nil
+	case elapsed >= c.deliverAfter && c.returnAddress.MatchString(delivery.Address):
+		return &TrackingUpdate{Status: protocol.DeliveryStatusReturned, Reason: "destinatário ausente"}, nil
+	case elapsed >= c.deliverAfter:
+		return &TrackingUpdate{Status: protocol.DeliveryStatusDelivered}, nil
+	case elapsed >= c.dispatchAfter:
+		return &TrackingUpdate{Status: protocol.DeliveryStatusDispatched}, nil
+	default:
+		return &TrackingUpdate{Status: protocol.DeliveryStatusScheduled}, nil
+	}
+}
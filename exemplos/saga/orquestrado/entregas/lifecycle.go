@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+	"saga/participant"
+	"saga/protocol"
+)
+
+// deliveryEventsTopic recebe os eventos do ciclo de vida das entregas,
+// consumidos pelo orquestrador (devoluções) e pelo serviço de pedidos
+const deliveryEventsTopic = "entregas-events"
+
+// lifecyclePath retorna os status a percorrer para levar a entrega de from
+// até to, sem pular etapas: uma entrega que a transportadora já informa como
+// entregue passa antes por DISPATCHED. Retorna nil se não há o que avançar.
+func lifecyclePath(from, to string) []string {
+	final := to == protocol.DeliveryStatusDelivered || to == protocol.DeliveryStatusReturned
+
+	switch {
+	case from == protocol.DeliveryStatusScheduled && to == protocol.DeliveryStatusDispatched:
+		return []string{to}
+	case from == protocol.DeliveryStatusScheduled && final:
+		return []string{protocol.DeliveryStatusDispatched, to}
+	case from == protocol.DeliveryStatusDispatched && final:
+		return []string{to}
+	}
+	return nil
+}
+
+// trackDeliveries consulta periodicamente a transportadora sobre as entregas
+// em andamento e publica os eventos registrados
+func (s *DeliveryService) trackDeliveries(ctx context.Context) {
+	interval, err := time.ParseDuration(participant.Env("CARRIER_POLL_INTERVAL", "5s"))
+	if err != nil {
+		log.Printf("CARRIER_POLL_INTERVAL inválido, usando 5s: %v", err)
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Acompanhamento das entregas iniciado (intervalo: %s)", interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.checkDeliveries(ctx); err != nil {
+				log.Printf("Erro ao consultar entregas: %v", err)
+			}
+			if err := s.relayEvents(); err != nil {
+				log.Printf("Erro ao publicar eventos de entrega: %v", err)
+			}
+		}
+	}
+}
+
+// checkDeliveries avança as entregas cujo status mudou na transportadora
+func (s *DeliveryService) checkDeliveries(ctx context.Context) error {
+	rows, err := s.db.Query(
+		`SELECT id, saga_id, order_id, address, status, tracking_number, created_at
+		 FROM deliveries WHERE status IN ($1, $2) ORDER BY created_at LIMIT 100`,
+		protocol.DeliveryStatusScheduled, protocol.DeliveryStatusDispatched,
+	)
+	if err != nil {
+		return err
+	}
+
+	var active []*Delivery
+	for rows.Next() {
+		d := &Delivery{}
+		if err := rows.Scan(&d.ID, &d.SagaID, &d.OrderID, &d.Address, &d.Status,
+			&d.TrackingNumber, &d.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		active = append(active, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range active {
+		update, err := s.carrier.Track(ctx, d)
+		if err != nil {
+			log.Printf("Erro ao rastrear entrega %s (%s): %v", d.ID, d.TrackingNumber, err)
+			continue
+		}
+
+		path := lifecyclePath(d.Status, update.Status)
+		if len(path) == 0 {
+			continue
+		}
+
+		if err := s.advanceDelivery(d, path, update.Reason); err != nil {
+			log.Printf("Erro ao atualizar entrega %s: %v", d.ID, err)
+		}
+	}
+	return nil
+}
+
+// advanceDelivery aplica os status do caminho em uma transação; o motivo
+// informado pela transportadora fica no último deles
+func (s *DeliveryService) advanceDelivery(d *Delivery, path []string, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	from := d.Status
+	for i, status := range path {
+		statusReason := ""
+		if i == len(path)-1 {
+			statusReason = reason
+		}
+		if err := s.setDeliveryStatus(tx, d, from, status, statusReason); err != nil {
+			return err
+		}
+		from = status
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Entrega %s (SAGA %s): %s -> %s", d.ID, d.SagaID, d.Status, from)
+	return nil
+}
+
+// setDeliveryStatus muda o status da entrega e registra o evento em
+// delivery_events na mesma transação. Falha se a entrega não estava em from.
+func (s *DeliveryService) setDeliveryStatus(tx *sql.Tx, d *Delivery, from, to, reason string) error {
+	result, err := tx.Exec(
+		`UPDATE deliveries SET status = $1, status_reason = NULLIF($2, ''), updated_at = CURRENT_TIMESTAMP
+		 WHERE id = $3 AND status = $4`,
+		to, reason, d.ID, from,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("entrega %s não está mais no status %s", d.ID, from)
+	}
+
+	return s.recordEvent(tx, d, to, reason)
+}
+
+// recordEvent grava o evento no outbox delivery_events; o envio ao Kafka é
+// feito por relayEvents depois do commit
+func (s *DeliveryService) recordEvent(tx *sql.Tx, d *Delivery, status, reason string) error {
+	event := protocol.NewDeliveryEvent(d.ID, d.SagaID, d.OrderID, status)
+	event.TrackingNumber = d.TrackingNumber
+	event.Carrier = s.carrier.Name()
+	event.Reason = reason
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO delivery_events (event_id, delivery_id, saga_id, status, payload)
+		 VALUES ($1, $2, $3, $4, $5) ON CONFLICT (event_id) DO NOTHING`,
+		event.EventID, d.ID, d.SagaID, status, payload,
+	)
+	return err
+}
+
+// relayEvents publica os eventos pendentes na ordem em que foram gravados.
+// Uma falha entre o envio e a marcação resulta em reenvio; os consumidores
+// descartam repetições pelo event_id.
+func (s *DeliveryService) relayEvents() error {
+	rows, err := s.db.Query(
+		`SELECT id, saga_id, payload FROM delivery_events
+		 WHERE sent_at IS NULL ORDER BY id LIMIT 100`,
+	)
+	if err != nil {
+		return err
+	}
+
+	type pendingEvent struct {
+		id      int64
+		sagaID  string
+		payload []byte
+	}
+	var pending []pendingEvent
+	for rows.Next() {
+		var e pendingEvent
+		if err := rows.Scan(&e.id, &e.sagaID, &e.payload); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range pending {
+		// A chave mantém os eventos da mesma SAGA na mesma partição, em ordem
+		msg := &sarama.ProducerMessage{
+			Topic: deliveryEventsTopic,
+			Key:   sarama.StringEncoder(e.sagaID),
+			Value: sarama.ByteEncoder(e.payload),
+		}
+		if _, _, err := s.producer.SendMessage(msg); err != nil {
+			return err
+		}
+
+		if _, err := s.db.Exec(
+			"UPDATE delivery_events SET sent_at = CURRENT_TIMESTAMP WHERE id = $1", e.id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
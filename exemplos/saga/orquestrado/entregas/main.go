@@ -3,38 +3,22 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/IBM/sarama"
-	_ "github.com/lib/pq"
+	"saga/ids"
+	"saga/participant"
+	"saga/protocol"
 )
 
-// Command representa um comando recebido do orquestrador
-type Command struct {
-	CommandID   string                 `json:"command_id"`
-	SagaID      string                 `json:"saga_id"`
-	OrderID     string                 `json:"order_id"`
-	CommandType string                 `json:"command_type"`
-	Payload     map[string]interface{} `json:"payload"`
-	Timestamp   time.Time              `json:"timestamp"`
-}
-
-// Reply representa uma resposta para o orquestrador
-type Reply struct {
-	ReplyID   string                 `json:"reply_id"`
-	CommandID string                 `json:"command_id"`
-	SagaID    string                 `json:"saga_id"`
-	Success   bool                   `json:"success"`
-	Message   string                 `json:"message"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
-}
+// Command e Reply são as mensagens do protocolo da SAGA
+type (
+	Command = protocol.Command
+	Reply   = protocol.Reply
+)
 
 // Delivery representa uma entrega
 type Delivery struct {
@@ -45,6 +29,7 @@ type Delivery struct {
 	ScheduledDate  time.Time `json:"scheduled_date"`
 	Status         string    `json:"status"`
 	TrackingNumber string    `json:"tracking_number"`
+	Carrier        string    `json:"carrier"`
 	CreatedAt      time.Time `json:"created_at"`
 }
 
@@ -52,84 +37,40 @@ type Delivery struct {
 type DeliveryService struct {
 	db       *sql.DB
 	producer sarama.SyncProducer
-	consumer sarama.ConsumerGroup
+	carrier  Carrier
 }
 
 func main() {
 	log.Println("Iniciando Serviço de Entregas...")
 
-	// Conectar ao banco de dados
-	db, err := connectDB()
+	// Banco, Kafka, idempotência, tracing e métricas ficam com a biblioteca
+	p, err := participant.New(participant.Config{Name: "entregas", EchoPayload: true})
 	if err != nil {
-		log.Fatal("Erro ao conectar no banco:", err)
+		log.Fatal("Erro ao iniciar participante:", err)
 	}
-	defer db.Close()
 
 	// Inicializar schema
-	if err := initSchema(db); err != nil {
+	if err := initSchema(p.DB); err != nil {
 		log.Fatal("Erro ao inicializar schema:", err)
 	}
 
-	// Configurar Kafka Producer
-	producer, err := setupProducer()
-	if err != nil {
-		log.Fatal("Erro ao configurar producer:", err)
-	}
-	defer producer.Close()
-
-	// Configurar Kafka Consumer
-	consumer, err := setupConsumer()
+	// Configurar a transportadora
+	carrier, err := newCarrier(p.DB)
 	if err != nil {
-		log.Fatal("Erro ao configurar consumer:", err)
+		log.Fatal("Erro ao configurar transportadora:", err)
 	}
-	defer consumer.Close()
 
 	service := &DeliveryService{
-		db:       db,
-		producer: producer,
-		consumer: consumer,
+		db:       p.DB,
+		producer: p.Producer,
+		carrier:  carrier,
 	}
 
-	// Iniciar consumo de comandos
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go service.consumeCommands(ctx)
-
-	// Aguardar sinal de término
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-	<-sigterm
+	p.Handle(protocol.CommandScheduleDelivery, service.handleScheduleDelivery)
+	p.Compensate(protocol.CommandCancelDelivery, service.handleCancelDelivery)
+	p.Go(service.trackDeliveries)
 
-	log.Println("Encerrando Serviço de Entregas...")
-}
-
-func connectDB() (*sql.DB, error) {
-	host := getEnv("DB_HOST", "localhost")
-	port := getEnv("DB_PORT", "5432")
-	user := getEnv("DB_USER", "postgres")
-	password := getEnv("DB_PASSWORD", "postgres")
-	dbname := getEnv("DB_NAME", "entregas")
-
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	// Tentar conectar com retry
-	for i := 0; i < 30; i++ {
-		if err = db.Ping(); err == nil {
-			log.Println("Conectado ao banco de dados")
-			return db, nil
-		}
-		log.Printf("⏳ Aguardando banco de dados... (%d/30)", i+1)
-		time.Sleep(2 * time.Second)
-	}
-
-	return nil, fmt.Errorf("timeout ao conectar no banco")
+	p.Run()
 }
 
 func initSchema(db *sql.DB) error {
@@ -146,6 +87,25 @@ func initSchema(db *sql.DB) error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_saga_id ON deliveries(saga_id);
+
+	ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS carrier VARCHAR(50);
+	ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS status_reason TEXT;
+	ALTER TABLE deliveries ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS idx_deliveries_status ON deliveries(status);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_deliveries_tracking_number ON deliveries(tracking_number);
+
+	CREATE TABLE IF NOT EXISTS delivery_events (
+		id BIGSERIAL PRIMARY KEY,
+		event_id VARCHAR(150) NOT NULL UNIQUE,
+		delivery_id VARCHAR(100) NOT NULL,
+		saga_id VARCHAR(100) NOT NULL,
+		status VARCHAR(50) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_delivery_events_pending ON delivery_events(id) WHERE sent_at IS NULL;
 	`
 
 	_, err := db.Exec(schema)
@@ -157,224 +117,191 @@ func initSchema(db *sql.DB) error {
 	return nil
 }
 
-func setupProducer() (sarama.SyncProducer, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
-
-	config := sarama.NewConfig()
-	config.Producer.Return.Successes = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Retry.Max = 5
-
-	producer, err := sarama.NewSyncProducer(brokers, config)
-	if err != nil {
+// handleScheduleDelivery agenda a entrega na transportadora
+func (s *DeliveryService) handleScheduleDelivery(ctx context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	var payload protocol.ScheduleDelivery
+	if err := protocol.Decode(cmd, &payload); err != nil {
 		return nil, err
 	}
 
-	log.Println("Kafka Producer configurado")
-	return producer, nil
-}
-
-func setupConsumer() (sarama.ConsumerGroup, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
-
-	config := sarama.NewConfig()
-	config.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
-
-	consumer, err := sarama.NewConsumerGroup(brokers, "entregas-group", config)
+	delivery, err := s.scheduleDelivery(ctx, tx, cmd, &payload)
 	if err != nil {
+		log.Printf("❌ Falha ao agendar entrega (SAGA: %s): %v", cmd.SagaID, err)
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			return nil, participant.Reject(rejected)
+		}
 		return nil, err
 	}
 
-	log.Println("Kafka Consumer configurado")
-	return consumer, nil
+	log.Printf("Entrega agendada: %s (Tracking: %s)",
+		delivery.ScheduledDate.Format("02/01/2006"), delivery.TrackingNumber)
+	return &participant.Result{
+		Message: "Entrega agendada com sucesso",
+		Data: protocol.DeliveryScheduled{
+			DeliveryID:     delivery.ID,
+			TrackingNumber: delivery.TrackingNumber,
+			ScheduledDate:  delivery.ScheduledDate.Format(time.RFC3339),
+		},
+	}, nil
 }
 
-// consumeCommands consome comandos do orquestrador
-func (s *DeliveryService) consumeCommands(ctx context.Context) {
-	topics := []string{"entregas-commands"}
-	handler := &ConsumerHandler{service: s}
-
-	for {
-		if err := s.consumer.Consume(ctx, topics, handler); err != nil {
-			log.Printf("Erro ao consumir mensagens: %v", err)
-		}
-
-		if ctx.Err() != nil {
-			return
-		}
+// handleCancelDelivery cancela a entrega (compensação)
+func (s *DeliveryService) handleCancelDelivery(ctx context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	if err := s.cancelDelivery(ctx, tx, cmd.SagaID); err != nil {
+		return nil, fmt.Errorf("Erro ao cancelar entrega: %w", err)
 	}
-}
 
-// ConsumerHandler implementa sarama.ConsumerGroupHandler
-type ConsumerHandler struct {
-	service *DeliveryService
+	log.Printf("Entrega cancelada (SAGA: %s)", cmd.SagaID)
+	return &participant.Result{Message: "Entrega cancelada com sucesso"}, nil
 }
 
-func (h *ConsumerHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
-func (h *ConsumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
-
-func (h *ConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		var cmd Command
-		if err := json.Unmarshal(message.Value, &cmd); err != nil {
-			log.Printf("Erro ao deserializar comando: %v", err)
-			session.MarkMessage(message, "")
-			continue
-		}
-
-		log.Printf("Comando recebido: %s (SAGA: %s)", cmd.CommandType, cmd.SagaID)
-
-		// Processar comando
-		reply := h.service.processCommand(&cmd)
-
-		// Enviar resposta
-		if err := h.service.sendReply(reply); err != nil {
-			log.Printf("❌ Erro ao enviar reply: %v", err)
-		}
-
-		session.MarkMessage(message, "")
+// scheduleDelivery agenda a entrega na transportadora e a registra com o
+// evento SCHEDULED. Recusas da transportadora retornam *RejectedError. Se a
+// entrega não puder ser registrada, a reserva é cancelada.
+func (s *DeliveryService) scheduleDelivery(ctx context.Context, tx *sql.Tx, cmd *Command, payload *protocol.ScheduleDelivery) (*Delivery, error) {
+	shipment, err := s.carrier.Schedule(ctx, ShipmentRequest{
+		Reference: cmd.SagaID,
+		OrderID:   payload.OrderID,
+		Address:   payload.Address,
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
 
-// processCommand processa um comando e retorna uma resposta
-func (s *DeliveryService) processCommand(cmd *Command) *Reply {
-	reply := &Reply{
-		ReplyID:   generateID(),
-		CommandID: cmd.CommandID,
-		SagaID:    cmd.SagaID,
-		Timestamp: time.Now(),
-		Data:      make(map[string]interface{}),
-	}
-	
-	// Copiar payload para Data se existir
-	if cmd.Payload != nil {
-		for k, v := range cmd.Payload {
-			reply.Data[k] = v
-		}
+	// Etapa reenviada pelo orquestrador: a transportadora devolve a reserva
+	// da SAGA, que já pode ter sido registrada por um comando anterior
+	existing := &Delivery{}
+	err = tx.QueryRow(
+		`SELECT id, saga_id, order_id, address, scheduled_date, status, tracking_number, COALESCE(carrier, ''), created_at
+		 FROM deliveries WHERE tracking_number = $1`,
+		shipment.TrackingNumber,
+	).Scan(&existing.ID, &existing.SagaID, &existing.OrderID, &existing.Address, &existing.ScheduledDate,
+		&existing.Status, &existing.TrackingNumber, &existing.Carrier, &existing.CreatedAt)
+	if err == nil {
+		return existing, nil
 	}
-
-	switch cmd.CommandType {
-	case "SCHEDULE_DELIVERY":
-		// Agendar entrega (mockado)
-		delivery := s.scheduleDelivery(cmd)
-		if delivery != nil {
-			reply.Success = true
-			reply.Message = "Entrega agendada com sucesso"
-			reply.Data["delivery_id"] = delivery.ID
-			reply.Data["tracking_number"] = delivery.TrackingNumber
-			reply.Data["scheduled_date"] = delivery.ScheduledDate.Format(time.RFC3339)
-			log.Printf("Entrega agendada: %s (Tracking: %s)",
-				delivery.ScheduledDate.Format("02/01/2006"), delivery.TrackingNumber)
-		} else {
-			reply.Success = false
-			reply.Message = "Falha ao agendar entrega"
-			log.Printf("Falha ao agendar entrega")
-		}
-
-	case "CANCEL_DELIVERY":
-		// Cancelar entrega (compensação)
-		if err := s.cancelDelivery(cmd.SagaID); err != nil {
-			reply.Success = false
-			reply.Message = fmt.Sprintf("Erro ao cancelar entrega: %v", err)
-			log.Printf("❌ Erro ao cancelar entrega: %v", err)
-		} else {
-			reply.Success = true
-			reply.Message = "Entrega cancelada com sucesso"
-			log.Printf("Entrega cancelada (SAGA: %s)", cmd.SagaID)
-		}
-
-	default:
-		reply.Success = false
-		reply.Message = fmt.Sprintf("Comando desconhecido: %s", cmd.CommandType)
-		log.Printf("Comando desconhecido: %s", cmd.CommandType)
+	if err != sql.ErrNoRows {
+		return nil, err
 	}
 
-	return reply
-}
-
-// scheduleDelivery agenda uma entrega (mockado)
-func (s *DeliveryService) scheduleDelivery(cmd *Command) *Delivery {
-	// Simulação de agendamento de entrega
-	// Sempre sucede - última etapa da SAGA
-
-	scheduledDate := time.Now().Add(48 * time.Hour) // 2 dias a partir de agora
-
 	delivery := &Delivery{
-		ID:             generateID(),
+		ID:             ids.New(),
 		SagaID:         cmd.SagaID,
-		OrderID:        getStringFromPayload(cmd.Payload, "order_id", ""),
-		Address:        getStringFromPayload(cmd.Payload, "address", "Rua Exemplo, 123"),
-		ScheduledDate:  scheduledDate,
-		Status:         "SCHEDULED",
-		TrackingNumber: fmt.Sprintf("TRK-%d", time.Now().Unix()),
+		OrderID:        payload.OrderID,
+		Address:        payload.Address,
+		ScheduledDate:  shipment.ScheduledDate,
+		Status:         protocol.DeliveryStatusScheduled,
+		TrackingNumber: shipment.TrackingNumber,
+		Carrier:        s.carrier.Name(),
 		CreatedAt:      time.Now(),
 	}
 
 	// Persistir no banco
-	_, err := s.db.Exec(
-		`INSERT INTO deliveries (id, saga_id, order_id, address, scheduled_date, status, tracking_number)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+	_, err = tx.Exec(
+		`INSERT INTO deliveries (id, saga_id, order_id, address, scheduled_date, status, tracking_number, carrier, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
 		delivery.ID, delivery.SagaID, delivery.OrderID, delivery.Address,
-		delivery.ScheduledDate, delivery.Status, delivery.TrackingNumber,
+		delivery.ScheduledDate, delivery.Status, delivery.TrackingNumber, delivery.Carrier, delivery.CreatedAt,
 	)
-
+	if err == nil {
+		err = s.recordEvent(tx, delivery, delivery.Status, "")
+	}
 	if err != nil {
-		log.Printf("❌ Erro ao salvar entrega: %v", err)
-		return nil
+		// A reserva já foi confirmada na transportadora: sem a entrega
+		// registrada, ela ocuparia a capacidade do dia até a compensação
+		if cancelErr := s.carrier.Cancel(ctx, shipment.TrackingNumber); cancelErr != nil {
+			log.Printf("Erro ao cancelar a reserva %s (SAGA: %s): %v", shipment.TrackingNumber, cmd.SagaID, cancelErr)
+		}
+		return nil, err
 	}
 
-	return delivery
+	return delivery, nil
 }
 
-// cancelDelivery cancela uma entrega
-func (s *DeliveryService) cancelDelivery(sagaID string) error {
-	_, err := s.db.Exec(
-		"UPDATE deliveries SET status = 'CANCELLED' WHERE saga_id = $1",
-		sagaID,
+// cancelDelivery cancela as entregas da SAGA. Uma entrega já despachada não
+// pode mais ser cancelada: a transportadora a devolve ao remetente e o comando
+// é recusado com ErrorCodeAwaitingReturn, para que o orquestrador o repita
+// depois da devolução. Entregas canceladas ou devolvidas são ignoradas, o que
+// torna a compensação idempotente; uma entrega já realizada a faz falhar.
+// Sem nenhuma entrega registrada, a reserva é cancelada pela referência.
+func (s *DeliveryService) cancelDelivery(ctx context.Context, tx *sql.Tx, sagaID string) error {
+	rows, err := tx.Query(
+		`SELECT id, saga_id, order_id, status, tracking_number FROM deliveries
+		 WHERE saga_id = $1 AND status IN ($2, $3, $4) FOR UPDATE`,
+		sagaID, protocol.DeliveryStatusScheduled, protocol.DeliveryStatusDispatched, protocol.DeliveryStatusDelivered,
 	)
-	return err
-}
-
-// sendReply envia uma resposta para o orquestrador
-func (s *DeliveryService) sendReply(reply *Reply) error {
-	data, err := json.Marshal(reply)
 	if err != nil {
 		return err
 	}
 
-	msg := &sarama.ProducerMessage{
-		Topic: "entregas-reply",
-		Value: sarama.ByteEncoder(data),
+	var deliveries []*Delivery
+	for rows.Next() {
+		d := &Delivery{}
+		if err := rows.Scan(&d.ID, &d.SagaID, &d.OrderID, &d.Status, &d.TrackingNumber); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
 	}
-
-	_, _, err = s.producer.SendMessage(msg)
-	if err != nil {
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return err
 	}
 
-	log.Printf("Reply enviado: Success=%t, Message=%s", reply.Success, reply.Message)
-	return nil
-}
+	if len(deliveries) == 0 {
+		return s.cancelUnregisteredBooking(ctx, tx, sagaID)
+	}
 
-// Funções auxiliares
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
+	for _, d := range deliveries {
+		if d.Status == protocol.DeliveryStatusDelivered {
+			return participant.Reject(fmt.Errorf("entrega %s já realizada", d.ID))
+		}
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+		err := s.carrier.Cancel(ctx, d.TrackingNumber)
+		if errors.Is(err, ErrReturnRequested) {
+			return participant.Fail(
+				fmt.Errorf("entrega %s já despachada, aguardando devolução", d.ID),
+				protocol.DeliveryAwaitingReturn{
+					ErrorCode:      protocol.ErrorCodeAwaitingReturn,
+					DeliveryID:     d.ID,
+					TrackingNumber: d.TrackingNumber,
+				},
+			)
+		}
+		if errors.Is(err, ErrAlreadyDelivered) {
+			return participant.Reject(fmt.Errorf("entrega %s já realizada", d.ID))
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.setDeliveryStatus(tx, d, d.Status, protocol.DeliveryStatusCancelled, ""); err != nil {
+			return err
+		}
 	}
-	return defaultValue
+	return nil
 }
 
-func getStringFromPayload(payload map[string]interface{}, key, defaultValue string) string {
-	if val, ok := payload[key]; ok {
-		if strVal, ok := val.(string); ok {
-			return strVal
-		}
+// cancelUnregisteredBooking cancela a reserva da SAGA na transportadora
+// quando nenhuma entrega foi registrada: o agendamento pode ter reservado a
+// coleta e falhado antes de confirmar a transação local (ou expirado no
+// orquestrador antes de responder). Uma entrega sem registro nunca foi
+// entregue à transportadora pelo serviço, então uma reserva que ela já
+// considera despachada ou entregue é apenas registrada no log.
+func (s *DeliveryService) cancelUnregisteredBooking(ctx context.Context, tx *sql.Tx, sagaID string) error {
+	var registered bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM deliveries WHERE saga_id = $1)", sagaID).Scan(&registered); err != nil {
+		return err
 	}
-	return defaultValue
+	if registered {
+		return nil
+	}
+
+	err := s.carrier.CancelReference(ctx, sagaID)
+	if errors.Is(err, ErrReturnRequested) || errors.Is(err, ErrAlreadyDelivered) {
+		log.Printf("Reserva da SAGA %s sem entrega registrada não cancelada: %v", sagaID, err)
+		return nil
+	}
+	return err
 }
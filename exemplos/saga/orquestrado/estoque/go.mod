@@ -2,12 +2,10 @@ module estoque
 
 go 1.23
 
-require (
-	github.com/IBM/sarama v1.43.0
-	github.com/lib/pq v1.10.9
-)
+require saga v0.0.0
 
 require (
+	github.com/IBM/sarama v1.43.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/eapache/go-resiliency v1.6.0 // indirect
 	github.com/eapache/go-xerial-snappy v0.0.0-20230731223053-c322873962e3 // indirect
@@ -22,8 +20,12 @@ require (
 	github.com/jcmturner/gokrb5/v8 v8.4.4 // indirect
 	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
 	github.com/klauspost/compress v1.17.7 // indirect
+	github.com/lib/pq v1.10.9 // indirect
 	github.com/pierrec/lz4/v4 v4.1.21 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475 // indirect
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
 )
+
+// Pacotes compartilhados entre os serviços da SAGA
+replace saga => ../saga
@@ -6,36 +6,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	"os"
-	"os/signal"
-	"syscall"
+	"sort"
 	"time"
 
-	"github.com/IBM/sarama"
-	_ "github.com/lib/pq"
+	"saga/deadletter"
+	"saga/ids"
+	"saga/participant"
+	"saga/protocol"
 )
 
-// Command representa um comando recebido do orquestrador
-type Command struct {
-	CommandID   string                 `json:"command_id"`
-	SagaID      string                 `json:"saga_id"`
-	OrderID     string                 `json:"order_id"`
-	CommandType string                 `json:"command_type"`
-	Payload     map[string]interface{} `json:"payload"`
-	Timestamp   time.Time              `json:"timestamp"`
-}
-
-// Reply representa uma resposta para o orquestrador
-type Reply struct {
-	ReplyID   string                 `json:"reply_id"`
-	CommandID string                 `json:"command_id"`
-	SagaID    string                 `json:"saga_id"`
-	Success   bool                   `json:"success"`
-	Message   string                 `json:"message"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
-}
+// Command e Reply são as mensagens do protocolo da SAGA
+type (
+	Command = protocol.Command
+	Reply   = protocol.Reply
+)
 
 // StockReservation representa uma reserva de estoque
 type StockReservation struct {
@@ -47,92 +31,85 @@ type StockReservation struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// StockService gerencia o estoque
-type StockService struct {
-	db       *sql.DB
-	producer sarama.SyncProducer
-	consumer sarama.ConsumerGroup
+// Product representa um item do catálogo com as quantidades em estoque.
+// Reserved é a parte de OnHand comprometida com SAGAs em andamento.
+type Product struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	OnHand   int    `json:"on_hand"`
+	Reserved int    `json:"reserved"`
 }
 
-func main() {
-	log.Println("Iniciando Serviço de Estoque...")
-
-	// Conectar ao banco de dados
-	db, err := connectDB()
-	if err != nil {
-		log.Fatal("Erro ao conectar no banco:", err)
-	}
-	defer db.Close()
-
-	// Inicializar schema
-	if err := initSchema(db); err != nil {
-		log.Fatal("Erro ao inicializar schema:", err)
-	}
-
-	// Configurar Kafka Producer
-	producer, err := setupProducer()
-	if err != nil {
-		log.Fatal("Erro ao configurar producer:", err)
-	}
-	defer producer.Close()
+// Available retorna a quantidade que ainda pode ser reservada
+func (p *Product) Available() int {
+	return p.OnHand - p.Reserved
+}
 
-	// Configurar Kafka Consumer
-	consumer, err := setupConsumer()
-	if err != nil {
-		log.Fatal("Erro ao configurar consumer:", err)
-	}
-	defer consumer.Close()
+// errShortStock indica que a reserva falhou por falta de estoque
+type errShortStock struct {
+	Item    protocol.ShortItem
+	Unknown bool
+}
 
-	service := &StockService{
-		db:       db,
-		producer: producer,
-		consumer: consumer,
+func (e *errShortStock) Error() string {
+	if e.Unknown {
+		return fmt.Sprintf("Produto %s não cadastrado", e.Item.ProductID)
 	}
+	return fmt.Sprintf("Estoque insuficiente para o produto %s (solicitado: %d, disponível: %d)",
+		e.Item.ProductID, e.Item.Requested, e.Item.Available)
+}
 
-	// Iniciar consumo de comandos
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go service.consumeCommands(ctx)
+// seedProducts é o catálogo inicial. PROD-005 tem pouco estoque para que
+// as reservas falhem por falta do item depois de alguns pedidos.
+var seedProducts = []Product{
+	{ID: "PROD-001", Name: "Notebook", OnHand: 100},
+	{ID: "PROD-002", Name: "Monitor", OnHand: 100},
+	{ID: "PROD-003", Name: "Teclado", OnHand: 100},
+	{ID: "PROD-004", Name: "Mouse", OnHand: 100},
+	{ID: "PROD-005", Name: "Headset", OnHand: 15},
+}
 
-	// Aguardar sinal de término
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-	<-sigterm
+// Tópico de conclusão da SAGA: as reservas dos pedidos concluídos são baixadas do estoque
+const completedTopic = "pedido-saga-pedido-processado"
 
-	log.Println("Encerrando Serviço de Estoque...")
+// StockService gerencia o estoque
+type StockService struct {
+	db *sql.DB
 }
 
-func connectDB() (*sql.DB, error) {
-	host := getEnv("DB_HOST", "localhost")
-	port := getEnv("DB_PORT", "5432")
-	user := getEnv("DB_USER", "postgres")
-	password := getEnv("DB_PASSWORD", "postgres")
-	dbname := getEnv("DB_NAME", "estoque")
-
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+func main() {
+	log.Println("Iniciando Serviço de Estoque...")
 
-	db, err := sql.Open("postgres", psqlInfo)
+	// Banco, Kafka, idempotência, tracing e métricas ficam com a biblioteca
+	p, err := participant.New(participant.Config{Name: "estoque", EchoPayload: true})
 	if err != nil {
-		return nil, err
+		log.Fatal("Erro ao iniciar participante:", err)
 	}
 
-	// Tentar conectar com retry
-	for i := 0; i < 30; i++ {
-		if err = db.Ping(); err == nil {
-			log.Println("Conectado ao banco de dados")
-			return db, nil
-		}
-		log.Printf("⏳ Aguardando banco de dados... (%d/30)", i+1)
-		time.Sleep(2 * time.Second)
+	// Inicializar schema
+	if err := initSchema(p.DB); err != nil {
+		log.Fatal("Erro ao inicializar schema:", err)
 	}
 
-	return nil, fmt.Errorf("timeout ao conectar no banco")
+	service := &StockService{db: p.DB}
+
+	p.Handle(protocol.CommandReserveStock, service.handleReserveStock)
+	p.Compensate(protocol.CommandReleaseStock, service.handleReleaseStock)
+	p.Subscribe(completedTopic, service.handleSagaCompleted)
+
+	p.Run()
 }
 
 func initSchema(db *sql.DB) error {
 	schema := `
+	CREATE TABLE IF NOT EXISTS products (
+		id VARCHAR(100) PRIMARY KEY,
+		name VARCHAR(200) NOT NULL,
+		on_hand INTEGER NOT NULL CHECK (on_hand >= 0),
+		reserved INTEGER NOT NULL DEFAULT 0 CHECK (reserved >= 0 AND reserved <= on_hand),
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
 	CREATE TABLE IF NOT EXISTS stock_reservations (
 		id VARCHAR(100) PRIMARY KEY,
 		saga_id VARCHAR(100) NOT NULL,
@@ -143,6 +120,10 @@ func initSchema(db *sql.DB) error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_saga_id ON stock_reservations(saga_id);
+
+	-- No máximo uma reserva ativa por produto em cada SAGA
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_reservations_active
+		ON stock_reservations(saga_id, product_id) WHERE status = 'RESERVED';
 	`
 
 	_, err := db.Exec(schema)
@@ -150,235 +131,226 @@ func initSchema(db *sql.DB) error {
 		return err
 	}
 
+	// Cadastrar o catálogo inicial sem sobrescrever quantidades já existentes
+	for _, p := range seedProducts {
+		_, err := db.Exec(
+			"INSERT INTO products (id, name, on_hand) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
+			p.ID, p.Name, p.OnHand,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Println("Schema do banco inicializado")
 	return nil
 }
 
-func setupProducer() (sarama.SyncProducer, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
-
-	config := sarama.NewConfig()
-	config.Producer.Return.Successes = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Retry.Max = 5
-
-	producer, err := sarama.NewSyncProducer(brokers, config)
-	if err != nil {
+// handleReserveStock reserva os itens do pedido
+func (s *StockService) handleReserveStock(_ context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	var payload protocol.ReserveStock
+	if err := protocol.Decode(cmd, &payload); err != nil {
 		return nil, err
 	}
 
-	log.Println("Kafka Producer configurado")
-	return producer, nil
-}
-
-func setupConsumer() (sarama.ConsumerGroup, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
-
-	config := sarama.NewConfig()
-	config.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
-
-	consumer, err := sarama.NewConsumerGroup(brokers, "estoque-group", config)
-	if err != nil {
-		return nil, err
+	reservations, err := s.reserveStock(tx, cmd, &payload)
+	if err == nil {
+		reservationIDs := make([]string, len(reservations))
+		for i, r := range reservations {
+			reservationIDs[i] = r.ID
+		}
+		log.Printf("Estoque reservado: %d item(ns) (SAGA: %s)", len(reservations), cmd.SagaID)
+		return &participant.Result{
+			Message: "Estoque reservado com sucesso",
+			Data:    protocol.StockReserved{ReservationIDs: reservationIDs},
+		}, nil
 	}
 
-	log.Println("Kafka Consumer configurado")
-	return consumer, nil
+	if short, ok := err.(*errShortStock); ok {
+		// Informar ao orquestrador qual item faltou
+		return nil, participant.Fail(err, protocol.StockShortage{ShortItem: short.Item})
+	}
+	return nil, err
 }
 
-// consumeCommands consome comandos do orquestrador
-func (s *StockService) consumeCommands(ctx context.Context) {
-	topics := []string{"estoque-commands"}
-	handler := &ConsumerHandler{service: s}
-
-	for {
-		if err := s.consumer.Consume(ctx, topics, handler); err != nil {
-			log.Printf("Erro ao consumir mensagens: %v", err)
-		}
-
-		if ctx.Err() != nil {
-			return
-		}
+// handleReleaseStock libera o estoque reservado (compensação)
+func (s *StockService) handleReleaseStock(_ context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	if err := s.releaseStock(tx, cmd.SagaID); err != nil {
+		return nil, fmt.Errorf("Erro ao liberar estoque: %w", err)
 	}
-}
 
-// ConsumerHandler implementa sarama.ConsumerGroupHandler
-type ConsumerHandler struct {
-	service *StockService
+	log.Printf("Estoque liberado (SAGA: %s)", cmd.SagaID)
+	return &participant.Result{Message: "Estoque liberado com sucesso"}, nil
 }
 
-func (h *ConsumerHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
-func (h *ConsumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
-
-func (h *ConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		var cmd Command
-		if err := json.Unmarshal(message.Value, &cmd); err != nil {
-			log.Printf("Erro ao deserializar comando: %v", err)
-			session.MarkMessage(message, "")
-			continue
-		}
-
-		log.Printf("Comando recebido: %s (SAGA: %s)", cmd.CommandType, cmd.SagaID)
-
-		// Processar comando
-		reply := h.service.processCommand(&cmd)
-
-		// Enviar resposta
-		if err := h.service.sendReply(reply); err != nil {
-			log.Printf("❌ Erro ao enviar reply: %v", err)
+// reserveStock reserva todos os itens do pedido na transação do comando. A
+// reserva é tudo ou nada: se faltar algum item a transação é desfeita, e
+// outras SAGAs nunca enxergam uma reserva parcial. As linhas dos produtos são
+// bloqueadas em ordem de product_id, para que SAGAs concorrentes com itens em
+// comum não entrem em deadlock, e ficam bloqueadas até o commit, para que não
+// reservem a mesma unidade.
+func (s *StockService) reserveStock(tx *sql.Tx, cmd *Command, payload *protocol.ReserveStock) ([]*StockReservation, error) {
+	items := make([]protocol.LineItem, len(payload.Items))
+	copy(items, payload.Items)
+	sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+
+	reservations := make([]*StockReservation, 0, len(items))
+	for _, item := range items {
+		reservation, err := s.reserveItem(tx, cmd.SagaID, item)
+		if err != nil {
+			return nil, err
 		}
-
-		session.MarkMessage(message, "")
+		reservations = append(reservations, reservation)
 	}
-	return nil
+	return reservations, nil
 }
 
-// processCommand processa um comando e retorna uma resposta
-func (s *StockService) processCommand(cmd *Command) *Reply {
-	reply := &Reply{
-		ReplyID:   generateID(),
-		CommandID: cmd.CommandID,
-		SagaID:    cmd.SagaID,
-		Timestamp: time.Now(),
-		Data:      make(map[string]interface{}),
-	}
-	
-	// Copiar payload para Data se existir
-	if cmd.Payload != nil {
-		for k, v := range cmd.Payload {
-			reply.Data[k] = v
-		}
+// reserveItem bloqueia a linha do produto e reserva a quantidade pedida se
+// houver estoque disponível. Se o comando for reprocessado, a reserva ativa
+// da SAGA para o produto é reaproveitada.
+func (s *StockService) reserveItem(tx *sql.Tx, sagaID string, item protocol.LineItem) (*StockReservation, error) {
+	reservation := &StockReservation{
+		ID:        ids.New(),
+		SagaID:    sagaID,
+		ProductID: item.ProductID,
+		Quantity:  item.Quantity,
+		Status:    "RESERVED",
+		CreatedAt: time.Now(),
 	}
 
-	switch cmd.CommandType {
-	case "RESERVE_STOCK":
-		// Reservar estoque (mockado com chance de falha)
-		reservation := s.reserveStock(cmd)
-		if reservation != nil {
-			reply.Success = true
-			reply.Message = "Estoque reservado com sucesso"
-			reply.Data["reservation_id"] = reservation.ID
-			log.Printf("Estoque reservado: %d unidades do produto %s",
-				reservation.Quantity, reservation.ProductID)
-		} else {
-			reply.Success = false
-			reply.Message = "Estoque insuficiente"
-			log.Printf("Estoque insuficiente")
-		}
+	var product Product
+	err := tx.QueryRow(
+		"SELECT id, on_hand, reserved FROM products WHERE id = $1 FOR UPDATE",
+		reservation.ProductID,
+	).Scan(&product.ID, &product.OnHand, &product.Reserved)
 
-	case "RELEASE_STOCK":
-		// Liberar estoque (compensação)
-		if err := s.releaseStock(cmd.SagaID); err != nil {
-			reply.Success = false
-			reply.Message = fmt.Sprintf("Erro ao liberar estoque: %v", err)
-			log.Printf("❌ Erro ao liberar estoque: %v", err)
-		} else {
-			reply.Success = true
-			reply.Message = "Estoque liberado com sucesso"
-			log.Printf("Estoque liberado (SAGA: %s)", cmd.SagaID)
+	if err == sql.ErrNoRows {
+		return nil, &errShortStock{
+			Item:    protocol.ShortItem{ProductID: reservation.ProductID, Requested: reservation.Quantity},
+			Unknown: true,
 		}
-
-	default:
-		reply.Success = false
-		reply.Message = fmt.Sprintf("Comando desconhecido: %s", cmd.CommandType)
-		log.Printf("Comando desconhecido: %s", cmd.CommandType)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return reply
-}
+	var existing string
+	err = tx.QueryRow(
+		"SELECT id FROM stock_reservations WHERE saga_id = $1 AND product_id = $2 AND status = 'RESERVED'",
+		sagaID, reservation.ProductID,
+	).Scan(&existing)
+	if err == nil {
+		reservation.ID = existing
+		return reservation, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
 
-// reserveStock reserva estoque (mockado)
-func (s *StockService) reserveStock(cmd *Command) *StockReservation {
-	// Simulação de verificação de estoque
-	// 10% de chance de falha para demonstrar compensação
-	if rand.Intn(100) < 10 {
-		log.Println("Simulando falha de estoque insuficiente")
-		return nil
+	if product.Available() < reservation.Quantity {
+		return nil, &errShortStock{Item: protocol.ShortItem{
+			ProductID: product.ID,
+			Requested: reservation.Quantity,
+			Available: product.Available(),
+		}}
 	}
 
-	reservation := &StockReservation{
-		ID:        generateID(),
-		SagaID:    cmd.SagaID,
-		ProductID: getStringFromPayload(cmd.Payload, "product_id", "PROD-001"),
-		Quantity:  getIntFromPayload(cmd.Payload, "quantity", 1),
-		Status:    "RESERVED",
-		CreatedAt: time.Now(),
+	if _, err := tx.Exec(
+		"UPDATE products SET reserved = reserved + $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		reservation.Quantity, product.ID,
+	); err != nil {
+		return nil, err
 	}
 
-	// Persistir no banco
-	_, err := s.db.Exec(
+	if _, err := tx.Exec(
 		`INSERT INTO stock_reservations (id, saga_id, product_id, quantity, status)
 		 VALUES ($1, $2, $3, $4, $5)`,
 		reservation.ID, reservation.SagaID, reservation.ProductID,
 		reservation.Quantity, reservation.Status,
-	)
-
-	if err != nil {
-		log.Printf("❌ Erro ao salvar reserva: %v", err)
-		return nil
+	); err != nil {
+		return nil, err
 	}
 
-	return reservation
+	return reservation, nil
 }
 
-// releaseStock libera estoque
-func (s *StockService) releaseStock(sagaID string) error {
-	_, err := s.db.Exec(
-		"UPDATE stock_reservations SET status = 'RELEASED' WHERE saga_id = $1",
-		sagaID,
-	)
-	return err
+// releaseStock devolve ao estoque as quantidades ainda reservadas pela SAGA.
+// Reservas já liberadas são ignoradas, o que torna a compensação idempotente.
+func (s *StockService) releaseStock(tx *sql.Tx, sagaID string) error {
+	return s.settleReservations(tx, sagaID, "RELEASED",
+		"UPDATE products SET reserved = reserved - $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2")
 }
 
-// sendReply envia uma resposta para o orquestrador
-func (s *StockService) sendReply(reply *Reply) error {
-	data, err := json.Marshal(reply)
-	if err != nil {
-		return err
+// handleSagaCompleted baixa do estoque as reservas de uma SAGA concluída:
+// as unidades deixam de estar reservadas e saem do saldo em mãos. SAGAs que
+// falharam também são publicadas no tópico e são ignoradas aqui.
+func (s *StockService) handleSagaCompleted(data []byte) error {
+	var event struct {
+		SagaID string `json:"saga_id"`
+		Status string `json:"status"`
 	}
-
-	msg := &sarama.ProducerMessage{
-		Topic: "estoque-reply",
-		Value: sarama.ByteEncoder(data),
+	if err := json.Unmarshal(data, &event); err != nil {
+		return deadletter.Permanent(fmt.Errorf("evento de conclusão inválido: %w", err))
+	}
+	if event.SagaID == "" {
+		return deadletter.Permanent(fmt.Errorf("evento de conclusão sem saga_id"))
+	}
+	if event.Status != "COMPLETED" {
+		return nil
 	}
 
-	_, _, err = s.producer.SendMessage(msg)
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	log.Printf("Reply enviado: Success=%t, Message=%s", reply.Success, reply.Message)
+	err = s.settleReservations(tx, event.SagaID, "COMMITTED",
+		`UPDATE products SET on_hand = on_hand - $1, reserved = reserved - $1, updated_at = CURRENT_TIMESTAMP
+		 WHERE id = $2`)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("erro ao baixar reservas da SAGA %s: %w", event.SagaID, err)
+	}
+	log.Printf("Reservas da SAGA %s baixadas do estoque", event.SagaID)
 	return nil
 }
 
-// Funções auxiliares
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// settleReservations encerra as reservas ativas da SAGA com o status
+// informado, aplicando productUpdate ($1 = quantidade, $2 = produto) a cada uma
+func (s *StockService) settleReservations(tx *sql.Tx, sagaID, status, productUpdate string) error {
+	rows, err := tx.Query(
+		`SELECT id, product_id, quantity FROM stock_reservations
+		 WHERE saga_id = $1 AND status = 'RESERVED' ORDER BY product_id FOR UPDATE`,
+		sagaID,
+	)
+	if err != nil {
+		return err
 	}
-	return defaultValue
-}
 
-func getStringFromPayload(payload map[string]interface{}, key, defaultValue string) string {
-	if val, ok := payload[key]; ok {
-		if strVal, ok := val.(string); ok {
-			return strVal
+	var reservations []StockReservation
+	for rows.Next() {
+		var r StockReservation
+		if err := rows.Scan(&r.ID, &r.ProductID, &r.Quantity); err != nil {
+			rows.Close()
+			return err
 		}
+		reservations = append(reservations, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	return defaultValue
-}
 
-func getIntFromPayload(payload map[string]interface{}, key string, defaultValue int) int {
-	if val, ok := payload[key]; ok {
-		if intVal, ok := val.(float64); ok {
-			return int(intVal)
+	for _, r := range reservations {
+		if _, err := tx.Exec(productUpdate, r.Quantity, r.ProductID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE stock_reservations SET status = $1 WHERE id = $2", status, r.ID); err != nil {
+			return err
 		}
 	}
-	return defaultValue
+	return nil
 }
@@ -0,0 +1,8 @@
+module gateway-fake
+
+go 1.23
+
+require saga v0.0.0
+
+// Pacotes compartilhados entre os serviços da SAGA
+replace saga => ../saga
@@ -0,0 +1,373 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"saga/ids"
+)
+
+// Operações do gateway
+const (
+	OpAuthorize = "authorize"
+	OpCapture   = "capture"
+	OpVoid      = "void"
+	OpRefund    = "refund"
+)
+
+// Resultados possíveis de uma regra
+const (
+	OutcomeApprove = "approve"
+	OutcomeDecline = "decline"
+	OutcomeTimeout = "timeout"
+	OutcomeError   = "error"
+)
+
+// Status das autorizações
+const (
+	StatusAuthorized = "AUTHORIZED"
+	StatusCaptured   = "CAPTURED"
+	StatusVoided     = "VOIDED"
+	StatusRefunded   = "REFUNDED"
+)
+
+//go:embed gateway-rules.json
+var defaultRules []byte
+
+// Rule define o comportamento do gateway para as requisições que casam com
+// ela. A primeira regra que casar vence; sem regra, a operação é aprovada.
+type Rule struct {
+	Name       string  `json:"name"`
+	Operation  string  `json:"operation,omitempty"`
+	CardSuffix string  `json:"card_suffix,omitempty"`
+	MinAmount  float64 `json:"min_amount,omitempty"`
+	MaxAmount  float64 `json:"max_amount,omitempty"`
+	Outcome    string  `json:"outcome"`
+	Reason     string  `json:"reason,omitempty"`
+	DelayMs    int     `json:"delay_ms,omitempty"`
+}
+
+// matches verifica se a regra se aplica à operação. Em capture, void e refund
+// o cartão e o valor são os da autorização original.
+func (r *Rule) matches(operation, cardNumber string, amount float64) bool {
+	op := r.Operation
+	if op == "" {
+		op = OpAuthorize
+	}
+	if op != operation {
+		return false
+	}
+	if r.CardSuffix != "" && !strings.HasSuffix(cardNumber, r.CardSuffix) {
+		return false
+	}
+	if r.MinAmount > 0 && amount < r.MinAmount {
+		return false
+	}
+	if r.MaxAmount > 0 && amount > r.MaxAmount {
+		return false
+	}
+	return true
+}
+
+// Authorization é uma autorização e o que aconteceu com ela depois
+type Authorization struct {
+	ID         string    `json:"id"`
+	CardNumber string    `json:"-"`
+	Amount     float64   `json:"amount"`
+	Currency   string    `json:"currency"`
+	Reference  string    `json:"reference"`
+	Status     string    `json:"status"`
+	CaptureID  string    `json:"capture_id,omitempty"`
+	RefundID   string    `json:"refund_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Gateway guarda as operações em memória
+type Gateway struct {
+	mu             sync.Mutex
+	rules          []Rule
+	authorizations map[string]*Authorization
+	captures       map[string]*Authorization
+	references     map[string]*Authorization
+}
+
+func main() {
+	rules, err := loadRules(getEnv("GATEWAY_RULES", ""))
+	if err != nil {
+		log.Fatal("Erro ao carregar regras do gateway:", err)
+	}
+
+	gateway := &Gateway{
+		rules:          rules,
+		authorizations: make(map[string]*Authorization),
+		captures:       make(map[string]*Authorization),
+		references:     make(map[string]*Authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /authorizations", gateway.handleAuthorize)
+	mux.HandleFunc("GET /authorizations/{id}", gateway.handleGet)
+	mux.HandleFunc("POST /authorizations/{id}/capture", gateway.handleCapture)
+	mux.HandleFunc("POST /authorizations/{id}/void", gateway.handleVoid)
+	mux.HandleFunc("POST /captures/{id}/refund", gateway.handleRefund)
+	mux.HandleFunc("GET /rules", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, gateway.rules)
+	})
+
+	addr := ":" + getEnv("HTTP_PORT", "8081")
+	log.Printf("Gateway de pagamento fake ouvindo em %s com %d regra(s)", addr, len(rules))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal("Erro no servidor HTTP:", err)
+	}
+}
+
+// loadRules lê as regras do arquivo informado ou usa as regras embutidas
+func loadRules(path string) ([]Rule, error) {
+	data := defaultRules
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		switch rule.Outcome {
+		case OutcomeApprove, OutcomeDecline, OutcomeTimeout, OutcomeError:
+		default:
+			return nil, fmt.Errorf("regra %d (%s): outcome inválido %q", i, rule.Name, rule.Outcome)
+		}
+		switch rule.Operation {
+		case "", OpAuthorize, OpCapture, OpVoid, OpRefund:
+		default:
+			return nil, fmt.Errorf("regra %d (%s): operation inválida %q", i, rule.Name, rule.Operation)
+		}
+	}
+
+	return rules, nil
+}
+
+// apply executa a primeira regra que casar. Retorna true se a requisição já
+// foi respondida (recusa, erro ou timeout).
+func (g *Gateway) apply(w http.ResponseWriter, r *http.Request, operation, cardNumber string, amount float64) bool {
+	var rule *Rule
+	for i := range g.rules {
+		if g.rules[i].matches(operation, cardNumber, amount) {
+			rule = &g.rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return false
+	}
+
+	if rule.DelayMs > 0 {
+		select {
+		case <-time.After(time.Duration(rule.DelayMs) * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}
+
+	log.Printf("Regra %s aplicada em %s (cartão final %s, R$ %.2f): %s",
+		rule.Name, operation, lastDigits(cardNumber), amount, rule.Outcome)
+
+	switch rule.Outcome {
+	case OutcomeDecline:
+		writeJSON(w, http.StatusPaymentRequired, map[string]string{"error": "declined", "reason": rule.Reason})
+	case OutcomeError:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal_error"})
+	case OutcomeTimeout:
+		// Sem resposta útil: o cliente já desistiu ou recebe 504
+		writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": "timeout"})
+	default:
+		return false
+	}
+	return true
+}
+
+func (g *Gateway) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CardNumber string  `json:"card_number"`
+		Amount     float64 `json:"amount"`
+		Currency   string  `json:"currency"`
+		Reference  string  `json:"reference"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if req.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_amount"})
+		return
+	}
+
+	// Reenvio da mesma referência (ex: após timeout do cliente) devolve a
+	// autorização já criada em vez de reter o valor duas vezes
+	g.mu.Lock()
+	existing, ok := g.references[req.Reference]
+	g.mu.Unlock()
+	if ok && req.Reference != "" {
+		writeJSON(w, http.StatusCreated, map[string]string{"id": existing.ID, "status": StatusAuthorized})
+		return
+	}
+
+	if g.apply(w, r, OpAuthorize, req.CardNumber, req.Amount) {
+		return
+	}
+
+	auth := &Authorization{
+		ID:         ids.NewWithPrefix("AUTH"),
+		CardNumber: req.CardNumber,
+		Amount:     req.Amount,
+		Currency:   req.Currency,
+		Reference:  req.Reference,
+		Status:     StatusAuthorized,
+		CreatedAt:  time.Now(),
+	}
+
+	g.mu.Lock()
+	g.authorizations[auth.ID] = auth
+	if auth.Reference != "" {
+		g.references[auth.Reference] = auth
+	}
+	g.mu.Unlock()
+
+	log.Printf("Autorização %s aprovada: R$ %.2f (ref: %s)", auth.ID, auth.Amount, auth.Reference)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": auth.ID, "status": auth.Status})
+}
+
+func (g *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	auth, ok := g.authorizations[r.PathValue("id")]
+	var snapshot Authorization
+	if ok {
+		snapshot = *auth
+	}
+	g.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// handleCapture captura a autorização. Capturar de novo devolve a mesma captura.
+func (g *Gateway) handleCapture(w http.ResponseWriter, r *http.Request) {
+	auth, ok := g.lookup(w, g.authorizations, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if g.apply(w, r, OpCapture, auth.CardNumber, auth.Amount) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch auth.Status {
+	case StatusCaptured, StatusRefunded:
+	case StatusAuthorized:
+		auth.Status = StatusCaptured
+		auth.CaptureID = ids.NewWithPrefix("CAP")
+		g.captures[auth.CaptureID] = auth
+		log.Printf("Autorização %s capturada: %s", auth.ID, auth.CaptureID)
+	default:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "invalid_state", "reason": auth.Status})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": auth.CaptureID, "status": StatusCaptured})
+}
+
+// handleVoid cancela uma autorização não capturada. É idempotente.
+func (g *Gateway) handleVoid(w http.ResponseWriter, r *http.Request) {
+	auth, ok := g.lookup(w, g.authorizations, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if g.apply(w, r, OpVoid, auth.CardNumber, auth.Amount) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch auth.Status {
+	case StatusVoided:
+	case StatusAuthorized:
+		auth.Status = StatusVoided
+		log.Printf("Autorização %s cancelada", auth.ID)
+	default:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "invalid_state", "reason": auth.Status})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": auth.ID, "status": StatusVoided})
+}
+
+// handleRefund estorna uma captura. Estornar de novo devolve o mesmo estorno.
+func (g *Gateway) handleRefund(w http.ResponseWriter, r *http.Request) {
+	auth, ok := g.lookup(w, g.captures, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if g.apply(w, r, OpRefund, auth.CardNumber, auth.Amount) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if auth.Status == StatusCaptured {
+		auth.Status = StatusRefunded
+		auth.RefundID = ids.NewWithPrefix("REF")
+		log.Printf("Captura %s estornada: %s", auth.CaptureID, auth.RefundID)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": auth.RefundID, "status": StatusRefunded})
+}
+
+// lookup busca o registro pelo id e responde 404 quando não existe
+func (g *Gateway) lookup(w http.ResponseWriter, index map[string]*Authorization, id string) (*Authorization, bool) {
+	g.mu.Lock()
+	auth, ok := index[id]
+	g.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+	}
+	return auth, ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func lastDigits(cardNumber string) string {
+	if len(cardNumber) <= 4 {
+		return cardNumber
+	}
+	return cardNumber[len(cardNumber)-4:]
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
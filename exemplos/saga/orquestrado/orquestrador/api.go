@@ -0,0 +1,515 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SagaSummary representa o estado atual de uma SAGA na listagem
+type SagaSummary struct {
+	SagaID     string     `json:"saga_id"`
+	OrderID    string     `json:"order_id"`
+	State      SagaState  `json:"state"`
+	Step       string     `json:"step,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Version    int64      `json:"version"`
+}
+
+// SagaTimelineEntry representa um evento da linha do tempo de uma SAGA
+type SagaTimelineEntry struct {
+	State     SagaState       `json:"state"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// SagaCommandEntry representa um comando emitido pelo orquestrador para a SAGA
+type SagaCommandEntry struct {
+	CommandID   string    `json:"command_id"`
+	Step        string    `json:"step"`
+	Kind        string    `json:"kind"`
+	CommandType string    `json:"command_type"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Deadline    time.Time `json:"deadline"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// adminRequest é o corpo opcional das ações administrativas
+type adminRequest struct {
+	Note string `json:"note"`
+}
+
+// startAPI inicia o servidor HTTP de consulta e administração das SAGAs
+func (o *Orchestrator) startAPI() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sagas", o.listSagas)
+	mux.HandleFunc("GET /sagas/{id}", o.getSaga)
+	mux.HandleFunc("POST /sagas/{id}/retry", o.retrySaga)
+	mux.HandleFunc("POST /sagas/{id}/compensate", o.compensateSaga)
+	mux.HandleFunc("POST /sagas/{id}/resolve", o.resolveSaga)
+	mux.Handle("GET /metrics", o.metrics.registry)
+
+	// Painel web: os streams abertos são encerrados junto com o servidor
+	streams := make(chan struct{})
+	mux.HandleFunc("GET /dashboard", o.dashboardPage)
+	mux.HandleFunc("GET /dashboard/stream", o.dashboardStream(streams))
+
+	server := &http.Server{
+		Addr:              ":" + getEnv("HTTP_PORT", "8080"),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	server.RegisterOnShutdown(func() { close(streams) })
+
+	go func() {
+		log.Printf("API HTTP disponível em %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Erro no servidor HTTP: %v", err)
+		}
+	}()
+
+	return server
+}
+
+// GET /sagas - Listar SAGAs filtrando por estado atual (?state=) e início (?from=, ?to= em RFC3339)
+func (o *Orchestrator) listSagas(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT saga_id, order_id, state, COALESCE(step, ''), COALESCE(last_error, ''),
+			started_at, updated_at, finished_at, version
+		FROM saga_instances`
+
+	var conditions []string
+	var args []interface{}
+
+	if state := r.URL.Query().Get("state"); state != "" {
+		args = append(args, strings.ToUpper(state))
+		conditions = append(conditions, fmt.Sprintf("state = $%d", len(args)))
+	}
+
+	for param, operator := range map[string]string{"from": ">=", "to": "<="} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Parâmetro %s inválido, use RFC3339", param))
+			return
+		}
+		args = append(args, t)
+		conditions = append(conditions, fmt.Sprintf("started_at %s $%d", operator, len(args)))
+	}
+
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "Parâmetro limit inválido")
+			return
+		}
+		limit = n
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY started_at DESC LIMIT $%d", len(args))
+
+	rows, err := o.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Erro ao listar SAGAs: %v", err)
+		writeError(w, http.StatusInternalServerError, "Erro ao buscar SAGAs")
+		return
+	}
+	defer rows.Close()
+
+	sagas := []SagaSummary{}
+	for rows.Next() {
+		var s SagaSummary
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&s.SagaID, &s.OrderID, &s.State, &s.Step, &s.Error,
+			&s.StartedAt, &s.UpdatedAt, &finishedAt, &s.Version); err != nil {
+			writeError(w, http.StatusInternalServerError, "Erro ao processar SAGAs")
+			return
+		}
+		if finishedAt.Valid {
+			s.FinishedAt = &finishedAt.Time
+		}
+		sagas = append(sagas, s)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sagas": sagas,
+		"total": len(sagas),
+	})
+}
+
+// GET /sagas/{id} - Linha do tempo completa da SAGA com dados, erros e comandos
+func (o *Orchestrator) getSaga(w http.ResponseWriter, r *http.Request) {
+	sagaID := r.PathValue("id")
+
+	rows, err := o.db.Query(
+		`SELECT state, data, COALESCE(error, ''), created_at
+		 FROM saga_events WHERE saga_id = $1 ORDER BY id`,
+		sagaID,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Erro ao buscar eventos")
+		return
+	}
+	defer rows.Close()
+
+	timeline := []SagaTimelineEntry{}
+	for rows.Next() {
+		var entry SagaTimelineEntry
+		var data []byte
+		if err := rows.Scan(&entry.State, &data, &entry.Error, &entry.CreatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "Erro ao processar eventos")
+			return
+		}
+		if len(data) > 0 && string(data) != "null" {
+			entry.Data = data
+		}
+		timeline = append(timeline, entry)
+	}
+
+	if len(timeline) == 0 {
+		writeError(w, http.StatusNotFound, "SAGA não encontrada")
+		return
+	}
+
+	commands, err := o.sagaCommands(sagaID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Erro ao buscar comandos")
+		return
+	}
+
+	root, err := o.sagaSpanContext(sagaID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Erro ao buscar trace")
+		return
+	}
+
+	response := map[string]interface{}{
+		"saga_id":  sagaID,
+		"state":    timeline[len(timeline)-1].State,
+		"timeline": timeline,
+		"commands": commands,
+	}
+	if root.IsValid() {
+		response["trace_id"] = root.TraceID.String()
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (o *Orchestrator) sagaCommands(sagaID string) ([]SagaCommandEntry, error) {
+	rows, err := o.db.Query(
+		`SELECT command_id, step, kind, command->>'command_type', status, attempts, deadline, created_at
+		 FROM saga_deadlines WHERE saga_id = $1 ORDER BY created_at`,
+		sagaID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := []SagaCommandEntry{}
+	for rows.Next() {
+		var c SagaCommandEntry
+		if err := rows.Scan(&c.CommandID, &c.Step, &c.Kind, &c.CommandType, &c.Status,
+			&c.Attempts, &c.Deadline, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+	return commands, rows.Err()
+}
+
+// POST /sagas/{id}/retry - Reenviar a etapa atual ou a compensação que falhou
+func (o *Orchestrator) retrySaga(w http.ResponseWriter, r *http.Request) {
+	sagaID := r.PathValue("id")
+
+	state, version, ok := o.adminState(w, sagaID)
+	if !ok {
+		return
+	}
+
+	if isTerminal(state) || state == StateCompensating {
+		writeError(w, http.StatusConflict, fmt.Sprintf("SAGA no estado %s não pode ser reenviada", state))
+		return
+	}
+
+	err := o.withTx(func(o *Orchestrator) error {
+		if err := o.lockAdminSaga(sagaID, version); err != nil {
+			return err
+		}
+		switch state {
+		case StateCompensationFailed:
+			return o.retryFailedCompensation(sagaID)
+		case StateRefunding, StateRefundFailed:
+			return o.resendRefund(sagaID)
+		}
+		return o.retryCurrentStep(sagaID, state)
+	})
+	if err != nil {
+		log.Printf("Erro ao reenviar SAGA %s: %v", sagaID, err)
+		writeAdminError(w, err, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"saga_id": sagaID, "action": "retry"})
+}
+
+// POST /sagas/{id}/compensate - Forçar a compensação de uma SAGA em andamento
+func (o *Orchestrator) compensateSaga(w http.ResponseWriter, r *http.Request) {
+	sagaID := r.PathValue("id")
+	req := decodeAdminRequest(r)
+
+	state, version, ok := o.adminState(w, sagaID)
+	if !ok {
+		return
+	}
+
+	if isTerminal(state) || state == StateCompensating || state == StateCompensationFailed || isRefundState(state) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("SAGA no estado %s não pode ser compensada", state))
+		return
+	}
+
+	reason := "Compensação forçada manualmente"
+	if req.Note != "" {
+		reason += ": " + req.Note
+	}
+
+	err := o.withTx(func(o *Orchestrator) error {
+		if err := o.lockAdminSaga(sagaID, version); err != nil {
+			return err
+		}
+		if err := o.cancelPendingCommands(sagaID); err != nil {
+			return err
+		}
+		return o.startCompensation(sagaID, state, CompensationCauseManual, reason)
+	})
+	if err != nil {
+		log.Printf("Erro ao compensar SAGA %s: %v", sagaID, err)
+		writeAdminError(w, err, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"saga_id": sagaID, "action": "compensate"})
+}
+
+// POST /sagas/{id}/resolve - Marcar a SAGA como resolvida manualmente
+func (o *Orchestrator) resolveSaga(w http.ResponseWriter, r *http.Request) {
+	sagaID := r.PathValue("id")
+	req := decodeAdminRequest(r)
+
+	state, version, ok := o.adminState(w, sagaID)
+	if !ok {
+		return
+	}
+
+	if isTerminal(state) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("SAGA já finalizada no estado %s", state))
+		return
+	}
+
+	err := o.withTx(func(o *Orchestrator) error {
+		if err := o.lockAdminSaga(sagaID, version); err != nil {
+			return err
+		}
+		if err := o.cancelPendingCommands(sagaID); err != nil {
+			return err
+		}
+		return o.saveEvent(&SagaEvent{
+			SagaID:    sagaID,
+			State:     StateResolved,
+			Data:      map[string]interface{}{"previous_state": state, "note": req.Note},
+			Timestamp: time.Now(),
+		})
+	})
+	if err != nil {
+		log.Printf("Erro ao resolver SAGA %s: %v", sagaID, err)
+		writeAdminError(w, err, "Erro ao salvar evento")
+		return
+	}
+
+	log.Printf("SAGA %s marcada como resolvida manualmente (estado anterior: %s)", sagaID, state)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"saga_id": sagaID, "action": "resolve"})
+}
+
+// adminState busca o estado atual e a versão da SAGA respondendo 404 se ela
+// não existir
+func (o *Orchestrator) adminState(w http.ResponseWriter, sagaID string) (SagaState, int64, bool) {
+	state, version, err := o.sagaStateVersion(sagaID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "SAGA não encontrada")
+		return "", 0, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Erro ao buscar SAGA")
+		return "", 0, false
+	}
+	return state, version, true
+}
+
+// lockAdminSaga bloqueia a SAGA e confirma que ela continua na versão em que
+// o estado foi validado. Um reply processado por outra réplica nesse meio
+// tempo faz a operação ser recusada em vez de aplicada sobre outro estado.
+func (o *Orchestrator) lockAdminSaga(sagaID string, version int64) error {
+	if err := o.lockSaga(sagaID); err != nil {
+		return err
+	}
+
+	_, current, err := o.sagaStateVersion(sagaID)
+	if err != nil {
+		return err
+	}
+	if current != version {
+		return fmt.Errorf("%w: %s (versão %d, esperada %d)", errSagaChanged, sagaID, current, version)
+	}
+
+	o.expectVersion(sagaID, version)
+	return nil
+}
+
+// writeAdminError responde 409 quando a SAGA mudou durante a operação
+func writeAdminError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, errSagaChanged) {
+		writeError(w, http.StatusConflict, "SAGA alterada durante a operação; consulte o estado e tente novamente")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, message)
+}
+
+// retryCurrentStep descarta o comando pendente e envia novamente a etapa
+// seguinte ao estado atual, usando os dados registrados nesse estado. Em um
+// estado parcial são reenviados apenas os ramos do grupo ainda não concluídos.
+func (o *Orchestrator) retryCurrentStep(sagaID string, state SagaState) error {
+	index := o.definition.NextStepIndex(state)
+	if index >= len(o.definition.Steps) {
+		return fmt.Errorf("nenhuma etapa a executar a partir de %s", state)
+	}
+
+	// O payload do grupo é o mesmo para todos os ramos: o do estado anterior a ele
+	if o.definition.IsPartialState(state) {
+		state = o.definition.StateBefore(o.definition.Steps[index].Name)
+	}
+
+	var orderID string
+	var data []byte
+	err := o.db.QueryRow(
+		`SELECT order_id, data FROM saga_events
+		 WHERE saga_id = $1 AND state = $2 ORDER BY id DESC LIMIT 1`,
+		sagaID, state,
+	).Scan(&orderID, &data)
+	if err != nil {
+		return err
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return err
+	}
+
+	if err := o.cancelPendingCommands(sagaID); err != nil {
+		return err
+	}
+
+	log.Printf("Reenvio manual da etapa %s (SAGA %s)", o.definition.Steps[index].Name, sagaID)
+	return o.dispatchStep(index, sagaID, orderID, payload)
+}
+
+// retryFailedCompensation retoma a compensação a partir da etapa que falhou
+func (o *Orchestrator) retryFailedCompensation(sagaID string) error {
+	var data []byte
+	err := o.db.QueryRow(
+		`SELECT data FROM saga_events
+		 WHERE saga_id = $1 AND state = $2 ORDER BY id DESC LIMIT 1`,
+		sagaID, StateCompensationFailed,
+	).Scan(&data)
+	if err != nil {
+		return err
+	}
+
+	var failed struct {
+		Step string `json:"step"`
+	}
+	if err := json.Unmarshal(data, &failed); err != nil {
+		return err
+	}
+
+	step, ok := o.definition.StepByName(failed.Step)
+	if !ok {
+		return fmt.Errorf("etapa desconhecida: %s", failed.Step)
+	}
+
+	reason, err := o.compensationReason(sagaID)
+	if err != nil {
+		return err
+	}
+
+	if err := o.saveEvent(&SagaEvent{
+		SagaID:    sagaID,
+		State:     StateCompensating,
+		Error:     reason,
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("Reenvio manual da compensação %s (SAGA %s)", step.CompensationCommandType, sagaID)
+	return o.sendCompensation(step, sagaID)
+}
+
+// cancelPendingCommands encerra os comandos ainda pendentes da SAGA para que
+// o watchdog não os reenvie e replies atrasados sejam rejeitados
+func (o *Orchestrator) cancelPendingCommands(sagaID string) error {
+	_, err := o.db.Exec(
+		"UPDATE saga_deadlines SET status = $1 WHERE saga_id = $2 AND status IN ($3, $4)",
+		DeadlineExpired, sagaID, DeadlinePending, DeadlineScheduled,
+	)
+	return err
+}
+
+// isTerminal indica se a SAGA já foi finalizada
+func isTerminal(state SagaState) bool {
+	return state == StateCompleted || state == StateFailed || state == StateResolved || state == StateRefunded
+}
+
+// isRefundState indica se a SAGA concluída está no fluxo de estorno
+func isRefundState(state SagaState) bool {
+	return state == StateRefunding || state == StateRefunded || state == StateRefundFailed
+}
+
+func decodeAdminRequest(r *http.Request) adminRequest {
+	var req adminRequest
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&req)
+	}
+	return req
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Erro ao serializar resposta: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
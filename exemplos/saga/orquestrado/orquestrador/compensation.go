@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"saga/ids"
+	"saga/protocol"
+)
+
+// Causas de uma compensação, usadas nas métricas
+const (
+	CompensationCauseStepFailed = "step_failed"
+	CompensationCauseTimeout    = "timeout"
+	CompensationCauseManual     = "manual"
+)
+
+// startCompensation inicia o processo de compensação. As compensações são
+// enviadas uma por vez, na ordem inversa das etapas concluídas, e a SAGA só
+// chega a FAILED depois que todas forem confirmadas pelos participantes.
+func (o *Orchestrator) startCompensation(sagaID string, currentState SagaState, cause, errorMsg string) error {
+	// Compensar a partir da última etapa concluída
+	return o.startCompensationFrom(sagaID, o.definition.StepByState(currentState), cause, errorMsg)
+}
+
+// startCompensationFrom inicia a compensação a partir do índice informado.
+// Uma etapa que expirou sem reply é compensada junto com as concluídas: não
+// se sabe se o participante a executou, e as compensações são idempotentes.
+func (o *Orchestrator) startCompensationFrom(sagaID string, index int, cause, errorMsg string) error {
+	log.Printf("Iniciando compensação para SAGA %s. Motivo: %s", sagaID, errorMsg)
+	o.observeCompensation(cause)
+
+	// Salvar evento de compensação
+	event := &SagaEvent{
+		SagaID:    sagaID,
+		State:     StateCompensating,
+		Error:     errorMsg,
+		Timestamp: time.Now(),
+	}
+
+	if err := o.saveEvent(event); err != nil {
+		return err
+	}
+
+	return o.compensateFrom(sagaID, index)
+}
+
+// compensateFrom envia a compensação da etapa mais recente, a partir do índice
+// informado, que declara compensation_command_type. Quando não há mais etapas
+// a compensar a SAGA é marcada como FAILED.
+func (o *Orchestrator) compensateFrom(sagaID string, index int) error {
+	for i := index; i >= 0; i-- {
+		sent, err := o.compensateStep(sagaID, i)
+		if err != nil || sent {
+			return err
+		}
+	}
+
+	reason, err := o.compensationReason(sagaID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Compensação da SAGA %s concluída", sagaID)
+
+	if err := o.publishFailure(sagaID, StateFailed, reason); err != nil {
+		return err
+	}
+
+	// Marcar SAGA como falhada
+	return o.saveEvent(&SagaEvent{
+		SagaID:    sagaID,
+		State:     StateFailed,
+		Error:     reason,
+		Timestamp: time.Now(),
+	})
+}
+
+// compensateStep envia a compensação da etapa ou, em um grupo paralelo, as
+// compensações de todos os ramos cujo comando foi enviado. Um ramo que falhou
+// ou expirou também é compensado: o participante pode tê-lo executado sem que
+// o reply chegasse, e as compensações são idempotentes. Retorna false se não
+// havia nada a compensar.
+func (o *Orchestrator) compensateStep(sagaID string, index int) (bool, error) {
+	step := o.definition.Steps[index]
+	if !step.IsGroup() {
+		if step.CompensationCommandType == "" {
+			return false, nil
+		}
+		return true, o.sendCompensation(step, sagaID)
+	}
+
+	sent := false
+	for _, branch := range step.Parallel {
+		if branch.CompensationCommandType == "" {
+			continue
+		}
+
+		last, err := o.latestCommand(sagaID, branch.Name, CommandKindStep)
+		if err != nil {
+			return false, err
+		}
+		if last == nil {
+			continue
+		}
+
+		if err := o.sendCompensation(branch, sagaID); err != nil {
+			return false, err
+		}
+		sent = true
+	}
+	return sent, nil
+}
+
+func (o *Orchestrator) sendCompensation(step SagaStep, sagaID string) error {
+	cmd, err := o.newCompensationCommand(step, sagaID)
+	if err != nil {
+		return err
+	}
+
+	// Registrar o comando para que o reply da compensação seja correlacionado
+	if err := o.registerDeadline(step, CommandKindCompensation, cmd); err != nil {
+		return err
+	}
+
+	return o.sendCommand(step.CommandTopic, cmd)
+}
+
+// newCompensationCommand monta o comando de compensação com o order_id da SAGA
+func (o *Orchestrator) newCompensationCommand(step SagaStep, sagaID string) (*Command, error) {
+	orderID, err := o.sagaOrderID(sagaID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Command{
+		CommandID:   ids.New(),
+		SagaID:      sagaID,
+		OrderID:     orderID,
+		CommandType: step.CompensationCommandType,
+		Timestamp:   time.Now(),
+	}, nil
+}
+
+// handleCompensationReply avança para a próxima compensação quando o
+// participante confirma, ou agenda uma nova tentativa em caso de falha. Em
+// um grupo paralelo só avança depois que todos os ramos forem compensados.
+func (o *Orchestrator) handleCompensationReply(cmd *outstandingCommand, reply *Reply, currentState SagaState) error {
+	index := o.definition.StepIndex(cmd.Step)
+	step, _ := o.definition.StepByName(cmd.Step)
+
+	if !reply.Success {
+		// Entrega já despachada: o cancelamento é repetido depois da devolução
+		if code, _ := reply.Data["error_code"].(string); code == protocol.ErrorCodeAwaitingReturn {
+			return o.awaitReturn(cmd.SagaID, step, cmd.Attempts, reply.Message)
+		}
+		return o.scheduleCompensationRetry(cmd.SagaID, step, cmd.Attempts, reply.Message)
+	}
+
+	log.Printf("Compensação %s confirmada (SAGA %s)", step.CompensationCommandType, cmd.SagaID)
+
+	pending, err := o.hasPendingCompensation(cmd.SagaID)
+	if err != nil {
+		return err
+	}
+	if pending {
+		log.Printf("SAGA %s aguardando as demais compensações do grupo %s", cmd.SagaID, o.definition.Steps[index].Name)
+		return nil
+	}
+
+	// Outro ramo do grupo esgotou as tentativas: a SAGA aguarda intervenção manual
+	if currentState == StateCompensationFailed {
+		return nil
+	}
+
+	return o.compensateFrom(cmd.SagaID, index-1)
+}
+
+// hasPendingCompensation indica se ainda há compensação aguardando resposta
+// ou nova tentativa na SAGA
+func (o *Orchestrator) hasPendingCompensation(sagaID string) (bool, error) {
+	var count int
+	err := o.db.QueryRow(
+		`SELECT COUNT(*) FROM saga_deadlines
+		 WHERE saga_id = $1 AND kind = $2 AND status IN ($3, $4)`,
+		sagaID, CommandKindCompensation, DeadlinePending, DeadlineScheduled,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// scheduleCompensationRetry agenda um novo comando de compensação após o
+// backoff. Um novo command_id é usado porque o participante guarda o reply
+// de falha do comando anterior.
+func (o *Orchestrator) scheduleCompensationRetry(sagaID string, step SagaStep, attempts int, errorMsg string) error {
+	if attempts > o.definition.CompensationMaxRetries {
+		return o.failCompensation(sagaID, step, attempts, errorMsg)
+	}
+
+	backoff := o.definition.CompensationBackoff(attempts)
+	cmd, err := o.newCompensationCommand(step, sagaID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Compensação %s falhou (SAGA %s): %s. Nova tentativa em %s (%d/%d)",
+		step.CompensationCommandType, sagaID, errorMsg, backoff, attempts+1, o.definition.CompensationMaxRetries+1)
+
+	return o.insertDeadline(step, CommandKindCompensation, cmd, DeadlineScheduled, attempts+1, backoff)
+}
+
+// failCompensation registra que a compensação não pôde ser concluída e a
+// SAGA precisa de intervenção manual
+func (o *Orchestrator) failCompensation(sagaID string, step SagaStep, attempts int, errorMsg string) error {
+	reason := fmt.Sprintf("Compensação %s falhou após %d tentativa(s): %s",
+		step.CompensationCommandType, attempts, errorMsg)
+
+	log.Printf("SAGA %s requer intervenção manual. %s", sagaID, reason)
+
+	if err := o.publishFailure(sagaID, StateCompensationFailed, reason); err != nil {
+		return err
+	}
+
+	return o.saveEvent(&SagaEvent{
+		SagaID:    sagaID,
+		State:     StateCompensationFailed,
+		Data:      map[string]interface{}{"step": step.Name, "attempts": attempts},
+		Error:     reason,
+		Timestamp: time.Now(),
+	})
+}
+
+// publishFailure publica o resultado de uma SAGA que terminou sem concluir o pedido
+func (o *Orchestrator) publishFailure(sagaID string, status SagaState, reason string) error {
+	orderID, err := o.sagaOrderID(sagaID)
+	if err != nil {
+		return err
+	}
+	return o.publishOrderProcessed(sagaID, orderID, status, reason, nil)
+}
+
+// compensationReason retorna o motivo registrado no início da compensação
+func (o *Orchestrator) compensationReason(sagaID string) (string, error) {
+	var reason sql.NullString
+	err := o.db.QueryRow(
+		"SELECT error FROM saga_events WHERE saga_id = $1 AND state = $2 ORDER BY id DESC LIMIT 1",
+		sagaID, StateCompensating,
+	).Scan(&reason)
+
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return reason.String, nil
+}
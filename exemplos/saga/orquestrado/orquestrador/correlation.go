@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Tipos de comando registrados em saga_deadlines
+const (
+	CommandKindStep         = "STEP"
+	CommandKindCompensation = "COMPENSATION"
+	CommandKindRefund       = "REFUND"
+)
+
+// outstandingCommand representa um comando emitido pelo orquestrador
+type outstandingCommand struct {
+	CommandID string
+	SagaID    string
+	Step      string
+	Kind      string
+	Status    string
+	Attempts  int
+}
+
+// findOutstanding busca o comando emitido pelo orquestrador com o command_id informado
+func (o *Orchestrator) findOutstanding(commandID string) (*outstandingCommand, error) {
+	cmd := &outstandingCommand{CommandID: commandID}
+	err := o.db.QueryRow(
+		"SELECT saga_id, step, kind, status, attempts FROM saga_deadlines WHERE command_id = $1",
+		commandID,
+	).Scan(&cmd.SagaID, &cmd.Step, &cmd.Kind, &cmd.Status, &cmd.Attempts)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// correlateReply confere se o reply corresponde ao comando pendente da etapa
+// atual da SAGA. Retorna o comando correlacionado ou o motivo da rejeição.
+func (o *Orchestrator) correlateReply(topic string, reply *Reply, currentState SagaState) (*outstandingCommand, string, error) {
+	cmd, err := o.findOutstanding(reply.CommandID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cmd == nil {
+		return nil, "command_id não foi emitido pelo orquestrador", nil
+	}
+	if cmd.SagaID != reply.SagaID {
+		return nil, fmt.Sprintf("command_id pertence à SAGA %s", cmd.SagaID), nil
+	}
+
+	step, ok := o.definition.StepByName(cmd.Step)
+	if !ok {
+		return nil, fmt.Sprintf("etapa %s não existe na definição", cmd.Step), nil
+	}
+	if step.ReplyTopic != topic {
+		return nil, fmt.Sprintf("etapa %s responde em %s", step.Name, step.ReplyTopic), nil
+	}
+	if cmd.Status != DeadlinePending {
+		return nil, fmt.Sprintf("comando não está mais pendente (%s)", cmd.Status), nil
+	}
+
+	// Uma etapa só pode avançar a partir do estado deixado pela etapa anterior
+	// (ou, em um grupo paralelo, pelos ramos que já responderam)
+	if cmd.Kind == CommandKindStep {
+		expected := o.definition.ExpectedStates(step.Name)
+		if !containsState(expected, currentState) {
+			return nil, fmt.Sprintf("etapa %s esperava o estado %s", step.Name, expected[0]), nil
+		}
+	}
+
+	// Encerrar o comando pendente; se outro reply chegou antes, este é duplicado
+	resolved, err := o.resolveDeadline(reply.CommandID, reply.Success, reply.Message)
+	if err != nil {
+		return nil, "", err
+	}
+	if !resolved {
+		return nil, "reply duplicado", nil
+	}
+
+	if err := o.finishCommand(reply.CommandID, reply); err != nil {
+		return nil, "", err
+	}
+
+	return cmd, "", nil
+}
+
+// rejectReply registra um reply descartado para depuração
+func (o *Orchestrator) rejectReply(topic string, reply *Reply, currentState SagaState, reason string) error {
+	log.Printf("Reply rejeitado (SAGA %s, comando %s, tópico %s): %s",
+		reply.SagaID, reply.CommandID, topic, reason)
+
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.db.Exec(
+		`INSERT INTO rejected_replies (reply_id, command_id, saga_id, topic, current_state, reason, reply)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		reply.ReplyID, reply.CommandID, reply.SagaID, topic, currentState, reason, payload,
+	)
+	return err
+}
+
+func containsState(states []SagaState, state SagaState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
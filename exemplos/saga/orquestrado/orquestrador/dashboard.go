@@ -0,0 +1,497 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// Intervalo de consulta de novos eventos e de envio do keep-alive no stream
+const (
+	dashboardPollInterval = time.Second
+	dashboardKeepAlive    = 15 * time.Second
+)
+
+// Status de uma etapa no diagrama do painel
+const (
+	StepPending            = "pending"
+	StepRunning            = "running"
+	StepDone               = "done"
+	StepFailed             = "failed"
+	StepCompensating       = "compensating"
+	StepCompensated        = "compensated"
+	StepCompensationFailed = "compensation_failed"
+)
+
+// DiagramStep é uma etapa da definição com o status que ela tem na SAGA.
+// Um grupo paralelo traz os ramos em Branches.
+type DiagramStep struct {
+	Name                    string         `json:"name"`
+	CommandType             string         `json:"command_type,omitempty"`
+	CompensationCommandType string         `json:"compensation_command_type,omitempty"`
+	Status                  string         `json:"status"`
+	Branches                []*DiagramStep `json:"branches,omitempty"`
+
+	// index é a posição da etapa (ou do grupo do ramo) na sequência
+	index int
+	group *DiagramStep
+}
+
+// SagaView é o estado de uma SAGA enviado ao painel, reconstruído a partir
+// dos eventos em saga_events
+type SagaView struct {
+	SagaID    string              `json:"saga_id"`
+	OrderID   string              `json:"order_id"`
+	State     SagaState           `json:"state"`
+	Error     string              `json:"error,omitempty"`
+	StartedAt time.Time           `json:"started_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+	Steps     []*DiagramStep      `json:"steps"`
+	Refund    *DiagramStep        `json:"refund,omitempty"`
+	Timeline  []SagaTimelineEntry `json:"timeline"`
+}
+
+// storedEvent é uma linha de saga_events lida pelo painel
+type storedEvent struct {
+	ID        int64
+	SagaID    string
+	OrderID   string
+	State     SagaState
+	Data      []byte
+	Error     string
+	CreatedAt time.Time
+}
+
+// sagaDiagram monta as etapas da definição, todas pendentes, e os índices
+// por nome e por estado usados para aplicar os eventos
+func (d *SagaDefinition) sagaDiagram() ([]*DiagramStep, map[string]*DiagramStep, map[SagaState]*DiagramStep) {
+	byName := make(map[string]*DiagramStep)
+	byState := make(map[SagaState]*DiagramStep)
+
+	newStep := func(step SagaStep, index int, group *DiagramStep) *DiagramStep {
+		s := &DiagramStep{
+			Name:                    step.Name,
+			CommandType:             step.CommandType,
+			CompensationCommandType: step.CompensationCommandType,
+			Status:                  StepPending,
+			index:                   index,
+			group:                   group,
+		}
+		byName[step.Name] = s
+		if step.State != "" {
+			byState[step.State] = s
+		}
+		return s
+	}
+
+	steps := make([]*DiagramStep, len(d.Steps))
+	for i, step := range d.Steps {
+		steps[i] = newStep(step, i, nil)
+		for _, branch := range step.Parallel {
+			steps[i].Branches = append(steps[i].Branches, newStep(branch, i, steps[i]))
+		}
+	}
+	return steps, byName, byState
+}
+
+// buildSagaView aplica os eventos, em ordem, às etapas da definição. A etapa
+// que falhou é a primeira ainda não concluída quando a compensação começa; as
+// compensações são inferidas dos estados COMPENSATING, COMPENSATION_FAILED e
+// FAILED, já que os eventos não registram cada compensação confirmada.
+func (o *Orchestrator) buildSagaView(events []storedEvent) *SagaView {
+	steps, byName, byState := o.definition.sagaDiagram()
+	view := &SagaView{
+		SagaID:    events[0].SagaID,
+		StartedAt: events[0].CreatedAt,
+		Steps:     steps,
+		Timeline:  make([]SagaTimelineEntry, 0, len(events)),
+	}
+	if o.definition.RefundStep != nil {
+		view.Refund = &DiagramStep{
+			Name:        o.definition.RefundStep.Name,
+			CommandType: o.definition.RefundStep.CommandType,
+			Status:      StepPending,
+			index:       -1,
+		}
+	}
+
+	// all percorre as etapas e os ramos na ordem da definição
+	all := func(fn func(s *DiagramStep)) {
+		for _, step := range steps {
+			fn(step)
+			for _, branch := range step.Branches {
+				fn(branch)
+			}
+		}
+	}
+
+	compensating := false
+	for _, e := range events {
+		view.State = e.State
+		view.UpdatedAt = e.CreatedAt
+		if e.OrderID != "" {
+			view.OrderID = e.OrderID
+		}
+		if e.Error != "" {
+			view.Error = e.Error
+		}
+		view.Timeline = append(view.Timeline, SagaTimelineEntry{State: e.State, Error: e.Error, CreatedAt: e.CreatedAt})
+
+		switch e.State {
+		case StateCompensating:
+			compensating = true
+			markFailedStep(steps)
+			all(func(s *DiagramStep) {
+				if s.CompensationCommandType != "" && (s.Status == StepDone || s.Status == StepCompensationFailed) {
+					s.Status = StepCompensating
+				}
+			})
+
+		case StateTimedOut:
+			if s, ok := byName[eventStep(e.Data)]; ok {
+				s.Status = StepFailed
+				if s.group != nil {
+					s.group.Status = StepFailed
+				}
+			}
+
+		case StateCompensationFailed:
+			failed, ok := byName[eventStep(e.Data)]
+			if !ok {
+				break
+			}
+			failed.Status = StepCompensationFailed
+			// As compensações seguem a ordem inversa: as etapas posteriores
+			// foram compensadas e as anteriores não chegaram a ser
+			all(func(s *DiagramStep) {
+				if s.Status != StepCompensating {
+					return
+				}
+				if s.index > failed.index {
+					s.Status = StepCompensated
+				} else {
+					s.Status = StepDone
+				}
+			})
+
+		case StateFailed:
+			all(func(s *DiagramStep) {
+				if s.Status == StepCompensating {
+					s.Status = StepCompensated
+				}
+			})
+
+		case StateRefunding, StateRefunded, StateRefundFailed:
+			if view.Refund != nil {
+				view.Refund.Status = map[SagaState]string{
+					StateRefunding:    StepRunning,
+					StateRefunded:     StepDone,
+					StateRefundFailed: StepFailed,
+				}[e.State]
+			}
+
+		default:
+			if s, ok := byState[e.State]; ok {
+				s.Status = StepDone
+			}
+		}
+	}
+
+	// Etapa em andamento: a primeira pendente de uma SAGA que ainda avança
+	if !compensating && !isTerminal(view.State) && !isRefundState(view.State) {
+		for _, step := range steps {
+			if step.Status == StepDone {
+				continue
+			}
+			step.Status = StepRunning
+			for _, branch := range step.Branches {
+				if branch.Status == StepPending {
+					branch.Status = StepRunning
+				}
+			}
+			break
+		}
+	}
+
+	return view
+}
+
+// markFailedStep marca como falha a primeira etapa não concluída, se nenhuma
+// falha foi registrada antes (ex.: por TIMED_OUT). Em um grupo, falham os
+// ramos que não foram concluídos.
+func markFailedStep(steps []*DiagramStep) {
+	for _, step := range steps {
+		if step.Status == StepFailed {
+			return
+		}
+	}
+	for _, step := range steps {
+		if step.Status == StepDone {
+			continue
+		}
+		step.Status = StepFailed
+		for _, branch := range step.Branches {
+			if branch.Status != StepDone {
+				branch.Status = StepFailed
+			}
+		}
+		return
+	}
+}
+
+// eventStep lê o nome da etapa registrado nos dados do evento
+func eventStep(data []byte) string {
+	var fields struct {
+		Step string `json:"step"`
+	}
+	if len(data) > 0 {
+		json.Unmarshal(data, &fields)
+	}
+	return fields.Step
+}
+
+// dashboardUpdates retorna as SAGAs com eventos confirmados depois do cursor
+// after e o novo cursor, o xmin do snapshot atual. Um id de saga_events é
+// reservado no INSERT, então uma transação lenta pode confirmar um id menor
+// do que um já lido; por isso o cursor segue a transação que gravou o evento
+// (tx_id): abaixo do xmin todas as transações já terminaram e nenhum evento
+// novo pode aparecer. Com after zero são as limit SAGAs mais recentes.
+// sagaID restringe a uma SAGA; changed indica se algum evento, de qualquer
+// SAGA, foi confirmado no intervalo.
+func (o *Orchestrator) dashboardUpdates(after int64, sagaID string, limit int) ([]*SagaView, int64, bool, error) {
+	var upTo int64
+	if err := o.db.QueryRow("SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint").Scan(&upTo); err != nil {
+		return nil, after, false, err
+	}
+	if upTo <= after {
+		return nil, after, false, nil
+	}
+
+	var changed bool
+	err := o.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM saga_events WHERE tx_id >= $1 AND tx_id < $2)", after, upTo,
+	).Scan(&changed)
+	if err != nil {
+		return nil, after, false, err
+	}
+	if !changed {
+		return nil, upTo, false, nil
+	}
+
+	args := []interface{}{after, upTo}
+	query := "SELECT DISTINCT saga_id FROM saga_events WHERE tx_id >= $1 AND tx_id < $2"
+	if after == 0 {
+		query = "SELECT saga_id FROM saga_events WHERE tx_id >= $1 AND tx_id < $2"
+	}
+	if sagaID != "" {
+		args = append(args, sagaID)
+		query += fmt.Sprintf(" AND saga_id = $%d", len(args))
+	}
+	if after == 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf(" GROUP BY saga_id ORDER BY MAX(id) DESC LIMIT $%d", len(args))
+	}
+
+	rows, err := o.db.Query(query, args...)
+	if err != nil {
+		return nil, after, false, err
+	}
+	var sagaIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, after, false, err
+		}
+		sagaIDs = append(sagaIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, after, false, err
+	}
+	if len(sagaIDs) == 0 {
+		return nil, upTo, true, nil
+	}
+
+	events, err := o.loadSagaEvents(sagaIDs, upTo)
+	if err != nil {
+		return nil, after, false, err
+	}
+
+	views := make([]*SagaView, 0, len(events))
+	for _, sagaEvents := range events {
+		views = append(views, o.buildSagaView(sagaEvents))
+	}
+	// Do menos para o mais recente: o painel coloca cada SAGA recebida no topo
+	sort.Slice(views, func(i, j int) bool { return views[i].UpdatedAt.Before(views[j].UpdatedAt) })
+
+	return views, upTo, true, nil
+}
+
+// loadSagaEvents lê os eventos das SAGAs informadas gravados por transações
+// anteriores a upTo, agrupados por SAGA e em ordem de gravação
+func (o *Orchestrator) loadSagaEvents(sagaIDs []string, upTo int64) (map[string][]storedEvent, error) {
+	args := []interface{}{upTo}
+	placeholders := make([]string, len(sagaIDs))
+	for i, id := range sagaIDs {
+		args = append(args, id)
+		placeholders[i] = "$" + strconv.Itoa(len(args))
+	}
+
+	rows, err := o.db.Query(
+		`SELECT id, saga_id, order_id, state, data, COALESCE(error, ''), created_at
+		 FROM saga_events WHERE tx_id < $1 AND saga_id IN (`+strings.Join(placeholders, ", ")+`)
+		 ORDER BY id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make(map[string][]storedEvent, len(sagaIDs))
+	for rows.Next() {
+		var e storedEvent
+		if err := rows.Scan(&e.ID, &e.SagaID, &e.OrderID, &e.State, &e.Data, &e.Error, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events[e.SagaID] = append(events[e.SagaID], e)
+	}
+	return events, rows.Err()
+}
+
+// sagaStateCounts conta as SAGAs pelo estado atual na projeção saga_instances
+func (o *Orchestrator) sagaStateCounts() (map[SagaState]int, error) {
+	rows, err := o.db.Query("SELECT state, COUNT(*) FROM saga_instances GROUP BY state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[SagaState]int)
+	for rows.Next() {
+		var state SagaState
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, err
+		}
+		counts[state] = n
+	}
+	return counts, rows.Err()
+}
+
+// GET /dashboard - Painel web com as SAGAs em tempo real
+func (o *Orchestrator) dashboardPage(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// GET /dashboard/stream - Mudanças de estado das SAGAs em Server-Sent Events
+// (?saga= acompanha uma SAGA, ?limit= SAGAs no estado inicial). O stream é
+// encerrado quando done é fechado, no encerramento do servidor.
+func (o *Orchestrator) dashboardStream(done <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "Streaming não suportado")
+			return
+		}
+
+		sagaID := r.URL.Query().Get("saga")
+		limit := 50
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, "Parâmetro limit inválido")
+				return
+			}
+			limit = n
+		}
+
+		// Na reconexão o navegador informa o último cursor recebido
+		var cursor int64
+		if value := r.Header.Get("Last-Event-ID"); value != "" {
+			if id, err := strconv.ParseInt(value, 10, 64); err == nil && id > 0 {
+				cursor = id
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		poll := time.NewTicker(dashboardPollInterval)
+		defer poll.Stop()
+		lastWrite := time.Now()
+
+		for first := true; ; first = false {
+			views, upTo, changed, err := o.dashboardUpdates(cursor, sagaID, limit)
+			if err != nil {
+				log.Printf("Erro ao consultar eventos para o painel: %v", err)
+			}
+
+			if err == nil && (first || changed) {
+				for _, view := range views {
+					if err := writeServerEvent(w, "saga", 0, view); err != nil {
+						return
+					}
+				}
+
+				counts, err := o.sagaStateCounts()
+				if err != nil {
+					log.Printf("Erro ao contar SAGAs para o painel: %v", err)
+				} else if err := writeServerEvent(w, "counts", upTo, counts); err != nil {
+					return
+				}
+
+				lastWrite = time.Now()
+				flusher.Flush()
+			} else if time.Since(lastWrite) >= dashboardKeepAlive {
+				// Comentário SSE: mantém a conexão aberta em proxies
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				lastWrite = time.Now()
+				flusher.Flush()
+			}
+			if err == nil {
+				cursor = upTo
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-done:
+				return
+			case <-poll.C:
+			}
+		}
+	}
+}
+
+// writeServerEvent escreve um evento SSE com o JSON de v. Com id informado,
+// o navegador o reenvia em Last-Event-ID ao reconectar.
+func writeServerEvent(w http.ResponseWriter, event string, id int64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
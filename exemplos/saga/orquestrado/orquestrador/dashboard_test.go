@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDashboardCursorFollowsCommitOrder grava o evento de uma SAGA em uma
+// transação que fica aberta enquanto outra SAGA grava e confirma um evento
+// com id maior. O painel só pode exibir a segunda depois que a primeira
+// terminar; um cursor pelo maior id já lido pularia o evento da primeira.
+func TestDashboardCursorFollowsCommitOrder(t *testing.T) {
+	db := testDB(t)
+	o := newTestOrchestrator(t, db, &fakeProducer{broker: newMemBroker(3)})
+
+	_, cursor, _, err := o.dashboardUpdates(0, "", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := make(chan struct{})
+	release := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- o.withTx(func(o *Orchestrator) error {
+			err := o.saveEvent(&SagaEvent{
+				SagaID:    "SAGA-LENTA",
+				OrderID:   "PED-LENTO",
+				State:     StatePending,
+				Timestamp: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+			close(saved)
+			<-release
+			return nil
+		})
+	}()
+
+	select {
+	case <-saved:
+	case err := <-result:
+		t.Fatalf("erro ao gravar evento da SAGA lenta: %v", err)
+	}
+
+	err = o.saveEvent(&SagaEvent{
+		SagaID:    "SAGA-RAPIDA",
+		OrderID:   "PED-RAPIDO",
+		State:     StatePending,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		close(release)
+		t.Fatalf("erro ao gravar evento da SAGA rápida: %v", err)
+	}
+
+	views, cursor, _, err := o.dashboardUpdates(cursor, "", 50)
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+	if len(views) != 0 {
+		t.Errorf("%d SAGA(s) exibida(s) com uma transação anterior ainda aberta", len(views))
+	}
+
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatalf("erro ao confirmar a SAGA lenta: %v", err)
+	}
+
+	views, _, _, err = o.dashboardUpdates(cursor, "", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, view := range views {
+		seen[view.SagaID] = true
+	}
+	for _, sagaID := range []string{"SAGA-LENTA", "SAGA-RAPIDA"} {
+		if !seen[sagaID] {
+			t.Errorf("SAGA %s não exibida depois da confirmação, obteve %v", sagaID, seen)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"saga/protocol"
+)
+
+//go:embed saga-definition.json
+var defaultDefinition []byte
+
+// SagaStep representa uma etapa da SAGA declarada na definição. Uma etapa
+// com parallel é um grupo: os comandos de todos os ramos são enviados ao
+// mesmo tempo e a SAGA só avança quando todos responderem.
+type SagaStep struct {
+	Name                    string     `json:"name"`
+	CommandTopic            string     `json:"command_topic"`
+	ReplyTopic              string     `json:"reply_topic"`
+	CommandType             string     `json:"command_type"`
+	CompensationCommandType string     `json:"compensation_command_type,omitempty"`
+	State                   SagaState  `json:"state"`
+	TimeoutSeconds          int        `json:"timeout_seconds,omitempty"`
+	MaxRetries              int        `json:"max_retries,omitempty"`
+	Parallel                []SagaStep `json:"parallel,omitempty"`
+	// PayloadVersion é a versão do payload enviada no comando; ausente
+	// mantém a versão 1 até que todos os participantes aceitem a nova
+	PayloadVersion int `json:"payload_version,omitempty"`
+}
+
+// IsGroup indica se a etapa é um grupo de ramos paralelos
+func (s SagaStep) IsGroup() bool {
+	return len(s.Parallel) > 0
+}
+
+// Timeout retorna o prazo de resposta da etapa
+func (s SagaStep) Timeout() time.Duration {
+	if s.TimeoutSeconds <= 0 {
+		return defaultStepTimeout
+	}
+	return time.Duration(s.TimeoutSeconds) * time.Second
+}
+
+// SagaDefinition descreve o fluxo completo da SAGA: tópicos de entrada/saída
+// e a sequência de etapas. A compensação é derivada da mesma sequência,
+// percorrida na ordem inversa.
+type SagaDefinition struct {
+	Name           string     `json:"name"`
+	StartTopic     string     `json:"start_topic"`
+	CompletedTopic string     `json:"completed_topic"`
+	Steps          []SagaStep `json:"steps"`
+
+	// Novas tentativas de uma compensação que falhou ou ficou sem resposta,
+	// com backoff exponencial a partir de compensation_backoff_seconds
+	CompensationMaxRetries     int `json:"compensation_max_retries"`
+	CompensationBackoffSeconds int `json:"compensation_backoff_seconds"`
+
+	// Devoluções: os eventos de entrega chegam em delivery_events_topic e,
+	// quando uma entrega de uma SAGA concluída é devolvida, o comando de
+	// refund_step estorna o pagamento. Sem refund_step devoluções são ignoradas.
+	DeliveryEventsTopic string    `json:"delivery_events_topic,omitempty"`
+	RefundStep          *SagaStep `json:"refund_step,omitempty"`
+}
+
+// CompensationBackoff retorna a espera antes da próxima tentativa de compensação
+func (d *SagaDefinition) CompensationBackoff(attempt int) time.Duration {
+	base := time.Duration(d.CompensationBackoffSeconds) * time.Second
+	if base <= 0 {
+		base = time.Second
+	}
+	if attempt > 10 {
+		attempt = 10
+	}
+	return base << (attempt - 1)
+}
+
+// loadDefinition carrega a definição da SAGA do arquivo indicado em
+// SAGA_DEFINITION ou, se não informado, da definição embutida no binário
+func loadDefinition() (*SagaDefinition, error) {
+	data := defaultDefinition
+	source := "embutida"
+
+	if path := getEnv("SAGA_DEFINITION", ""); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("erro ao ler definição %s: %w", path, err)
+		}
+		data = content
+		source = path
+	}
+
+	def, err := parseDefinition(data)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Definição da SAGA carregada (%s): %s com %d etapas", source, def.Name, len(def.Steps))
+	return def, nil
+}
+
+// parseDefinition decodifica e valida uma definição em JSON
+func parseDefinition(data []byte) (*SagaDefinition, error) {
+	var def SagaDefinition
+	if err := json.Unmarshal(data, &def); err != nil {
+		return nil, fmt.Errorf("definição da SAGA inválida: %w", err)
+	}
+
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &def, nil
+}
+
+// Validate garante que a definição é consistente antes de o orquestrador
+// começar a consumir mensagens
+func (d *SagaDefinition) Validate() error {
+	if d.StartTopic == "" {
+		return fmt.Errorf("definição da SAGA sem start_topic")
+	}
+	if len(d.Steps) == 0 {
+		return fmt.Errorf("definição da SAGA sem etapas")
+	}
+	if d.CompensationMaxRetries < 0 || d.CompensationBackoffSeconds < 0 {
+		return fmt.Errorf("definição da SAGA com compensation_max_retries ou compensation_backoff_seconds negativo")
+	}
+
+	v := &definitionValidator{
+		names:  make(map[string]bool),
+		states: make(map[SagaState]bool),
+	}
+
+	for i, step := range d.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("etapa %d sem name", i)
+		}
+
+		if !step.IsGroup() {
+			if err := v.validateStep(step); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Grupo: só declara name e state; os comandos ficam nos ramos
+		if step.CommandTopic != "" || step.ReplyTopic != "" || step.CommandType != "" || step.CompensationCommandType != "" {
+			return fmt.Errorf("grupo %s não pode declarar comandos, apenas parallel", step.Name)
+		}
+		if len(step.Parallel) < 2 {
+			return fmt.Errorf("grupo %s precisa de ao menos dois ramos", step.Name)
+		}
+		if err := v.register(step); err != nil {
+			return err
+		}
+		for _, branch := range step.Parallel {
+			if branch.IsGroup() {
+				return fmt.Errorf("grupo %s não pode conter outro grupo (%s)", step.Name, branch.Name)
+			}
+			if err := v.validateStep(branch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.validateRefundStep(v)
+}
+
+// validateRefundStep valida a etapa de estorno. Ela não faz parte da
+// sequência da SAGA: não tem state próprio nem compensação.
+func (d *SagaDefinition) validateRefundStep(v *definitionValidator) error {
+	step := d.RefundStep
+	if step == nil {
+		return nil
+	}
+
+	if d.DeliveryEventsTopic == "" {
+		return fmt.Errorf("refund_step exige delivery_events_topic")
+	}
+	if step.IsGroup() || step.State != "" || step.CompensationCommandType != "" {
+		return fmt.Errorf("refund_step %s não pode declarar parallel, state ou compensation_command_type", step.Name)
+	}
+	if v.names[step.Name] {
+		return fmt.Errorf("etapa %s repetida", step.Name)
+	}
+
+	if err := validateCommand(*step); err != nil {
+		return err
+	}
+	v.names[step.Name] = true
+	return nil
+}
+
+// definitionValidator acumula nomes e estados já usados para garantir que
+// sejam únicos entre etapas e ramos. Tópicos de reply podem se repetir: o
+// reply é associado à etapa pelo command_id.
+type definitionValidator struct {
+	names  map[string]bool
+	states map[SagaState]bool
+}
+
+var reservedStates = map[SagaState]bool{
+	StatePending:            true,
+	StateCompleted:          true,
+	StateFailed:             true,
+	StateCompensating:       true,
+	StateTimedOut:           true,
+	StateCompensationFailed: true,
+	StateResolved:           true,
+	StateRefunding:          true,
+	StateRefunded:           true,
+	StateRefundFailed:       true,
+}
+
+func (v *definitionValidator) validateStep(step SagaStep) error {
+	if err := validateCommand(step); err != nil {
+		return err
+	}
+	return v.register(step)
+}
+
+// validateCommand confere os campos do comando de uma etapa
+func validateCommand(step SagaStep) error {
+	switch {
+	case step.Name == "":
+		return fmt.Errorf("etapa sem name")
+	case step.CommandTopic == "":
+		return fmt.Errorf("etapa %s sem command_topic", step.Name)
+	case step.ReplyTopic == "":
+		return fmt.Errorf("etapa %s sem reply_topic", step.Name)
+	case step.CommandType == "":
+		return fmt.Errorf("etapa %s sem command_type", step.Name)
+	}
+
+	if step.TimeoutSeconds < 0 || step.MaxRetries < 0 {
+		return fmt.Errorf("etapa %s com timeout_seconds ou max_retries negativo", step.Name)
+	}
+	if step.PayloadVersion < 0 {
+		return fmt.Errorf("etapa %s com payload_version negativo", step.Name)
+	}
+	if latest, ok := protocol.LatestVersion(step.CommandType); ok && step.PayloadVersion > latest {
+		return fmt.Errorf("etapa %s com payload_version %d, mas %s só vai até a v%d",
+			step.Name, step.PayloadVersion, step.CommandType, latest)
+	}
+	return nil
+}
+
+func (v *definitionValidator) register(step SagaStep) error {
+	if step.State == "" {
+		return fmt.Errorf("etapa %s sem state", step.Name)
+	}
+	if reservedStates[step.State] {
+		return fmt.Errorf("etapa %s usa o estado reservado %s", step.Name, step.State)
+	}
+	if v.names[step.Name] {
+		return fmt.Errorf("etapa %s repetida", step.Name)
+	}
+	if v.states[step.State] {
+		return fmt.Errorf("estado %s repetido na etapa %s", step.State, step.Name)
+	}
+
+	v.names[step.Name] = true
+	v.states[step.State] = true
+	return nil
+}
+
+// Topics retorna os tópicos que o orquestrador precisa consumir
+func (d *SagaDefinition) Topics() []string {
+	topics := []string{d.StartTopic}
+	seen := map[string]bool{d.StartTopic: true}
+	for i := range d.Steps {
+		for _, step := range d.Branches(i) {
+			if !seen[step.ReplyTopic] {
+				seen[step.ReplyTopic] = true
+				topics = append(topics, step.ReplyTopic)
+			}
+		}
+	}
+	if d.RefundStep != nil {
+		for _, topic := range []string{d.RefundStep.ReplyTopic, d.DeliveryEventsTopic} {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+	return topics
+}
+
+// Branches retorna os ramos de um grupo ou a própria etapa, para que etapas
+// simples e grupos possam ser tratados da mesma forma
+func (d *SagaDefinition) Branches(index int) []SagaStep {
+	step := d.Steps[index]
+	if step.IsGroup() {
+		return step.Parallel
+	}
+	return []SagaStep{step}
+}
+
+// find localiza uma etapa (etapa simples, grupo ou ramo de grupo) pelo nome
+// e retorna também o índice da etapa de primeiro nível que a contém. A etapa
+// de estorno, fora da sequência, é encontrada com índice -1.
+func (d *SagaDefinition) find(name string) (int, SagaStep, bool) {
+	for i := range d.Steps {
+		if d.Steps[i].Name == name {
+			return i, d.Steps[i], true
+		}
+		for _, step := range d.Steps[i].Parallel {
+			if step.Name == name {
+				return i, step, true
+			}
+		}
+	}
+	if d.RefundStep != nil && d.RefundStep.Name == name {
+		return -1, *d.RefundStep, true
+	}
+	return -1, SagaStep{}, false
+}
+
+// StepIndex retorna o índice de primeiro nível da etapa (ou do grupo que
+// contém o ramo) com o nome informado, ou -1
+func (d *SagaDefinition) StepIndex(name string) int {
+	index, _, _ := d.find(name)
+	return index
+}
+
+// StepByName retorna a etapa (ou o ramo de grupo) com o nome informado
+func (d *SagaDefinition) StepByName(name string) (SagaStep, bool) {
+	_, step, ok := d.find(name)
+	return step, ok
+}
+
+// StepByState retorna o índice da etapa cujo sucesso leva ao estado informado.
+// Estados parciais de um grupo retornam o índice do grupo. Para estados que
+// não pertencem a nenhuma etapa (ex: PENDING) retorna -1.
+func (d *SagaDefinition) StepByState(state SagaState) int {
+	for i, step := range d.Steps {
+		if step.State == state {
+			return i
+		}
+		for _, branch := range step.Parallel {
+			if branch.State == state {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// IsPartialState indica se o estado representa a conclusão de apenas um ramo
+// de um grupo paralelo, com os demais ramos ainda em andamento
+func (d *SagaDefinition) IsPartialState(state SagaState) bool {
+	index := d.StepByState(state)
+	return index >= 0 && d.Steps[index].State != state
+}
+
+// NextStepIndex retorna o índice da etapa a executar a partir do estado
+// atual. Em um estado parcial o próprio grupo ainda precisa ser concluído.
+func (d *SagaDefinition) NextStepIndex(state SagaState) int {
+	if d.IsPartialState(state) {
+		return d.StepByState(state)
+	}
+	return d.StepByState(state) + 1
+}
+
+// StateBefore retorna o estado em que a SAGA precisa estar para que a etapa
+// informada seja executada: PENDING para a primeira etapa ou o estado da anterior
+func (d *SagaDefinition) StateBefore(name string) SagaState {
+	if i := d.StepIndex(name); i > 0 {
+		return d.Steps[i-1].State
+	}
+	return StatePending
+}
+
+// ExpectedStates retorna os estados em que a SAGA pode estar ao receber o
+// reply da etapa. Ramos de um grupo também aceitam os estados parciais dos
+// ramos irmãos que responderam antes.
+func (d *SagaDefinition) ExpectedStates(name string) []SagaState {
+	states := []SagaState{d.StateBefore(name)}
+	if i := d.StepIndex(name); i >= 0 {
+		for _, branch := range d.Steps[i].Parallel {
+			states = append(states, branch.State)
+		}
+	}
+	return states
+}
+
+// IsLastStep indica se a etapa é a última da SAGA
+func (d *SagaDefinition) IsLastStep(index int) bool {
+	return index == len(d.Steps)-1
+}
@@ -5,6 +5,7 @@ go 1.23
 require (
 	github.com/IBM/sarama v1.43.0
 	github.com/lib/pq v1.10.9
+	saga v0.0.0
 )
 
 require (
@@ -27,3 +28,6 @@ require (
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
 )
+
+// Pacotes compartilhados entre os serviços da SAGA
+replace saga => ../saga
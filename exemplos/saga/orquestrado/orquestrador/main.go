@@ -13,20 +13,33 @@ import (
 
 	"github.com/IBM/sarama"
 	_ "github.com/lib/pq"
+	"saga/deadletter"
+	"saga/ids"
+	"saga/protocol"
+	"saga/tracing"
 )
 
 // SagaState representa os estados possíveis da SAGA
 type SagaState string
 
 const (
-	StatePending           SagaState = "PENDING"
-	StateOrderValidated    SagaState = "ORDER_VALIDATED"
-	StateStockReserved     SagaState = "STOCK_RESERVED"
-	StatePaymentProcessed  SagaState = "PAYMENT_PROCESSED"
-	StateDeliveryScheduled SagaState = "DELIVERY_SCHEDULED"
-	StateCompleted         SagaState = "COMPLETED"
-	StateFailed            SagaState = "FAILED"
-	StateCompensating      SagaState = "COMPENSATING"
+	StatePending                  SagaState = "PENDING"
+	StateOrderValidated           SagaState = "ORDER_VALIDATED"
+	StateStockReserved            SagaState = "STOCK_RESERVED"
+	StatePaymentProcessed         SagaState = "PAYMENT_PROCESSED"
+	StateStockAndPaymentConfirmed SagaState = "STOCK_AND_PAYMENT_CONFIRMED"
+	StateDeliveryScheduled        SagaState = "DELIVERY_SCHEDULED"
+	StatePaymentCaptured          SagaState = "PAYMENT_CAPTURED"
+	StateCompleted                SagaState = "COMPLETED"
+	StateFailed                   SagaState = "FAILED"
+	StateCompensating             SagaState = "COMPENSATING"
+	StateTimedOut                 SagaState = "TIMED_OUT"
+	StateCompensationFailed       SagaState = "COMPENSATION_FAILED"
+	StateResolved                 SagaState = "RESOLVED"
+	// Estados após a conclusão, quando a entrega é devolvida e o pagamento estornado
+	StateRefunding    SagaState = "REFUNDING"
+	StateRefunded     SagaState = "REFUNDED"
+	StateRefundFailed SagaState = "REFUND_FAILED"
 )
 
 // SagaEvent representa um evento da SAGA
@@ -37,39 +50,43 @@ type SagaEvent struct {
 	Data      map[string]interface{} `json:"data"`
 	Timestamp time.Time              `json:"timestamp"`
 	Error     string                 `json:"error,omitempty"`
+	// TraceID só é informado no primeiro evento; os demais herdam o da SAGA
+	TraceID string `json:"trace_id,omitempty"`
 }
 
-// Command representa um comando enviado aos serviços
-type Command struct {
-	CommandID   string                 `json:"command_id"`
-	SagaID      string                 `json:"saga_id"`
-	OrderID     string                 `json:"order_id"`
-	CommandType string                 `json:"command_type"`
-	Payload     map[string]interface{} `json:"payload"`
-	Timestamp   time.Time              `json:"timestamp"`
-}
-
-// Reply representa uma resposta de um serviço
-type Reply struct {
-	ReplyID   string                 `json:"reply_id"`
-	CommandID string                 `json:"command_id"`
-	SagaID    string                 `json:"saga_id"`
-	Success   bool                   `json:"success"`
-	Message   string                 `json:"message"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
-}
+// Command e Reply são as mensagens do protocolo da SAGA
+type (
+	Command = protocol.Command
+	Reply   = protocol.Reply
+)
 
 // Orchestrator gerencia as SAGAs
 type Orchestrator struct {
-	db       *sql.DB
-	producer sarama.SyncProducer
-	consumer sarama.ConsumerGroup
+	db           dbtx
+	conn         *sql.DB
+	producer     sarama.SyncProducer
+	consumer     sarama.ConsumerGroup
+	definition   *SagaDefinition
+	outboxSignal chan struct{}
+	tracer       *tracing.Tracer
+	metrics      *sagaMetrics
+	deadLetters  *deadletter.Queue
+	// hooks acumula as ações adiadas até o commit de withTx
+	hooks *[]func()
+	// versions guarda a versão de saga_instances lida em cada SAGA durante a
+	// transação de withTx; saveEvent só grava se a versão não mudou
+	versions map[string]int64
 }
 
 func main() {
 	log.Println("Iniciando Orquestrador SAGA...")
 
+	// Carregar e validar a definição da SAGA
+	definition, err := loadDefinition()
+	if err != nil {
+		log.Fatal("Erro ao carregar definição da SAGA:", err)
+	}
+
 	// Conectar ao banco de dados
 	db, err := connectDB()
 	if err != nil {
@@ -82,6 +99,12 @@ func main() {
 		log.Fatal("Erro ao inicializar schema:", err)
 	}
 
+	// Comando "replay": recriar a projeção saga_instances e encerrar
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(db, definition)
+		return
+	}
+
 	// Configurar Kafka Producer
 	producer, err := setupProducer()
 	if err != nil {
@@ -96,17 +119,45 @@ func main() {
 	}
 	defer consumer.Close()
 
+	// Configurar exportação dos traces
+	tracer, err := tracing.New("orquestrador")
+	if err != nil {
+		log.Fatal("Erro ao configurar tracing:", err)
+	}
+	defer tracer.Shutdown()
+
 	orch := &Orchestrator{
-		db:       db,
-		producer: producer,
-		consumer: consumer,
+		db:           db,
+		conn:         db,
+		producer:     producer,
+		consumer:     consumer,
+		definition:   definition,
+		outboxSignal: make(chan struct{}, 1),
+		tracer:       tracer,
+		deadLetters:  deadletter.NewQueue(producer, consumerGroup),
+	}
+	orch.metrics = newSagaMetrics(orch)
+
+	// Preencher a projeção das SAGAs em bancos criados antes dela
+	if err := orch.ensureProjection(); err != nil {
+		log.Fatal("Erro ao criar a projeção saga_instances:", err)
+	}
+
+	// Retomar SAGAs interrompidas antes de consumir novas mensagens
+	if err := orch.recoverSagas(); err != nil {
+		log.Fatal("Erro ao recuperar SAGAs:", err)
 	}
 
 	// Iniciar consumo de mensagens
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	go orch.relayOutbox(ctx)
 	go orch.consumeMessages(ctx)
+	go orch.watchDeadlines(ctx)
+
+	// API HTTP de consulta e administração
+	server := orch.startAPI()
 
 	// Aguardar sinal de término
 	sigterm := make(chan os.Signal, 1)
@@ -114,6 +165,12 @@ func main() {
 	<-sigterm
 
 	log.Println("Encerrando Orquestrador SAGA...")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Erro ao encerrar servidor HTTP: %v", err)
+	}
 }
 
 func connectDB() (*sql.DB, error) {
@@ -158,6 +215,95 @@ func initSchema(db *sql.DB) error {
 
 	CREATE INDEX IF NOT EXISTS idx_saga_id ON saga_events(saga_id);
 	CREATE INDEX IF NOT EXISTS idx_order_id ON saga_events(order_id);
+
+	CREATE TABLE IF NOT EXISTS saga_deadlines (
+		command_id VARCHAR(100) PRIMARY KEY,
+		saga_id VARCHAR(100) NOT NULL,
+		order_id VARCHAR(100),
+		step VARCHAR(100) NOT NULL,
+		topic VARCHAR(100) NOT NULL,
+		command JSONB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 1,
+		status VARCHAR(20) NOT NULL DEFAULT 'PENDING',
+		deadline TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_deadlines_status ON saga_deadlines(status, deadline);
+
+	ALTER TABLE saga_deadlines ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'STEP';
+	ALTER TABLE saga_deadlines ADD COLUMN IF NOT EXISTS success BOOLEAN;
+	ALTER TABLE saga_deadlines ADD COLUMN IF NOT EXISTS result_message TEXT;
+	CREATE INDEX IF NOT EXISTS idx_deadlines_saga_id ON saga_deadlines(saga_id);
+
+	CREATE TABLE IF NOT EXISTS rejected_replies (
+		id SERIAL PRIMARY KEY,
+		reply_id VARCHAR(100),
+		command_id VARCHAR(100),
+		saga_id VARCHAR(100),
+		topic VARCHAR(100) NOT NULL,
+		current_state VARCHAR(50),
+		reason TEXT NOT NULL,
+		reply JSONB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_rejected_saga_id ON rejected_replies(saga_id);
+
+	CREATE TABLE IF NOT EXISTS saga_outbox (
+		id BIGSERIAL PRIMARY KEY,
+		topic VARCHAR(100) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_outbox_pending ON saga_outbox(id) WHERE sent_at IS NULL;
+
+	ALTER TABLE saga_events ADD COLUMN IF NOT EXISTS trace_id VARCHAR(32);
+	ALTER TABLE saga_deadlines ADD COLUMN IF NOT EXISTS traceparent VARCHAR(55);
+	ALTER TABLE saga_outbox ADD COLUMN IF NOT EXISTS traceparent VARCHAR(55);
+	CREATE INDEX IF NOT EXISTS idx_trace_id ON saga_events(trace_id);
+
+	-- Transação que gravou o evento: o painel acompanha os eventos na ordem de
+	-- confirmação, que pode ser diferente da ordem dos ids
+	ALTER TABLE saga_events ADD COLUMN IF NOT EXISTS tx_id BIGINT NOT NULL DEFAULT pg_current_xact_id()::text::bigint;
+	CREATE INDEX IF NOT EXISTS idx_events_tx_id ON saga_events(tx_id);
+
+	CREATE TABLE IF NOT EXISTS saga_instances (
+		saga_id VARCHAR(100) PRIMARY KEY,
+		order_id VARCHAR(100) NOT NULL,
+		state VARCHAR(50) NOT NULL,
+		step VARCHAR(100),
+		last_event_id INTEGER NOT NULL,
+		last_error TEXT,
+		trace_id VARCHAR(32),
+		started_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_instances_state ON saga_instances(state);
+	CREATE INDEX IF NOT EXISTS idx_instances_started_at ON saga_instances(started_at);
+
+	-- Uma SAGA por pedido: uma reentrega concorrente do mesmo pedido falha aqui
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_instances_order_id ON saga_instances(order_id);
+
+	-- Controle de concorrência otimista entre réplicas do orquestrador
+	ALTER TABLE saga_instances ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 0;
+
+	-- Chave da mensagem no Kafka: mensagens da mesma SAGA vão para a mesma partição
+	ALTER TABLE saga_outbox ADD COLUMN IF NOT EXISTS message_key VARCHAR(100);
+
+	-- Devoluções de entrega recebidas; applied_at marca as que iniciaram o estorno
+	CREATE TABLE IF NOT EXISTS saga_returns (
+		saga_id VARCHAR(100) PRIMARY KEY,
+		delivery_id VARCHAR(100) NOT NULL,
+		tracking_number VARCHAR(100),
+		reason TEXT NOT NULL,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		applied_at TIMESTAMP
+	);
 	`
 
 	_, err := db.Exec(schema)
@@ -186,6 +332,9 @@ func setupProducer() (sarama.SyncProducer, error) {
 	return producer, nil
 }
 
+// consumerGroup também dá nome ao tópico de dead-letter do orquestrador
+const consumerGroup = "orquestrador-group"
+
 func setupConsumer() (sarama.ConsumerGroup, error) {
 	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
 
@@ -193,7 +342,7 @@ func setupConsumer() (sarama.ConsumerGroup, error) {
 	config.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
 	config.Consumer.Offsets.Initial = sarama.OffsetNewest
 
-	consumer, err := sarama.NewConsumerGroup(brokers, "orquestrador-group", config)
+	consumer, err := sarama.NewConsumerGroup(brokers, consumerGroup, config)
 	if err != nil {
 		return nil, err
 	}
@@ -204,13 +353,8 @@ func setupConsumer() (sarama.ConsumerGroup, error) {
 
 // consumeMessages consome tanto o início da SAGA quanto as respostas dos serviços
 func (o *Orchestrator) consumeMessages(ctx context.Context) {
-	topics := []string{
-		"pedido-saga-pedido-processar", // Tópico de início da SAGA
-		"pedidos-reply",
-		"estoque-reply",
-		"pagamentos-reply",
-		"entregas-reply",
-	}
+	// Tópico de início da SAGA mais os tópicos de reply de cada etapa
+	topics := o.definition.Topics()
 
 	handler := &ConsumerHandler{orchestrator: o}
 
@@ -235,53 +379,96 @@ func (h *ConsumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return
 
 func (h *ConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	for message := range claim.Messages() {
-		topic := message.Topic
+		err := h.orchestrator.deadLetters.Handle(session, message, func() error {
+			return h.handleMessage(message)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// Se for o tópico de início da SAGA, iniciar nova SAGA
-		if topic == "pedido-saga-pedido-processar" {
-			if err := h.orchestrator.startNewSaga(message.Value); err != nil {
-				log.Printf("Erro ao iniciar SAGA: %v", err)
-			}
-			session.MarkMessage(message, "")
-			continue
+// handleMessage processa uma mensagem consumida. Erros são tentados de novo
+// e, esgotadas as tentativas, a mensagem vai para o dead-letter; a transação
+// de cada tentativa é descartada quando ela falha.
+func (h *ConsumerHandler) handleMessage(message *sarama.ConsumerMessage) error {
+	topic := message.Topic
+
+	// Se for o tópico de início da SAGA, iniciar nova SAGA
+	if topic == h.orchestrator.definition.StartTopic {
+		err := h.orchestrator.withTx(func(o *Orchestrator) error {
+			return o.startNewSaga(message.Value, tracing.FromHeaders(message.Headers))
+		})
+		if err != nil {
+			return fmt.Errorf("erro ao iniciar SAGA: %w", err)
 		}
+		return nil
+	}
 
-		// Caso contrário, processar reply
-		var reply Reply
-		if err := json.Unmarshal(message.Value, &reply); err != nil {
-			log.Printf("Erro ao deserializar reply: %v", err)
-			session.MarkMessage(message, "")
-			continue
+	// Eventos do ciclo de vida das entregas (devoluções)
+	if topic == h.orchestrator.definition.DeliveryEventsTopic {
+		err := h.orchestrator.withTx(func(o *Orchestrator) error {
+			return o.handleDeliveryEvent(message.Value)
+		})
+		if err != nil {
+			return fmt.Errorf("erro ao processar evento de entrega: %w", err)
 		}
+		return nil
+	}
 
-		log.Printf("Reply recebido: %s - Success: %t - Message: %s",
-			topic, reply.Success, reply.Message)
+	// Caso contrário, processar reply
+	var reply Reply
+	if err := json.Unmarshal(message.Value, &reply); err != nil {
+		return deadletter.Permanent(fmt.Errorf("erro ao deserializar reply: %w", err))
+	}
 
-		// Processar reply de acordo com a máquina de estados
-		if err := h.orchestrator.processReply(topic, &reply); err != nil {
-			log.Printf("Erro ao processar reply: %v", err)
-		}
+	log.Printf("Reply recebido: %s - Success: %t - Message: %s",
+		topic, reply.Success, reply.Message)
 
-		session.MarkMessage(message, "")
+	// Processar reply de acordo com a máquina de estados; a transição de
+	// estado e os próximos comandos são gravados na mesma transação
+	err := h.orchestrator.withTx(func(o *Orchestrator) error {
+		return o.processReply(topic, &reply)
+	})
+	if err != nil {
+		return fmt.Errorf("erro ao processar reply: %w", err)
 	}
 	return nil
 }
 
-// startNewSaga inicia uma nova SAGA a partir do pedido recebido
-func (o *Orchestrator) startNewSaga(data []byte) error {
+// startNewSaga inicia uma nova SAGA a partir do pedido recebido. Se o pedido
+// chegou com traceparent, a SAGA continua o trace de quem o publicou.
+func (o *Orchestrator) startNewSaga(data []byte, parent tracing.SpanContext) error {
 	var orderData map[string]interface{}
 	if err := json.Unmarshal(data, &orderData); err != nil {
-		return err
+		return deadletter.Permanent(fmt.Errorf("pedido inválido: %w", err))
 	}
 
-	sagaID := generateID()
+	sagaID := ids.New()
 	orderID, ok := orderData["order_id"].(string)
 	if !ok {
-		orderID = generateID()
+		orderID = ids.New()
 		orderData["order_id"] = orderID
+	} else {
+		// Mensagem reentregue após uma queda: a SAGA do pedido já existe
+		var existing string
+		err := o.db.QueryRow("SELECT saga_id FROM saga_events WHERE order_id = $1 LIMIT 1", orderID).Scan(&existing)
+		if err == nil {
+			log.Printf("Pedido %s já possui a SAGA %s, ignorando", orderID, existing)
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	traceID := parent.TraceID
+	if !traceID.IsValid() {
+		traceID = tracing.NewTraceID()
 	}
 
-	log.Printf("Iniciando nova SAGA: %s para pedido: %s", sagaID, orderID)
+	log.Printf("Iniciando nova SAGA: %s para pedido: %s (trace %s)", sagaID, orderID, traceID)
 
 	// Salvar evento inicial
 	event := &SagaEvent{
@@ -290,161 +477,173 @@ func (o *Orchestrator) startNewSaga(data []byte) error {
 		State:     StatePending,
 		Data:      orderData,
 		Timestamp: time.Now(),
+		TraceID:   traceID.String(),
 	}
 
 	if err := o.saveEvent(event); err != nil {
 		return err
 	}
 
-	// Iniciar SAGA enviando comando para validar pedido
-	cmd := &Command{
-		CommandID:   generateID(),
-		SagaID:      sagaID,
-		OrderID:     orderID,
-		CommandType: "VALIDATE_ORDER",
-		Payload:     orderData,
-		Timestamp:   time.Now(),
-	}
-
-	return o.sendCommand("pedidos-commands", cmd)
+	// Iniciar SAGA enviando o(s) comando(s) da primeira etapa
+	return o.dispatchStep(0, sagaID, orderID, orderData)
 }
 
 // processReply processa a resposta e avança na máquina de estados
 func (o *Orchestrator) processReply(topic string, reply *Reply) error {
+	// Serializar replies da mesma SAGA; ramos paralelos respondem em
+	// tópicos diferentes e são consumidos ao mesmo tempo
+	if err := o.lockSaga(reply.SagaID); err != nil {
+		return err
+	}
+
 	// Buscar estado atual da SAGA
 	currentState, err := o.getCurrentState(reply.SagaID)
-	if err != nil {
+	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
 
 	log.Printf("Estado atual da SAGA %s: %s", reply.SagaID, currentState)
 
+	// Garantir que o reply corresponde ao comando pendente da etapa atual
+	cmd, reason, err := o.correlateReply(topic, reply, currentState)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return o.rejectReply(topic, reply, currentState, reason)
+	}
+
+	// Reply de compensação: seguir para a próxima ou tentar novamente
+	if cmd.Kind == CommandKindCompensation {
+		return o.handleCompensationReply(cmd, reply, currentState)
+	}
+
+	// Reply do estorno de uma entrega devolvida
+	if cmd.Kind == CommandKindRefund {
+		return o.handleRefundReply(cmd, reply)
+	}
+
+	// Localizar a etapa que respondeu
+	stepIndex := o.definition.StepIndex(cmd.Step)
+
+	// O order_id da SAGA é o do pedido recebido, não o devolvido nos replies
+	orderID, err := o.sagaOrderID(reply.SagaID)
+	if err != nil {
+		return err
+	}
+
+	// Ramo de um grupo paralelo: aguardar os demais ramos antes de decidir
+	if o.definition.Steps[stepIndex].IsGroup() {
+		return o.handleBranchReply(cmd, reply, stepIndex, orderID)
+	}
+
 	// Se a resposta foi de falha, iniciar compensação
 	if !reply.Success {
-		return o.startCompensation(reply.SagaID, currentState, reply.Message)
-	}
-
-	// Avançar para próximo estado baseado no tópico
-	var nextState SagaState
-	var nextCommand *Command
-
-	// Extrair order_id com segurança
-	orderID := o.getOrderID(reply)
-
-	switch topic {
-	case "pedidos-reply":
-		nextState = StateOrderValidated
-		// Próximo passo: reservar estoque
-		nextCommand = &Command{
-			CommandID:   generateID(),
-			SagaID:      reply.SagaID,
-			OrderID:     orderID,
-			CommandType: "RESERVE_STOCK",
-			Payload:     reply.Data,
-			Timestamp:   time.Now(),
-		}
-		if err := o.sendCommand("estoque-commands", nextCommand); err != nil {
-			return err
-		}
+		return o.startCompensation(reply.SagaID, currentState, CompensationCauseStepFailed, reply.Message)
+	}
 
-	case "estoque-reply":
-		nextState = StateStockReserved
-		// Próximo passo: processar pagamento
-		nextCommand = &Command{
-			CommandID:   generateID(),
-			SagaID:      reply.SagaID,
-			OrderID:     orderID,
-			CommandType: "PROCESS_PAYMENT",
-			Payload:     reply.Data,
-			Timestamp:   time.Now(),
-		}
-		if err := o.sendCommand("pagamentos-commands", nextCommand); err != nil {
-			return err
-		}
+	return o.advance(reply.SagaID, orderID, stepIndex, reply.Data)
+}
 
-	case "pagamentos-reply":
-		nextState = StatePaymentProcessed
-		// Próximo passo: agendar entrega
-		nextCommand = &Command{
-			CommandID:   generateID(),
-			SagaID:      reply.SagaID,
-			OrderID:     orderID,
-			CommandType: "SCHEDULE_DELIVERY",
-			Payload:     reply.Data,
-			Timestamp:   time.Now(),
-		}
-		if err := o.sendCommand("entregas-commands", nextCommand); err != nil {
-			return err
-		}
+// advance registra a conclusão da etapa e envia a próxima, ou conclui a
+// SAGA se a etapa for a última
+func (o *Orchestrator) advance(sagaID, orderID string, index int, data map[string]interface{}) error {
+	step := o.definition.Steps[index]
 
-	case "entregas-reply":
-		nextState = StateCompleted
-		log.Printf("SAGA %s concluída com sucesso!", reply.SagaID)
+	// Última etapa concluída: encerrar a SAGA
+	if o.definition.IsLastStep(index) {
+		return o.completeSaga(sagaID, orderID, step.State, data)
+	}
 
-		// Publicar evento de pedido processado
-		if err := o.publishOrderProcessed(reply.SagaID, reply.Data); err != nil {
-			log.Printf("Erro ao publicar pedido processado: %v", err)
-		}
+	// Próximo passo definido na SAGA
+	if err := o.dispatchStep(index+1, sagaID, orderID, data); err != nil {
+		return err
 	}
 
 	// Salvar evento de transição de estado
 	return o.saveEvent(&SagaEvent{
-		SagaID:    reply.SagaID,
+		SagaID:    sagaID,
 		OrderID:   orderID,
-		State:     nextState,
-		Data:      reply.Data,
+		State:     step.State,
+		Data:      data,
 		Timestamp: time.Now(),
 	})
 }
 
-// startCompensation inicia o processo de compensação
-func (o *Orchestrator) startCompensation(sagaID string, currentState SagaState, errorMsg string) error {
-	log.Printf("Iniciando compensação para SAGA %s. Motivo: %s", sagaID, errorMsg)
-
-	// Salvar evento de compensação
-	event := &SagaEvent{
+// completeSaga registra o estado da última etapa e conclui a SAGA
+func (o *Orchestrator) completeSaga(sagaID, orderID string, state SagaState, data map[string]interface{}) error {
+	if err := o.saveEvent(&SagaEvent{
 		SagaID:    sagaID,
-		State:     StateCompensating,
-		Error:     errorMsg,
+		OrderID:   orderID,
+		State:     state,
+		Data:      data,
 		Timestamp: time.Now(),
-	}
-
-	if err := o.saveEvent(event); err != nil {
+	}); err != nil {
 		return err
 	}
 
-	// Executar compensações na ordem inversa
-	switch currentState {
-	case StatePaymentProcessed:
-		// Cancelar pagamento
-		o.sendCompensation("pagamentos-commands", sagaID, "CANCEL_PAYMENT")
-		fallthrough
-	case StateStockReserved:
-		// Liberar estoque
-		o.sendCompensation("estoque-commands", sagaID, "RELEASE_STOCK")
-		fallthrough
-	case StateOrderValidated:
-		// Cancelar pedido
-		o.sendCompensation("pedidos-commands", sagaID, "CANCEL_ORDER")
+	log.Printf("SAGA %s concluída com sucesso!", sagaID)
+
+	// Publicar evento de pedido processado
+	if err := o.publishOrderProcessed(sagaID, orderID, StateCompleted, "", data); err != nil {
+		log.Printf("Erro ao publicar pedido processado: %v", err)
 	}
 
-	// Marcar SAGA como falhada
-	return o.saveEvent(&SagaEvent{
+	if err := o.saveEvent(&SagaEvent{
 		SagaID:    sagaID,
-		State:     StateFailed,
-		Error:     errorMsg,
+		OrderID:   orderID,
+		State:     StateCompleted,
+		Data:      data,
 		Timestamp: time.Now(),
-	})
+	}); err != nil {
+		return err
+	}
+
+	// Uma devolução recebida antes da conclusão é estornada agora
+	return o.startRefund(sagaID)
+}
+
+// dispatchStep envia o comando da etapa ou, em um grupo, os comandos de
+// todos os ramos que ainda não foram concluídos
+func (o *Orchestrator) dispatchStep(index int, sagaID, orderID string, payload map[string]interface{}) error {
+	group := o.definition.Steps[index].IsGroup()
+
+	for _, step := range o.definition.Branches(index) {
+		if group {
+			last, err := o.latestCommand(sagaID, step.Name, CommandKindStep)
+			if err != nil {
+				return err
+			}
+			if last != nil && last.Succeeded() {
+				continue
+			}
+		}
+
+		if err := o.sendStepCommand(step, sagaID, orderID, payload); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (o *Orchestrator) sendCompensation(topic, sagaID, commandType string) error {
+// sendStepCommand envia o comando de uma etapa da SAGA
+func (o *Orchestrator) sendStepCommand(step SagaStep, sagaID, orderID string, payload map[string]interface{}) error {
 	cmd := &Command{
-		CommandID:   generateID(),
-		SagaID:      sagaID,
-		CommandType: commandType,
-		Timestamp:   time.Now(),
+		CommandID:      ids.New(),
+		SagaID:         sagaID,
+		OrderID:        orderID,
+		CommandType:    step.CommandType,
+		PayloadVersion: step.PayloadVersion,
+		Payload:        payload,
+		Timestamp:      time.Now(),
+	}
+
+	// Registrar o prazo antes do envio para que o watchdog perceba a falta de resposta
+	if err := o.registerDeadline(step, CommandKindStep, cmd); err != nil {
+		return err
 	}
-	return o.sendCommand(topic, cmd)
+
+	return o.sendCommand(step.CommandTopic, cmd)
 }
 
 func (o *Orchestrator) sendCommand(topic string, cmd *Command) error {
@@ -453,94 +652,157 @@ func (o *Orchestrator) sendCommand(topic string, cmd *Command) error {
 		return err
 	}
 
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Value: sarama.ByteEncoder(data),
+	// O span do comando foi criado junto com o prazo em saga_deadlines
+	var traceparent sql.NullString
+	err = o.db.QueryRow(
+		"SELECT traceparent FROM saga_deadlines WHERE command_id = $1", cmd.CommandID,
+	).Scan(&traceparent)
+	if err != nil && err != sql.ErrNoRows {
+		return err
 	}
 
-	_, _, err = o.producer.SendMessage(msg)
-	if err != nil {
+	// O comando é publicado pelo relay do outbox após o commit da transação
+	if err := o.enqueue(topic, cmd.SagaID, data, traceparent.String); err != nil {
 		return err
 	}
 
-	log.Printf("Comando enviado para %s: %s", topic, cmd.CommandType)
+	log.Printf("Comando registrado para %s: %s", topic, cmd.CommandType)
 	return nil
 }
 
-// publishOrderProcessed publica evento de pedido processado com sucesso
-func (o *Orchestrator) publishOrderProcessed(sagaID string, data map[string]interface{}) error {
+// publishOrderProcessed publica o resultado final do pedido: COMPLETED,
+// FAILED (compensado) ou COMPENSATION_FAILED
+func (o *Orchestrator) publishOrderProcessed(sagaID, orderID string, status SagaState, errorMsg string, data map[string]interface{}) error {
+	if o.definition.CompletedTopic == "" {
+		return nil
+	}
+
 	event := map[string]interface{}{
 		"saga_id":   sagaID,
-		"order_id":  data["order_id"],
-		"status":    "COMPLETED",
+		"order_id":  orderID,
+		"status":    status,
 		"timestamp": time.Now().Format(time.RFC3339),
 		"data":      data,
 	}
+	if errorMsg != "" {
+		event["error"] = errorMsg
+	}
 
 	eventData, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
 
-	msg := &sarama.ProducerMessage{
-		Topic: "pedido-saga-pedido-processado",
-		Value: sarama.ByteEncoder(eventData),
+	root, err := o.sagaSpanContext(sagaID)
+	if err != nil {
+		return err
+	}
+	var traceparent string
+	if root.IsValid() {
+		traceparent = root.Traceparent()
 	}
 
-	_, _, err = o.producer.SendMessage(msg)
-	if err != nil {
+	if err := o.enqueue(o.definition.CompletedTopic, sagaID, eventData, traceparent); err != nil {
 		return err
 	}
 
-	log.Printf("Pedido processado publicado: SAGA %s", sagaID)
+	log.Printf("Pedido processado registrado: SAGA %s (%s)", sagaID, status)
 	return nil
 }
 
+// saveEvent grava o evento em saga_events e o aplica à projeção
+// saga_instances na mesma transação; fora de withTx abre uma própria. Sem
+// OrderID, o evento leva o order_id registrado em saga_instances.
 func (o *Orchestrator) saveEvent(event *SagaEvent) error {
-	dataJSON, _ := json.Marshal(event.Data)
+	if o.hooks == nil {
+		return o.withTx(func(o *Orchestrator) error {
+			return o.saveEvent(event)
+		})
+	}
+
+	// Eventos do próprio orquestrador (timeout, compensação, resolução manual,
+	// ...) herdam o pedido com que a SAGA foi iniciada
+	if event.OrderID == "" {
+		orderID, err := o.sagaOrderID(event.SagaID)
+		if err != nil {
+			return err
+		}
+		event.OrderID = orderID
+	}
 
-	_, err := o.db.Exec(
-		"INSERT INTO saga_events (saga_id, order_id, state, data, error) VALUES ($1, $2, $3, $4, $5)",
-		event.SagaID, event.OrderID, event.State, dataJSON, event.Error,
-	)
+	dataJSON, _ := json.Marshal(event.Data)
 
+	stored := &projectedEvent{
+		SagaID:  event.SagaID,
+		OrderID: event.OrderID,
+		State:   event.State,
+		Error:   event.Error,
+	}
+	err := o.db.QueryRow(
+		`INSERT INTO saga_events (saga_id, order_id, state, data, error, trace_id)
+		 VALUES ($1, $2, $3, $4, $5, COALESCE(NULLIF($6, ''),
+			(SELECT trace_id FROM saga_events WHERE saga_id = $1 ORDER BY id LIMIT 1)))
+		 RETURNING id, trace_id, created_at`,
+		event.SagaID, event.OrderID, event.State, dataJSON, event.Error, event.TraceID,
+	).Scan(&stored.ID, &stored.TraceID, &stored.CreatedAt)
 	if err != nil {
 		return err
 	}
 
+	if err := o.project(stored); err != nil {
+		return err
+	}
+
 	log.Printf("Evento salvo: SAGA %s -> %s", event.SagaID, event.State)
+
+	o.observeSagaState(event.State)
+
+	switch event.State {
+	case StateCompleted, StateFailed, StateCompensationFailed:
+		return o.finishSagaSpan(event)
+	}
 	return nil
 }
 
+// getCurrentState lê o estado atual da SAGA na projeção saga_instances.
+// Dentro de withTx a versão lida passa a ser exigida pelo próximo saveEvent.
 func (o *Orchestrator) getCurrentState(sagaID string) (SagaState, error) {
-	var state string
-	err := o.db.QueryRow(
-		"SELECT state FROM saga_events WHERE saga_id = $1 ORDER BY created_at DESC LIMIT 1",
-		sagaID,
-	).Scan(&state)
-
+	state, version, err := o.sagaStateVersion(sagaID)
 	if err != nil {
 		return StatePending, err
 	}
 
-	return SagaState(state), nil
+	o.expectVersion(sagaID, version)
+	return state, nil
 }
 
-// getOrderID extrai o order_id do reply.Data com segurança
-func (o *Orchestrator) getOrderID(reply *Reply) string {
-	if reply.Data == nil {
-		return ""
-	}
+// sagaStateVersion lê o estado e a versão da SAGA sem registrar a versão
+func (o *Orchestrator) sagaStateVersion(sagaID string) (SagaState, int64, error) {
+	var state string
+	var version int64
+	err := o.db.QueryRow(
+		"SELECT state, version FROM saga_instances WHERE saga_id = $1",
+		sagaID,
+	).Scan(&state, &version)
 
-	if orderID, ok := reply.Data["order_id"].(string); ok {
-		return orderID
+	if err != nil {
+		return StatePending, 0, err
 	}
 
-	return ""
+	return SagaState(state), version, nil
 }
 
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+// sagaOrderID busca o order_id com que a SAGA foi iniciada. Ele é repassado
+// em todos os comandos para que os participantes identifiquem o pedido.
+func (o *Orchestrator) sagaOrderID(sagaID string) (string, error) {
+	var orderID string
+	err := o.db.QueryRow(
+		"SELECT order_id FROM saga_instances WHERE saga_id = $1", sagaID,
+	).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return orderID, err
 }
 
 func getEnv(key, defaultValue string) string {
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+	"saga/tracing"
+)
+
+// dbtx é implementado por *sql.DB e *sql.Tx, permitindo que as mesmas
+// operações do orquestrador rodem dentro ou fora de uma transação
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// withTx executa fn com uma cópia do orquestrador ligada a uma transação.
+// Eventos de estado, comandos registrados e mensagens do outbox gravados
+// dentro de fn são confirmados juntos ou descartados juntos.
+func (o *Orchestrator) withTx(fn func(o *Orchestrator) error) error {
+	tx, err := o.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	var hooks []func()
+	txOrch := *o
+	txOrch.db = tx
+	txOrch.hooks = &hooks
+	txOrch.versions = make(map[string]int64)
+
+	if err := fn(&txOrch); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	o.notifyOutbox()
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// afterCommit adia fn até o commit da transação atual; spans e métricas não
+// devem refletir transações descartadas. Fora de uma transação fn roda na hora.
+func (o *Orchestrator) afterCommit(fn func()) {
+	if o.hooks != nil {
+		*o.hooks = append(*o.hooks, fn)
+		return
+	}
+	fn()
+}
+
+// lockSaga impede que outra transação altere a mesma SAGA até o fim da
+// transação atual
+func (o *Orchestrator) lockSaga(sagaID string) error {
+	_, err := o.db.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", sagaID)
+	return err
+}
+
+// errSagaChanged indica que outra transação alterou a SAGA depois que ela foi
+// lida. A mensagem é tentada de novo e encontra o estado atualizado.
+var errSagaChanged = errors.New("SAGA alterada por outra transação")
+
+// expectVersion faz o próximo saveEvent da SAGA na transação exigir a versão
+// informada. Fora de withTx não tem efeito.
+func (o *Orchestrator) expectVersion(sagaID string, version int64) {
+	if o.versions != nil {
+		o.versions[sagaID] = version
+	}
+}
+
+// enqueue grava a mensagem no outbox; o envio ao Kafka é feito pelo relay
+// depois que a transação é confirmada. A chave é o ID da SAGA e o traceparent,
+// se houver, vira header da mensagem.
+func (o *Orchestrator) enqueue(topic, key string, payload []byte, traceparent string) error {
+	_, err := o.db.Exec(
+		`INSERT INTO saga_outbox (topic, message_key, payload, traceparent)
+		 VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, ''))`,
+		topic, key, payload, traceparent,
+	)
+	return err
+}
+
+// notifyOutbox acorda o relay sem bloquear quem confirmou a transação
+func (o *Orchestrator) notifyOutbox() {
+	select {
+	case o.outboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// relayOutbox publica no Kafka as mensagens pendentes do outbox, na ordem em
+// que foram gravadas. Uma falha entre o envio e a marcação de envio resulta
+// em reenvio, tratado pela idempotência por command_id dos participantes.
+func (o *Orchestrator) relayOutbox(ctx context.Context) {
+	interval, err := time.ParseDuration(getEnv("OUTBOX_INTERVAL", "1s"))
+	if err != nil {
+		log.Printf("OUTBOX_INTERVAL inválido, usando 1s: %v", err)
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := o.flushOutbox(); err != nil {
+			log.Printf("Erro ao publicar outbox: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.outboxSignal:
+		}
+	}
+}
+
+type outboxMessage struct {
+	ID          int64
+	Topic       string
+	Key         string
+	Payload     []byte
+	Traceparent string
+}
+
+// outboxLockKey identifica o advisory lock do relay: com várias réplicas do
+// orquestrador, apenas uma publica o outbox por vez, na ordem de gravação
+const outboxLockKey = "saga_outbox_relay"
+
+func (o *Orchestrator) flushOutbox() error {
+	tx, err := o.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock(hashtext($1))", outboxLockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		// Outra réplica está publicando
+		return nil
+	}
+
+	rows, err := tx.Query(
+		`SELECT id, topic, COALESCE(message_key, ''), payload, COALESCE(traceparent, '')
+		 FROM saga_outbox WHERE sent_at IS NULL ORDER BY id LIMIT 100`,
+	)
+	if err != nil {
+		return err
+	}
+
+	var pending []outboxMessage
+	for rows.Next() {
+		var m outboxMessage
+		if err := rows.Scan(&m.ID, &m.Topic, &m.Key, &m.Payload, &m.Traceparent); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		msg := &sarama.ProducerMessage{
+			Topic: m.Topic,
+			Value: sarama.ByteEncoder(m.Payload),
+		}
+		if m.Key != "" {
+			msg.Key = sarama.StringEncoder(m.Key)
+		}
+		if sc, ok := tracing.ParseTraceparent(m.Traceparent); ok {
+			msg.Headers = tracing.Headers(sc)
+		}
+
+		// Parar no primeiro erro para preservar a ordem das mensagens
+		if _, _, err := o.producer.SendMessage(msg); err != nil {
+			return err
+		}
+
+		// A marcação usa a conexão fora da transação, que só segura o lock:
+		// mensagens já enviadas ficam marcadas mesmo se um envio seguinte falhar
+		if _, err := o.conn.Exec("UPDATE saga_outbox SET sent_at = CURRENT_TIMESTAMP WHERE id = $1", m.ID); err != nil {
+			return err
+		}
+
+		log.Printf("Mensagem do outbox publicada em %s", m.Topic)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// commandResult é o resultado do comando mais recente de uma etapa
+type commandResult struct {
+	Step     string
+	Status   string
+	Success  sql.NullBool
+	Message  sql.NullString
+	Attempts int
+}
+
+// Succeeded indica se o participante confirmou o comando com sucesso
+func (r *commandResult) Succeeded() bool {
+	return r.Status == DeadlineReplied && r.Success.Valid && r.Success.Bool
+}
+
+// Done indica se o comando já terminou, com sucesso, falha ou timeout
+func (r *commandResult) Done() bool {
+	return r.Status != DeadlinePending && r.Status != DeadlineScheduled
+}
+
+// failure descreve por que o comando não foi concluído
+func (r *commandResult) failure() string {
+	if r.Status == DeadlineExpired {
+		return fmt.Sprintf("Timeout aguardando resposta da etapa %s após %d tentativa(s)", r.Step, r.Attempts)
+	}
+	return fmt.Sprintf("%s: %s", r.Step, r.Message.String)
+}
+
+// latestCommand busca o comando mais recente da etapa na SAGA, ou nil se a
+// etapa ainda não foi enviada
+func (o *Orchestrator) latestCommand(sagaID, step, kind string) (*commandResult, error) {
+	r := &commandResult{Step: step}
+	err := o.db.QueryRow(
+		`SELECT status, success, result_message, attempts FROM saga_deadlines
+		 WHERE saga_id = $1 AND step = $2 AND kind = $3
+		 ORDER BY created_at DESC LIMIT 1`,
+		sagaID, step, kind,
+	).Scan(&r.Status, &r.Success, &r.Message, &r.Attempts)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// handleBranchReply registra o estado parcial do ramo concluído e tenta
+// fechar o grupo. Falhas não mudam o estado: a compensação só começa quando
+// todos os ramos terminarem, para que nenhum ramo bem-sucedido fique sem
+// ser compensado.
+func (o *Orchestrator) handleBranchReply(cmd *outstandingCommand, reply *Reply, index int, orderID string) error {
+	if reply.Success {
+		branch, _ := o.definition.StepByName(cmd.Step)
+		if err := o.saveEvent(&SagaEvent{
+			SagaID:    reply.SagaID,
+			OrderID:   orderID,
+			State:     branch.State,
+			Data:      reply.Data,
+			Timestamp: time.Now(),
+		}); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Ramo %s falhou (SAGA %s): %s", cmd.Step, reply.SagaID, reply.Message)
+	}
+
+	return o.joinGroup(reply.SagaID, orderID, index)
+}
+
+// joinGroup faz o fan-in de um grupo paralelo: aguarda enquanto houver ramo
+// em andamento, compensa se algum ramo falhou ou expirou e avança com os
+// dados de todos os ramos quando todos foram concluídos
+func (o *Orchestrator) joinGroup(sagaID, orderID string, index int) error {
+	group := o.definition.Steps[index]
+
+	var failures []string
+	timedOut := false
+
+	for _, branch := range group.Parallel {
+		r, err := o.latestCommand(sagaID, branch.Name, CommandKindStep)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return fmt.Errorf("ramo %s do grupo %s não foi enviado", branch.Name, group.Name)
+		}
+		if !r.Done() {
+			log.Printf("SAGA %s: grupo %s aguardando o ramo %s", sagaID, group.Name, branch.Name)
+			return nil
+		}
+		if !r.Succeeded() {
+			failures = append(failures, r.failure())
+			timedOut = timedOut || r.Status == DeadlineExpired
+		}
+	}
+
+	if len(failures) > 0 {
+		return o.failGroup(sagaID, group, failures, timedOut)
+	}
+
+	data, err := o.mergeBranchData(sagaID, group)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("SAGA %s: todos os ramos do grupo %s concluídos", sagaID, group.Name)
+	return o.advance(sagaID, orderID, index, data)
+}
+
+// failGroup inicia a compensação do grupo e das etapas anteriores. Todos os
+// ramos enviados são compensados, inclusive os que falharam ou expiraram,
+// mesmo que nenhum ramo tenha sido concluído.
+func (o *Orchestrator) failGroup(sagaID string, group SagaStep, failures []string, timedOut bool) error {
+	if _, err := o.getCurrentState(sagaID); err != nil {
+		return err
+	}
+
+	errorMsg := fmt.Sprintf("Grupo %s falhou: %s", group.Name, strings.Join(failures, "; "))
+
+	if timedOut {
+		if err := o.saveEvent(&SagaEvent{
+			SagaID:    sagaID,
+			State:     StateTimedOut,
+			Data:      map[string]interface{}{"step": group.Name},
+			Error:     errorMsg,
+			Timestamp: time.Now(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	cause := CompensationCauseStepFailed
+	if timedOut {
+		cause = CompensationCauseTimeout
+	}
+
+	return o.startCompensationFrom(sagaID, o.definition.StepIndex(group.Name), cause, errorMsg)
+}
+
+// mergeBranchData combina os dados dos replies de todos os ramos, na ordem
+// em que estão declarados, para formar o payload da próxima etapa
+func (o *Orchestrator) mergeBranchData(sagaID string, group SagaStep) (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+
+	for _, branch := range group.Parallel {
+		var data []byte
+		err := o.db.QueryRow(
+			`SELECT data FROM saga_events
+			 WHERE saga_id = $1 AND state = $2 ORDER BY id DESC LIMIT 1`,
+			sagaID, branch.State,
+		).Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+
+		var branchData map[string]interface{}
+		if err := json.Unmarshal(data, &branchData); err != nil {
+			return nil, err
+		}
+		for k, v := range branchData {
+			merged[k] = v
+		}
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"saga/ids"
+)
+
+// TestFailedGroupCompensatesEveryIssuedBranch recusa a reserva de estoque e
+// deixa o pagamento expirar, sem nenhum ramo concluído. Os dois ramos foram
+// enviados e podem ter sido executados, então RELEASE_STOCK e CANCEL_PAYMENT
+// precisam ser enviados antes de compensar a validação.
+func TestFailedGroupCompensatesEveryIssuedBranch(t *testing.T) {
+	db := testDB(t)
+	broker := newMemBroker(3)
+	o := newTestOrchestrator(t, db, &fakeProducer{broker: broker})
+
+	validate := startTestSaga(t, o, broker)
+	sagaID := validate.SagaID
+
+	err := o.withTx(func(o *Orchestrator) error {
+		return o.processReply("pedidos-reply", validatedReply(validate))
+	})
+	if err != nil {
+		t.Fatalf("erro ao processar validação: %v", err)
+	}
+	if err := o.flushOutbox(); err != nil {
+		t.Fatalf("erro ao publicar outbox: %v", err)
+	}
+
+	reserve := broker.commands(t, "estoque-commands")
+	payment := broker.commands(t, "pagamentos-commands")
+	if len(reserve) != 1 || len(payment) != 1 {
+		t.Fatalf("esperava os comandos dos dois ramos, obteve %d e %d", len(reserve), len(payment))
+	}
+
+	err = o.withTx(func(o *Orchestrator) error {
+		return o.processReply("estoque-reply", &Reply{
+			ReplyID:   ids.New(),
+			CommandID: reserve[0].CommandID,
+			SagaID:    sagaID,
+			Success:   false,
+			Message:   "Estoque indisponível",
+			Timestamp: time.Now(),
+		})
+	})
+	if err != nil {
+		t.Fatalf("erro ao processar recusa do estoque: %v", err)
+	}
+
+	step, _ := o.definition.StepByName("processar-pagamento")
+	err = o.withTx(func(o *Orchestrator) error {
+		return o.handleExpired(expiredDeadline{
+			CommandID: payment[0].CommandID,
+			SagaID:    sagaID,
+			OrderID:   payment[0].OrderID,
+			Step:      step.Name,
+			Kind:      CommandKindStep,
+			Status:    DeadlinePending,
+			Attempts:  step.MaxRetries + 1,
+		})
+	})
+	if err != nil {
+		t.Fatalf("erro ao tratar prazo expirado do pagamento: %v", err)
+	}
+	if err := o.flushOutbox(); err != nil {
+		t.Fatalf("erro ao publicar outbox: %v", err)
+	}
+
+	compensations := make(map[string]int)
+	for _, topic := range []string{"pedidos-commands", "estoque-commands", "pagamentos-commands"} {
+		for _, cmd := range broker.commands(t, topic) {
+			compensations[cmd.CommandType]++
+		}
+	}
+	for _, commandType := range []string{"RELEASE_STOCK", "CANCEL_PAYMENT"} {
+		if compensations[commandType] != 1 {
+			t.Errorf("compensação %s enviada %d vez(es)", commandType, compensations[commandType])
+		}
+	}
+	if compensations["CANCEL_ORDER"] != 0 {
+		t.Errorf("validação compensada antes da confirmação dos ramos")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// replayBatchSize limita os eventos lidos por consulta durante o replay
+const replayBatchSize = 500
+
+// projectedEvent é o evento de saga_events já gravado, com o id e o horário
+// atribuídos pelo banco
+type projectedEvent struct {
+	ID        int64
+	SagaID    string
+	OrderID   string
+	State     SagaState
+	Error     string
+	TraceID   sql.NullString
+	CreatedAt time.Time
+}
+
+// project aplica o evento à projeção saga_instances. O evento só é aplicado
+// se for posterior ao último já refletido na SAGA, então eventos com o mesmo
+// created_at são ordenados pelo id e reaplicar um evento não tem efeito.
+//
+// O order_id e o início vêm do primeiro evento; a etapa e o último erro só
+// mudam quando o evento traz um valor, para que a SAGA em compensação
+// continue mostrando a etapa em que parou e o motivo da falha.
+//
+// Cada evento aplicado incrementa a versão da SAGA. Se a transação leu a SAGA
+// antes (getCurrentState), o evento só é aplicado sobre a versão lida; caso
+// contrário outra réplica a alterou no meio tempo e errSagaChanged desfaz a
+// transação inteira.
+func (o *Orchestrator) project(e *projectedEvent) error {
+	var step sql.NullString
+	if name := o.stepOfState(e.State); name != "" {
+		step = sql.NullString{String: name, Valid: true}
+	}
+
+	var lastError sql.NullString
+	if e.Error != "" {
+		lastError = sql.NullString{String: e.Error, Valid: true}
+	}
+
+	var finishedAt sql.NullTime
+	if isTerminal(e.State) {
+		finishedAt = sql.NullTime{Time: e.CreatedAt, Valid: true}
+	}
+
+	expected, checked := o.versions[e.SagaID]
+
+	var version int64
+	err := o.db.QueryRow(
+		`INSERT INTO saga_instances (saga_id, order_id, state, step, last_event_id, last_error,
+			trace_id, started_at, updated_at, finished_at, version)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8, $9, 1)
+		 ON CONFLICT (saga_id) DO UPDATE SET
+			state = EXCLUDED.state,
+			step = COALESCE(EXCLUDED.step, saga_instances.step),
+			last_event_id = EXCLUDED.last_event_id,
+			last_error = COALESCE(EXCLUDED.last_error, saga_instances.last_error),
+			trace_id = COALESCE(saga_instances.trace_id, EXCLUDED.trace_id),
+			updated_at = EXCLUDED.updated_at,
+			finished_at = EXCLUDED.finished_at,
+			version = saga_instances.version + 1
+		 WHERE saga_instances.last_event_id < EXCLUDED.last_event_id
+			AND (NOT $10 OR saga_instances.version = $11)
+		 RETURNING version`,
+		e.SagaID, e.OrderID, e.State, step, e.ID, lastError,
+		e.TraceID, e.CreatedAt, finishedAt, checked, expected,
+	).Scan(&version)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s (versão lida %d)", errSagaChanged, e.SagaID, expected)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Eventos seguintes na mesma transação partem da versão recém-gravada
+	o.expectVersion(e.SagaID, version)
+	return nil
+}
+
+// stepOfState retorna o nome da etapa, ou do ramo de grupo, cujo sucesso leva
+// ao estado. Estados que não pertencem a nenhuma etapa retornam "".
+func (o *Orchestrator) stepOfState(state SagaState) string {
+	index := o.definition.StepByState(state)
+	if index < 0 {
+		return ""
+	}
+	for _, step := range o.definition.Branches(index) {
+		if step.State == state {
+			return step.Name
+		}
+	}
+	return o.definition.Steps[index].Name
+}
+
+// rebuildProjection recria saga_instances do zero relendo saga_events na
+// ordem em que os eventos foram gravados. Roda em uma única transação: o
+// TRUNCATE bloqueia a projeção, então eventos gravados durante o replay
+// esperam e são aplicados depois dele. Retorna o número de eventos aplicados.
+func (o *Orchestrator) rebuildProjection() (int, error) {
+	applied := 0
+
+	err := o.withTx(func(o *Orchestrator) error {
+		if _, err := o.db.Exec("TRUNCATE saga_instances"); err != nil {
+			return err
+		}
+
+		var lastID int64
+		for {
+			batch, err := o.eventsAfter(lastID)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+
+			for _, e := range batch {
+				if err := o.project(e); err != nil {
+					return err
+				}
+			}
+
+			applied += len(batch)
+			lastID = batch[len(batch)-1].ID
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return applied, nil
+}
+
+// eventsAfter lê o próximo lote de eventos. As linhas são fechadas antes de
+// aplicar o lote, pois a transação não aceita outra consulta com elas abertas.
+func (o *Orchestrator) eventsAfter(lastID int64) ([]*projectedEvent, error) {
+	rows, err := o.db.Query(
+		`SELECT id, saga_id, order_id, state, COALESCE(error, ''), trace_id, created_at
+		 FROM saga_events WHERE id > $1 ORDER BY id LIMIT $2`,
+		lastID, replayBatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []*projectedEvent
+	for rows.Next() {
+		e := &projectedEvent{}
+		if err := rows.Scan(&e.ID, &e.SagaID, &e.OrderID, &e.State, &e.Error,
+			&e.TraceID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		batch = append(batch, e)
+	}
+	return batch, rows.Err()
+}
+
+// ensureProjection preenche saga_instances a partir de saga_events quando a
+// projeção ainda está vazia, como na primeira subida após a sua criação
+func (o *Orchestrator) ensureProjection() error {
+	var empty, hasEvents bool
+	err := o.conn.QueryRow(
+		`SELECT NOT EXISTS (SELECT 1 FROM saga_instances), EXISTS (SELECT 1 FROM saga_events)`,
+	).Scan(&empty, &hasEvents)
+	if err != nil || !empty || !hasEvents {
+		return err
+	}
+
+	applied, err := o.rebuildProjection()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Projeção saga_instances criada a partir de %d evento(s)", applied)
+	return nil
+}
+
+// runReplay é o comando "replay": recria a projeção e encerra
+func runReplay(db *sql.DB, definition *SagaDefinition) {
+	orch := &Orchestrator{db: db, conn: db, definition: definition}
+
+	start := time.Now()
+	applied, err := orch.rebuildProjection()
+	if err != nil {
+		log.Fatal("Erro ao recriar a projeção saga_instances:", err)
+	}
+
+	log.Printf("Projeção saga_instances recriada: %d evento(s) aplicados em %s",
+		applied, time.Since(start).Round(time.Millisecond))
+}
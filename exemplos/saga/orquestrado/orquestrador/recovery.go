@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// recoverSagas retoma as SAGAs que estavam em andamento quando o orquestrador
+// parou. Comandos já gravados no outbox são publicados pelo relay e prazos
+// pendentes continuam com o watchdog; aqui tratamos as SAGAs que ficaram sem
+// nenhum comando pendente e por isso nunca avançariam sozinhas.
+func (o *Orchestrator) recoverSagas() error {
+	rows, err := o.conn.Query(
+		`SELECT saga_id, state FROM saga_instances i
+		WHERE state NOT IN ($1, $2, $3, $4, $5, $6)
+		AND NOT EXISTS (
+			SELECT 1 FROM saga_deadlines d
+			WHERE d.saga_id = i.saga_id AND d.status IN ($7, $8)
+		)`,
+		StateCompleted, StateFailed, StateResolved, StateCompensationFailed, StateRefunded, StateRefundFailed,
+		DeadlinePending, DeadlineScheduled,
+	)
+	if err != nil {
+		return err
+	}
+
+	stalled := make(map[string]SagaState)
+	for rows.Next() {
+		var sagaID string
+		var state SagaState
+		if err := rows.Scan(&sagaID, &state); err != nil {
+			rows.Close()
+			return err
+		}
+		stalled[sagaID] = state
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	resumed := 0
+	for sagaID, state := range stalled {
+		var stuck bool
+		err := o.withTx(func(o *Orchestrator) error {
+			// Outra réplica subindo ao mesmo tempo pode já ter retomado a SAGA
+			var err error
+			if stuck, err = o.stillStalled(sagaID, state); err != nil || !stuck {
+				return err
+			}
+
+			log.Printf("Recuperando SAGA %s parada no estado %s", sagaID, state)
+			return o.resumeSaga(sagaID, state)
+		})
+		if err != nil {
+			log.Printf("Erro ao recuperar SAGA %s: %v", sagaID, err)
+			continue
+		}
+		if stuck {
+			resumed++
+		}
+	}
+
+	log.Printf("Recuperação concluída: %d SAGA(s) retomada(s)", resumed)
+	return nil
+}
+
+// stillStalled bloqueia a SAGA e confirma que ela continua no estado
+// encontrado e sem comandos pendentes
+func (o *Orchestrator) stillStalled(sagaID string, state SagaState) (bool, error) {
+	if err := o.lockSaga(sagaID); err != nil {
+		return false, err
+	}
+
+	current, err := o.getCurrentState(sagaID)
+	if err != nil || current != state {
+		return false, err
+	}
+
+	var pending bool
+	err = o.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM saga_deadlines WHERE saga_id = $1 AND status IN ($2, $3))`,
+		sagaID, DeadlinePending, DeadlineScheduled,
+	).Scan(&pending)
+	return !pending, err
+}
+
+// resumeSaga volta a conduzir uma SAGA sem comandos pendentes
+func (o *Orchestrator) resumeSaga(sagaID string, state SagaState) error {
+	switch state {
+	case StateCompensating:
+		return o.resumeCompensation(sagaID)
+	case StateRefunding:
+		return o.resendRefund(sagaID)
+	case StateTimedOut:
+		index, err := o.compensationStart(sagaID)
+		if err != nil {
+			return err
+		}
+		return o.startCompensationFrom(sagaID, index, CompensationCauseTimeout, "Compensação retomada após reinício do orquestrador")
+	default:
+		return o.retryCurrentStep(sagaID, state)
+	}
+}
+
+// resumeCompensation continua a compensação a partir da última compensação
+// confirmada ou, se nenhuma foi enviada, de onde ela começou
+func (o *Orchestrator) resumeCompensation(sagaID string) error {
+	var step string
+	err := o.db.QueryRow(
+		`SELECT step FROM saga_deadlines
+		 WHERE saga_id = $1 AND kind = $2 AND status = $3
+		 ORDER BY created_at DESC LIMIT 1`,
+		sagaID, CommandKindCompensation, DeadlineReplied,
+	).Scan(&step)
+
+	if err == nil {
+		return o.compensateFrom(sagaID, o.definition.StepIndex(step)-1)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	index, err := o.compensationStart(sagaID)
+	if err != nil {
+		return err
+	}
+	return o.compensateFrom(sagaID, index)
+}
+
+// compensationStart retorna o índice em que a compensação começa: a última
+// etapa concluída ou, se a SAGA expirou aguardando uma etapa posterior, a
+// etapa expirada
+func (o *Orchestrator) compensationStart(sagaID string) (int, error) {
+	before, err := o.stateBeforeCompensation(sagaID)
+	if err != nil {
+		return 0, err
+	}
+	index := o.definition.StepByState(before)
+
+	var step sql.NullString
+	err = o.db.QueryRow(
+		`SELECT data->>'step' FROM saga_events
+		 WHERE saga_id = $1 AND state = $2
+		 ORDER BY id DESC LIMIT 1`,
+		sagaID, StateTimedOut,
+	).Scan(&step)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if expired := o.definition.StepIndex(step.String); step.Valid && expired > index {
+		index = expired
+	}
+	return index, nil
+}
+
+// stateBeforeCompensation retorna o último estado de etapa registrado antes
+// do início da compensação
+func (o *Orchestrator) stateBeforeCompensation(sagaID string) (SagaState, error) {
+	var state SagaState
+	err := o.db.QueryRow(
+		`SELECT state FROM saga_events
+		 WHERE saga_id = $1 AND state NOT IN ($2, $3)
+		 ORDER BY id DESC LIMIT 1`,
+		sagaID, StateCompensating, StateTimedOut,
+	).Scan(&state)
+	return state, err
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"saga/deadletter"
+	"saga/ids"
+	"saga/tracing"
+)
+
+// startTestSaga inicia uma SAGA pela instância informada, publica o outbox e
+// retorna o comando VALIDATE_ORDER enviado
+func startTestSaga(t *testing.T, o *Orchestrator, broker *memBroker) *Command {
+	t.Helper()
+
+	err := o.withTx(func(o *Orchestrator) error {
+		return o.startNewSaga([]byte(`{"order_id": "PED-1", "customer_id": "CLI-1"}`), tracing.SpanContext{})
+	})
+	if err != nil {
+		t.Fatalf("erro ao iniciar SAGA: %v", err)
+	}
+	if err := o.flushOutbox(); err != nil {
+		t.Fatalf("erro ao publicar outbox: %v", err)
+	}
+
+	commands := broker.commands(t, "pedidos-commands")
+	if len(commands) != 1 {
+		t.Fatalf("esperava 1 comando de validação, obteve %d", len(commands))
+	}
+	return commands[0]
+}
+
+// validatedReply é o reply de sucesso do comando de validação
+func validatedReply(cmd *Command) *Reply {
+	return &Reply{
+		ReplyID:   ids.New(),
+		CommandID: cmd.CommandID,
+		SagaID:    cmd.SagaID,
+		Success:   true,
+		Message:   "Pedido validado com sucesso",
+		Data:      map[string]interface{}{"order_id": "PED-1", "amount_cents": 1000},
+		Timestamp: time.Now(),
+	}
+}
+
+// assertSingleCommands confere que cada tipo de comando da SAGA foi publicado
+// uma única vez, com o ID da SAGA como chave. Comandos de outras SAGAs
+// publicados no mesmo broker são ignorados.
+func assertSingleCommands(t *testing.T, broker *memBroker, sagaID string, expected ...string) {
+	t.Helper()
+
+	counts := make(map[string]int)
+	for _, m := range broker.messages() {
+		if !strings.HasSuffix(m.Topic, "-commands") {
+			continue
+		}
+		var cmd Command
+		if err := json.Unmarshal(m.Value, &cmd); err != nil {
+			t.Fatalf("mensagem inválida em %s: %v", m.Topic, err)
+		}
+		if cmd.SagaID != sagaID {
+			continue
+		}
+		if m.Key != sagaID {
+			t.Errorf("comando %s com chave %q, esperava a SAGA %s", cmd.CommandType, m.Key, sagaID)
+		}
+		counts[cmd.CommandType]++
+	}
+
+	for _, commandType := range expected {
+		if counts[commandType] != 1 {
+			t.Errorf("comando %s publicado %d vez(es)", commandType, counts[commandType])
+		}
+	}
+	if len(counts) != len(expected) {
+		t.Errorf("comandos publicados %v, esperava apenas %v", counts, expected)
+	}
+}
+
+// TestStaleReplicaGetsErrSagaChanged roda duas instâncias do orquestrador
+// sobre a mesma SAGA. A segunda lê a SAGA para reenviar a etapa, como em
+// POST /sagas/{id}/retry, enquanto a primeira processa o reply e a avança: a
+// operação da segunda falha com errSagaChanged e o reply reentregue a ela é
+// rejeitado, sem nenhum comando em dobro.
+func TestStaleReplicaGetsErrSagaChanged(t *testing.T) {
+	db := testDB(t)
+	broker := newMemBroker(3)
+	first := newTestOrchestrator(t, db, &fakeProducer{broker: broker})
+	second := newTestOrchestrator(t, db, &fakeProducer{broker: broker})
+
+	validate := startTestSaga(t, first, broker)
+	sagaID := validate.SagaID
+
+	state, version, err := second.sagaStateVersion(sagaID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := validatedReply(validate)
+	err = first.withTx(func(o *Orchestrator) error {
+		return o.processReply("pedidos-reply", reply)
+	})
+	if err != nil {
+		t.Fatalf("erro ao processar reply na primeira instância: %v", err)
+	}
+
+	err = second.withTx(func(o *Orchestrator) error {
+		if err := o.lockAdminSaga(sagaID, version); err != nil {
+			return err
+		}
+		return o.retryCurrentStep(sagaID, state)
+	})
+	if !errors.Is(err, errSagaChanged) {
+		t.Fatalf("reenvio com leitura obsoleta: esperava errSagaChanged, obteve %v", err)
+	}
+
+	// Reentrega do mesmo reply para a outra instância após um rebalanceamento
+	err = second.withTx(func(o *Orchestrator) error {
+		return o.processReply("pedidos-reply", reply)
+	})
+	if err != nil {
+		t.Fatalf("erro ao processar reply reentregue: %v", err)
+	}
+
+	for _, o := range []*Orchestrator{first, second} {
+		if err := o.flushOutbox(); err != nil {
+			t.Fatalf("erro ao publicar outbox: %v", err)
+		}
+	}
+
+	assertSingleCommands(t, broker, sagaID, "VALIDATE_ORDER", "RESERVE_STOCK", "PROCESS_PAYMENT")
+
+	current, _, err := first.sagaStateVersion(sagaID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != StateOrderValidated {
+		t.Errorf("estado da SAGA %s, esperava %s", current, StateOrderValidated)
+	}
+}
+
+// TestConcurrentWriteRollsBackStaleTransaction cobre a versão exigida por
+// saveEvent mesmo sem o lock da SAGA: a transação da segunda instância lê o
+// estado, a primeira avança a SAGA e confirma, e a gravação da segunda falha
+// com errSagaChanged, descartando o que ela havia enfileirado no outbox.
+func TestConcurrentWriteRollsBackStaleTransaction(t *testing.T) {
+	db := testDB(t)
+	broker := newMemBroker(3)
+	first := newTestOrchestrator(t, db, &fakeProducer{broker: broker})
+	second := newTestOrchestrator(t, db, &fakeProducer{broker: broker})
+
+	validate := startTestSaga(t, first, broker)
+	sagaID := validate.SagaID
+
+	read := make(chan struct{})
+	advanced := make(chan struct{})
+	result := make(chan error, 1)
+
+	go func() {
+		result <- second.withTx(func(o *Orchestrator) error {
+			state, err := o.getCurrentState(sagaID)
+			close(read)
+			if err != nil {
+				return err
+			}
+			<-advanced
+			return o.startCompensation(sagaID, state, CompensationCauseManual, "leitura obsoleta")
+		})
+	}()
+
+	<-read
+	err := first.withTx(func(o *Orchestrator) error {
+		return o.processReply("pedidos-reply", validatedReply(validate))
+	})
+	close(advanced)
+	if err != nil {
+		t.Fatalf("erro ao processar reply na primeira instância: %v", err)
+	}
+
+	if err := <-result; !errors.Is(err, errSagaChanged) {
+		t.Fatalf("gravação com leitura obsoleta: esperava errSagaChanged, obteve %v", err)
+	}
+
+	for _, o := range []*Orchestrator{first, second} {
+		if err := o.flushOutbox(); err != nil {
+			t.Fatalf("erro ao publicar outbox: %v", err)
+		}
+	}
+
+	assertSingleCommands(t, broker, sagaID, "VALIDATE_ORDER", "RESERVE_STOCK", "PROCESS_PAYMENT")
+
+	var compensating int
+	err = db.QueryRow(
+		"SELECT COUNT(*) FROM saga_events WHERE saga_id = $1 AND state = $2", sagaID, StateCompensating,
+	).Scan(&compensating)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compensating != 0 {
+		t.Errorf("evento COMPENSATING da transação obsoleta foi gravado")
+	}
+}
+
+// memGroup é um consumer group sobre o memBroker. As partições dos tópicos
+// são distribuídas entre os membros e cada entrada ou saída de membro
+// rebalanceia o grupo como no Kafka: a geração atual é encerrada, o
+// rebalanceamento espera as sessões terminarem as mensagens em andamento e a
+// nova geração retoma cada partição do último offset confirmado.
+type memGroup struct {
+	broker *memBroker
+	topics []string
+
+	rebalancing sync.Mutex // serializa os rebalanceamentos
+	mu          sync.Mutex
+	cond        *sync.Cond
+	members     []*memMember
+	generation  *memGeneration // nil durante o rebalanceamento
+	generations int32
+	committed   map[topicPartition]int64
+	marks       []markedMessage
+}
+
+// memGeneration é uma geração do grupo, com as partições de cada membro
+type memGeneration struct {
+	id       int32
+	ctx      context.Context
+	cancel   context.CancelFunc
+	claims   map[*memMember][]topicPartition
+	sessions sync.WaitGroup
+}
+
+// markedMessage registra uma mensagem confirmada com MarkMessage
+type markedMessage struct {
+	Member     string
+	Generation int32
+	Topic      string
+	Partition  int32
+	Offset     int64
+	Key        string
+}
+
+func newMemGroup(broker *memBroker, topics []string) *memGroup {
+	g := &memGroup{
+		broker:    broker,
+		topics:    topics,
+		committed: make(map[topicPartition]int64),
+	}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// join adiciona um membro ao grupo e rebalanceia
+func (g *memGroup) join(name string) *memMember {
+	m := &memMember{group: g, name: name}
+
+	g.mu.Lock()
+	g.members = append(g.members, m)
+	g.mu.Unlock()
+
+	g.rebalance()
+	return m
+}
+
+// leave remove o membro do grupo e rebalanceia
+func (g *memGroup) leave(m *memMember) {
+	g.mu.Lock()
+	for i, member := range g.members {
+		if member == m {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.mu.Unlock()
+
+	g.rebalance()
+}
+
+// rebalance encerra a geração atual, espera as suas sessões e distribui as
+// partições entre os membros em uma nova geração
+func (g *memGroup) rebalance() {
+	g.rebalancing.Lock()
+	defer g.rebalancing.Unlock()
+
+	g.mu.Lock()
+	previous := g.generation
+	g.generation = nil
+	g.mu.Unlock()
+
+	if previous != nil {
+		previous.cancel()
+		previous.sessions.Wait()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.generations++
+	gen := &memGeneration{id: g.generations, claims: make(map[*memMember][]topicPartition)}
+	gen.ctx, gen.cancel = context.WithCancel(context.Background())
+
+	if len(g.members) > 0 {
+		i := 0
+		for _, topic := range g.topics {
+			for p := int32(0); p < g.broker.partitions; p++ {
+				m := g.members[i%len(g.members)]
+				gen.claims[m] = append(gen.claims[m], topicPartition{topic, p})
+				i++
+			}
+		}
+	}
+
+	g.generation = gen
+	g.cond.Broadcast()
+}
+
+// mark confirma a mensagem, avançando o offset da partição
+func (g *memGroup) mark(s *memSession, msg *sarama.ConsumerMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tp := topicPartition{msg.Topic, msg.Partition}
+	if msg.Offset+1 > g.committed[tp] {
+		g.committed[tp] = msg.Offset + 1
+	}
+	g.marks = append(g.marks, markedMessage{
+		Member:     s.member.name,
+		Generation: s.generation,
+		Topic:      msg.Topic,
+		Partition:  msg.Partition,
+		Offset:     msg.Offset,
+		Key:        string(msg.Key),
+	})
+}
+
+// marked retorna uma cópia das mensagens confirmadas, na ordem de confirmação
+func (g *memGroup) marked() []markedMessage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]markedMessage(nil), g.marks...)
+}
+
+// feed entrega as mensagens da partição a partir do offset confirmado até o
+// fim da sessão
+func (g *memGroup) feed(ctx context.Context, claim *memClaim) {
+	defer close(claim.messages)
+
+	g.mu.Lock()
+	offset := g.committed[claim.tp]
+	g.mu.Unlock()
+
+	for {
+		messages, published := g.broker.read(claim.tp, offset)
+		for _, m := range messages {
+			msg := &sarama.ConsumerMessage{
+				Topic:     m.Topic,
+				Partition: m.Partition,
+				Offset:    m.Offset,
+				Key:       []byte(m.Key),
+				Value:     m.Value,
+			}
+			select {
+			case claim.messages <- msg:
+				offset = m.Offset + 1
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-published:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// memMember é um membro do memGroup e substitui o sarama.ConsumerGroup do
+// orquestrador
+type memMember struct {
+	sarama.ConsumerGroup
+	group      *memGroup
+	name       string
+	generation int32
+}
+
+// Consume participa de uma geração do grupo: espera o próximo
+// rebalanceamento e consome as partições atribuídas ao membro até a geração
+// ou o contexto terminar
+func (m *memMember) Consume(ctx context.Context, _ []string, handler sarama.ConsumerGroupHandler) error {
+	g := m.group
+
+	g.mu.Lock()
+	for ctx.Err() == nil && (g.generation == nil || g.generation.id == m.generation) {
+		g.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		g.mu.Unlock()
+		return err
+	}
+	gen := g.generation
+	m.generation = gen.id
+	gen.sessions.Add(1)
+	g.mu.Unlock()
+	defer gen.sessions.Done()
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-gen.ctx.Done():
+			cancel()
+		case <-sessionCtx.Done():
+		}
+	}()
+
+	session := &memSession{member: m, generation: gen.id, ctx: sessionCtx}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, tp := range gen.claims[m] {
+		claim := &memClaim{tp: tp, messages: make(chan *sarama.ConsumerMessage)}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			g.feed(sessionCtx, claim)
+		}()
+		go func() {
+			defer wg.Done()
+			// Como no sarama, o fim de um ConsumeClaim encerra a sessão
+			defer cancel()
+			handler.ConsumeClaim(session, claim)
+		}()
+	}
+	wg.Wait()
+
+	return handler.Cleanup(session)
+}
+
+// memSession é a sessão de um membro em uma geração
+type memSession struct {
+	sarama.ConsumerGroupSession
+	member     *memMember
+	generation int32
+	ctx        context.Context
+}
+
+func (s *memSession) Context() context.Context { return s.ctx }
+
+func (s *memSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.member.group.mark(s, msg)
+}
+
+// memClaim é uma partição atribuída a um membro
+type memClaim struct {
+	sarama.ConsumerGroupClaim
+	tp       topicPartition
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *memClaim) Topic() string                            { return c.tp.topic }
+func (c *memClaim) Partition() int32                         { return c.tp.partition }
+func (c *memClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// testReplica é uma instância do orquestrador com consume loop e relay do
+// outbox rodando sobre o memGroup
+type testReplica struct {
+	member  *memMember
+	cancel  context.CancelFunc
+	done    sync.WaitGroup
+	stopped sync.Once
+}
+
+func startReplica(t *testing.T, db *sql.DB, broker *memBroker, group *memGroup, name string) *testReplica {
+	t.Helper()
+
+	o := newTestOrchestrator(t, db, &fakeProducer{broker: broker})
+	o.deadLetters = deadletter.NewQueue(o.producer, consumerGroup)
+
+	r := &testReplica{member: group.join(name)}
+	o.consumer = r.member
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done.Add(2)
+	go func() {
+		defer r.done.Done()
+		o.consumeMessages(ctx)
+	}()
+	go func() {
+		defer r.done.Done()
+		o.relayOutbox(ctx)
+	}()
+
+	// Encerrada antes de o schema do teste ser removido
+	t.Cleanup(r.stop)
+	return r
+}
+
+// stop encerra a instância e a retira do grupo
+func (r *testReplica) stop() {
+	r.stopped.Do(func() {
+		r.cancel()
+		r.member.group.leave(r.member)
+		r.done.Wait()
+	})
+}
+
+// replyToCommands faz o papel dos participantes: responde com sucesso a
+// cada comando publicado, no tópico de reply do serviço e com a SAGA como
+// chave
+func replyToCommands(ctx context.Context, broker *memBroker) {
+	seen := 0
+	for {
+		messages, published := broker.since(seen)
+		seen += len(messages)
+
+		for _, m := range messages {
+			if !strings.HasSuffix(m.Topic, "-commands") {
+				continue
+			}
+			var cmd Command
+			if err := json.Unmarshal(m.Value, &cmd); err != nil {
+				continue
+			}
+			value, _ := json.Marshal(&Reply{
+				ReplyID:   ids.New(),
+				CommandID: cmd.CommandID,
+				SagaID:    cmd.SagaID,
+				Success:   true,
+				Message:   cmd.CommandType + " concluído",
+				Data:      cmd.Payload,
+				Timestamp: time.Now(),
+			})
+			broker.publish(&sarama.ProducerMessage{
+				Topic: strings.TrimSuffix(m.Topic, "-commands") + "-reply",
+				Key:   sarama.StringEncoder(cmd.SagaID),
+				Value: sarama.ByteEncoder(value),
+			})
+		}
+
+		select {
+		case <-published:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publishOrders publica os pedidos de first a last-1 no tópico de início,
+// com o order_id como chave
+func publishOrders(t *testing.T, broker *memBroker, topic string, first, last int) {
+	t.Helper()
+
+	for i := first; i < last; i++ {
+		orderID := fmt.Sprintf("PED-%d", i)
+		value := fmt.Sprintf(`{"order_id": %q, "customer_id": "CLI-1"}`, orderID)
+		_, _, err := broker.publish(&sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.StringEncoder(orderID),
+			Value: sarama.StringEncoder(value),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitCompleted espera até que ao menos n SAGAs tenham sido concluídas
+func waitCompleted(t *testing.T, db *sql.DB, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var completed int
+		err := db.QueryRow("SELECT COUNT(*) FROM saga_events WHERE state = $1", StateCompleted).Scan(&completed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if completed >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d de %d SAGAs concluídas no prazo", completed, n)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestReplicasConsumePartitionsInOrder roda o consume loop de duas
+// instâncias do orquestrador em um consumer group sobre o memBroker, com
+// SAGAs em andamento durante dois rebalanceamentos: a segunda instância
+// entra no grupo e depois a primeira sai. Cada partição precisa ser
+// confirmada em ordem, sem lacunas nem repetições, e cada SAGA precisa
+// passar pelos estados da definição na ordem, com cada comando publicado uma
+// única vez.
+func TestReplicasConsumePartitionsInOrder(t *testing.T) {
+	db := testDB(t)
+	broker := newMemBroker(3)
+
+	definition, err := parseDefinition(defaultDefinition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := newMemGroup(broker, definition.Topics())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go replyToCommands(ctx, broker)
+
+	const batch = 10
+
+	first := startReplica(t, db, broker, group, "primeira")
+	publishOrders(t, broker, definition.StartTopic, 0, batch)
+	waitCompleted(t, db, 1)
+
+	// Rebalanceamento com SAGAs do primeiro lote em andamento
+	startReplica(t, db, broker, group, "segunda")
+	publishOrders(t, broker, definition.StartTopic, batch, 2*batch)
+	waitCompleted(t, db, batch+1)
+
+	first.stop()
+	publishOrders(t, broker, definition.StartTopic, 2*batch, 3*batch)
+	waitCompleted(t, db, 3*batch)
+
+	// Offsets confirmados por partição: em ordem, sem lacunas nem repetições
+	next := make(map[topicPartition]int64)
+	members := make(map[string]bool)
+	for _, m := range group.marked() {
+		tp := topicPartition{m.Topic, m.Partition}
+		if m.Offset != next[tp] {
+			t.Errorf("%s/%d: offset %d confirmado por %s, esperava %d", m.Topic, m.Partition, m.Offset, m.Member, next[tp])
+		}
+		next[tp] = m.Offset + 1
+		members[m.Member] = true
+	}
+	if !members["primeira"] || !members["segunda"] {
+		t.Errorf("mensagens confirmadas pelas instâncias %v, esperava as duas", members)
+	}
+
+	// Estados de cada SAGA na ordem da definição; os estados parciais dos
+	// ramos de um grupo podem chegar em qualquer ordem antes do estado do grupo
+	expected := []SagaState{StatePending}
+	branches := make(map[SagaState]bool)
+	for _, step := range definition.Steps {
+		for _, branch := range step.Parallel {
+			branches[branch.State] = true
+		}
+		expected = append(expected, step.State)
+	}
+	expected = append(expected, StateCompleted)
+
+	rows, err := db.Query("SELECT saga_id, state FROM saga_events ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	states := make(map[string][]SagaState)
+	for rows.Next() {
+		var sagaID string
+		var state SagaState
+		if err := rows.Scan(&sagaID, &state); err != nil {
+			t.Fatal(err)
+		}
+		if !branches[state] {
+			states[sagaID] = append(states[sagaID], state)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(states) != 3*batch {
+		t.Errorf("%d SAGAs iniciadas, esperava %d", len(states), 3*batch)
+	}
+	for sagaID, got := range states {
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("SAGA %s passou pelos estados %v, esperava %v", sagaID, got, expected)
+		}
+		assertSingleCommands(t, broker, sagaID,
+			"VALIDATE_ORDER", "RESERVE_STOCK", "PROCESS_PAYMENT", "SCHEDULE_DELIVERY", "CAPTURE_PAYMENT")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"saga/deadletter"
+	"saga/ids"
+	"saga/protocol"
+)
+
+// returnPollInterval é o intervalo em que a compensação de uma entrega em
+// devolução é repetida quando o evento RETURNED não chega
+const returnPollInterval = 60 * time.Second
+
+// handleDeliveryEvent trata um evento do ciclo de vida das entregas. Apenas
+// devoluções mudam a SAGA, e toda devolução fica registrada em saga_returns:
+//   - numa SAGA concluída, o pagamento é estornado;
+//   - numa SAGA em compensação, o cancelamento da entrega que aguardava a
+//     devolução é reenviado;
+//   - numa SAGA ainda em andamento, o estorno é feito ao concluir.
+//
+// Eventos repetidos já encontram a devolução registrada e são ignorados.
+func (o *Orchestrator) handleDeliveryEvent(data []byte) error {
+	var event protocol.DeliveryEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return deadletter.Permanent(fmt.Errorf("evento de entrega inválido: %w", err))
+	}
+	if event.SagaID == "" {
+		return deadletter.Permanent(fmt.Errorf("evento de entrega %s sem saga_id", event.EventID))
+	}
+
+	log.Printf("Entrega %s da SAGA %s: %s", event.DeliveryID, event.SagaID, event.Status)
+
+	if event.Status != protocol.DeliveryStatusReturned {
+		return nil
+	}
+
+	if err := o.lockSaga(event.SagaID); err != nil {
+		return err
+	}
+
+	state, err := o.getCurrentState(event.SagaID)
+	if err != nil {
+		return err
+	}
+	if state != StateCompleted && (isTerminal(state) || isRefundState(state) || state == StateCompensationFailed) {
+		log.Printf("Devolução da entrega %s ignorada: SAGA %s no estado %s", event.DeliveryID, event.SagaID, state)
+		return nil
+	}
+
+	reason := "Entrega devolvida"
+	if event.Reason != "" {
+		reason += ": " + event.Reason
+	}
+
+	recorded, err := o.recordReturn(&event, reason)
+	if err != nil || !recorded {
+		return err
+	}
+
+	switch state {
+	case StateCompleted:
+		return o.startRefund(event.SagaID)
+	case StateCompensating:
+		log.Printf("SAGA %s: entrega %s devolvida, retomando a compensação", event.SagaID, event.DeliveryID)
+		return o.expediteCompensation(event.SagaID)
+	default:
+		log.Printf("Devolução da entrega %s registrada: SAGA %s no estado %s, estorno ao concluir",
+			event.DeliveryID, event.SagaID, state)
+		return nil
+	}
+}
+
+// recordReturn registra a devolução da entrega. Retorna false se ela já
+// estava registrada.
+func (o *Orchestrator) recordReturn(event *protocol.DeliveryEvent, reason string) (bool, error) {
+	result, err := o.db.Exec(
+		`INSERT INTO saga_returns (saga_id, delivery_id, tracking_number, reason)
+		 VALUES ($1, $2, NULLIF($3, ''), $4) ON CONFLICT (saga_id) DO NOTHING`,
+		event.SagaID, event.DeliveryID, event.TrackingNumber, reason,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// startRefund inicia o estorno da devolução registrada e ainda não aplicada.
+// É chamado ao receber a devolução de uma SAGA concluída e ao concluir uma
+// SAGA cuja devolução chegou antes; sem devolução pendente não faz nada.
+func (o *Orchestrator) startRefund(sagaID string) error {
+	if o.definition.RefundStep == nil {
+		return nil
+	}
+
+	var deliveryID, reason string
+	var trackingNumber sql.NullString
+	err := o.db.QueryRow(
+		`UPDATE saga_returns SET applied_at = CURRENT_TIMESTAMP
+		 WHERE saga_id = $1 AND applied_at IS NULL
+		 RETURNING delivery_id, tracking_number, reason`,
+		sagaID,
+	).Scan(&deliveryID, &trackingNumber, &reason)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := o.saveEvent(&SagaEvent{
+		SagaID: sagaID,
+		State:  StateRefunding,
+		Data: map[string]interface{}{
+			"delivery_id":     deliveryID,
+			"tracking_number": trackingNumber.String,
+			"reason":          reason,
+		},
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("SAGA %s: %s, iniciando estorno", sagaID, reason)
+	return o.sendRefund(sagaID, reason, deliveryID)
+}
+
+// awaitReturn agenda de novo a compensação recusada porque a entrega já foi
+// despachada e está voltando ao remetente. A espera não consome tentativas:
+// o evento RETURNED antecipa o reenvio e, sem ele, a compensação é repetida
+// a cada returnPollInterval.
+func (o *Orchestrator) awaitReturn(sagaID string, step SagaStep, attempts int, errorMsg string) error {
+	cmd, err := o.newCompensationCommand(step, sagaID)
+	if err != nil {
+		return err
+	}
+
+	// A devolução pode ter chegado antes da recusa
+	var returned bool
+	if err := o.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM saga_returns WHERE saga_id = $1)", sagaID,
+	).Scan(&returned); err != nil {
+		return err
+	}
+
+	delay := returnPollInterval
+	if returned {
+		delay = 0
+	}
+
+	log.Printf("Compensação %s da SAGA %s aguardando a devolução: %s", step.CompensationCommandType, sagaID, errorMsg)
+	return o.insertDeadline(step, CommandKindCompensation, cmd, DeadlineScheduled, attempts, delay)
+}
+
+// expediteCompensation antecipa as compensações agendadas da SAGA, enviadas
+// pelo watchdog na próxima verificação
+func (o *Orchestrator) expediteCompensation(sagaID string) error {
+	_, err := o.db.Exec(
+		`UPDATE saga_deadlines SET deadline = CURRENT_TIMESTAMP
+		 WHERE saga_id = $1 AND kind = $2 AND status = $3`,
+		sagaID, CommandKindCompensation, DeadlineScheduled,
+	)
+	return err
+}
+
+// sendRefund envia o comando da etapa de estorno
+func (o *Orchestrator) sendRefund(sagaID, reason, deliveryID string) error {
+	step := *o.definition.RefundStep
+
+	orderID, err := o.sagaOrderID(sagaID)
+	if err != nil {
+		return err
+	}
+
+	cmd := &Command{
+		CommandID:      ids.New(),
+		SagaID:         sagaID,
+		OrderID:        orderID,
+		CommandType:    step.CommandType,
+		PayloadVersion: step.PayloadVersion,
+		Payload:        map[string]interface{}{"reason": reason, "delivery_id": deliveryID},
+		Timestamp:      time.Now(),
+	}
+
+	if err := o.registerDeadline(step, CommandKindRefund, cmd); err != nil {
+		return err
+	}
+	return o.sendCommand(step.CommandTopic, cmd)
+}
+
+// resendRefund reenvia o estorno com os dados registrados em REFUNDING, na
+// recuperação após uma queda ou pela API de administração
+func (o *Orchestrator) resendRefund(sagaID string) error {
+	if o.definition.RefundStep == nil {
+		return fmt.Errorf("definição sem refund_step")
+	}
+
+	var data []byte
+	err := o.db.QueryRow(
+		`SELECT data FROM saga_events
+		 WHERE saga_id = $1 AND state = $2 ORDER BY id DESC LIMIT 1`,
+		sagaID, StateRefunding,
+	).Scan(&data)
+	if err != nil {
+		return err
+	}
+
+	var refund struct {
+		DeliveryID string `json:"delivery_id"`
+		Reason     string `json:"reason"`
+	}
+	if err := json.Unmarshal(data, &refund); err != nil {
+		return err
+	}
+
+	if err := o.cancelPendingCommands(sagaID); err != nil {
+		return err
+	}
+
+	log.Printf("Reenvio do estorno da SAGA %s", sagaID)
+	return o.sendRefund(sagaID, refund.Reason, refund.DeliveryID)
+}
+
+// handleRefundReply conclui o estorno. Uma recusa do participante deixa a
+// SAGA em REFUND_FAILED, à espera de intervenção manual.
+func (o *Orchestrator) handleRefundReply(cmd *outstandingCommand, reply *Reply) error {
+	if !reply.Success {
+		return o.failRefund(cmd.SagaID, cmd.Attempts, reply.Message)
+	}
+
+	log.Printf("Estorno da SAGA %s confirmado", cmd.SagaID)
+
+	orderID, err := o.sagaOrderID(cmd.SagaID)
+	if err != nil {
+		return err
+	}
+
+	if err := o.publishOrderProcessed(cmd.SagaID, orderID, StateRefunded, "", reply.Data); err != nil {
+		return err
+	}
+
+	return o.saveEvent(&SagaEvent{
+		SagaID:    cmd.SagaID,
+		State:     StateRefunded,
+		Data:      reply.Data,
+		Timestamp: time.Now(),
+	})
+}
+
+// handleExpiredRefund reenvia o estorno sem resposta e, esgotadas as
+// tentativas, marca a SAGA como REFUND_FAILED
+func (o *Orchestrator) handleExpiredRefund(d expiredDeadline, step SagaStep) error {
+	if d.Attempts <= step.MaxRetries {
+		return o.retryStep(d, step, step.MaxRetries)
+	}
+
+	expired, err := o.expireDeadline(d.CommandID)
+	if err != nil || !expired {
+		return err
+	}
+
+	if err := o.finishCommand(d.CommandID, nil); err != nil {
+		return err
+	}
+
+	return o.failRefund(d.SagaID, d.Attempts, "sem resposta do participante")
+}
+
+// failRefund registra que o estorno não pôde ser feito
+func (o *Orchestrator) failRefund(sagaID string, attempts int, errorMsg string) error {
+	reason := fmt.Sprintf("Estorno falhou após %d tentativa(s): %s", attempts, errorMsg)
+	log.Printf("SAGA %s requer intervenção manual. %s", sagaID, reason)
+
+	return o.saveEvent(&SagaEvent{
+		SagaID:    sagaID,
+		State:     StateRefundFailed,
+		Data:      map[string]interface{}{"step": o.definition.RefundStep.Name, "attempts": attempts},
+		Error:     reason,
+		Timestamp: time.Now(),
+	})
+}
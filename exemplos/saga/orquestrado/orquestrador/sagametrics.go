@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"saga/metrics"
+)
+
+// sagaMetrics são as métricas do orquestrador expostas em GET /metrics
+type sagaMetrics struct {
+	registry      *metrics.Registry
+	started       *metrics.CounterVec
+	completed     *metrics.CounterVec
+	failed        *metrics.CounterVec
+	compensations *metrics.CounterVec
+	replyLatency  *metrics.HistogramVec
+}
+
+func newSagaMetrics(o *Orchestrator) *sagaMetrics {
+	registry := metrics.NewRegistry()
+
+	m := &sagaMetrics{
+		registry: registry,
+		started: registry.NewCounterVec("saga_started_total",
+			"SAGAs iniciadas"),
+		completed: registry.NewCounterVec("saga_completed_total",
+			"SAGAs concluídas com sucesso"),
+		failed: registry.NewCounterVec("saga_failed_total",
+			"SAGAs encerradas sem concluir o pedido, por estado final", "state"),
+		compensations: registry.NewCounterVec("saga_compensations_total",
+			"Compensações iniciadas, por causa", "cause"),
+		replyLatency: registry.NewHistogramVec("saga_step_reply_duration_seconds",
+			"Tempo entre o registro do comando e o reply do participante", "step", "kind", "success"),
+	}
+
+	registry.NewGaugeFunc("saga_in_flight", "SAGAs em andamento por estado atual",
+		[]string{"state"}, o.inFlightByState)
+
+	return m
+}
+
+// inFlightByState conta as SAGAs não finalizadas pelo estado atual
+func (o *Orchestrator) inFlightByState() ([]metrics.Sample, error) {
+	rows, err := o.conn.Query(
+		`SELECT state, COUNT(*) FROM saga_instances
+		 WHERE state NOT IN ($1, $2, $3, $4)
+		 GROUP BY state ORDER BY state`,
+		StateCompleted, StateFailed, StateResolved, StateRefunded,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []metrics.Sample
+	for rows.Next() {
+		var state string
+		var count float64
+		if err := rows.Scan(&state, &count); err != nil {
+			return nil, err
+		}
+		samples = append(samples, metrics.Sample{Labels: []string{state}, Value: count})
+	}
+	return samples, rows.Err()
+}
+
+// observeSagaState conta o início e o fim das SAGAs depois do commit
+func (o *Orchestrator) observeSagaState(state SagaState) {
+	o.afterCommit(func() {
+		switch state {
+		case StatePending:
+			o.metrics.started.Inc()
+		case StateCompleted:
+			o.metrics.completed.Inc()
+		case StateFailed, StateCompensationFailed:
+			o.metrics.failed.Inc(string(state))
+		}
+	})
+}
+
+// observeCompensation conta uma compensação iniciada pela causa informada
+func (o *Orchestrator) observeCompensation(cause string) {
+	o.afterCommit(func() {
+		o.metrics.compensations.Inc(cause)
+	})
+}
+
+// observeReply registra a latência do reply de um comando
+func (o *Orchestrator) observeReply(step, kind string, success bool, sentAt time.Time) {
+	o.afterCommit(func() {
+		o.metrics.replyLatency.ObserveSince(sentAt, step, kind, strconv.FormatBool(success))
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"saga/tracing"
+)
+
+// Cada SAGA é um trace. O span raiz cobre a SAGA inteira e tem o span_id
+// derivado do saga_id, para que qualquer transação consiga referenciá-lo.
+// Cada comando registrado em saga_deadlines ganha um span filho da raiz,
+// cujo contexto é gravado em saga_deadlines.traceparent e enviado no header
+// do comando; os spans dos participantes ficam abaixo dele.
+
+// rootSpanID deriva o span raiz da SAGA a partir do saga_id
+func rootSpanID(sagaID string) tracing.SpanID {
+	h := fnv.New64a()
+	h.Write([]byte(sagaID))
+
+	var id tracing.SpanID
+	binary.BigEndian.PutUint64(id[:], h.Sum64()|1)
+	return id
+}
+
+// sagaSpanContext retorna o contexto do span raiz da SAGA. SAGAs iniciadas
+// antes do rastreamento não têm trace_id e retornam um contexto inválido.
+func (o *Orchestrator) sagaSpanContext(sagaID string) (tracing.SpanContext, error) {
+	var traceID sql.NullString
+	err := o.db.QueryRow(
+		"SELECT trace_id FROM saga_events WHERE saga_id = $1 ORDER BY id LIMIT 1", sagaID,
+	).Scan(&traceID)
+	if err != nil && err != sql.ErrNoRows {
+		return tracing.SpanContext{}, err
+	}
+
+	id, ok := tracing.ParseTraceID(traceID.String)
+	if !ok {
+		return tracing.SpanContext{}, nil
+	}
+	return tracing.SpanContext{TraceID: id, SpanID: rootSpanID(sagaID)}, nil
+}
+
+// commandTraceparent cria o span de um novo comando, filho da raiz da SAGA
+func (o *Orchestrator) commandTraceparent(sagaID string) (string, error) {
+	root, err := o.sagaSpanContext(sagaID)
+	if err != nil || !root.IsValid() {
+		return "", err
+	}
+	return tracing.SpanContext{TraceID: root.TraceID, SpanID: tracing.NewSpanID()}.Traceparent(), nil
+}
+
+// recordSpan entrega o span ao tracer depois do commit da transação
+func (o *Orchestrator) recordSpan(span *tracing.Span) {
+	o.afterCommit(func() {
+		o.tracer.Record(span)
+	})
+}
+
+// finishCommand encerra o span do comando quando o reply é correlacionado ou,
+// com reply nil, quando o prazo se esgota. A latência só é registrada quando
+// há reply.
+func (o *Orchestrator) finishCommand(commandID string, reply *Reply) error {
+	var sagaID, step, kind, commandType string
+	var traceparent sql.NullString
+	var attempts int
+	var createdAt time.Time
+	err := o.db.QueryRow(
+		`SELECT saga_id, step, kind, command->>'command_type', attempts, traceparent, created_at
+		 FROM saga_deadlines WHERE command_id = $1`,
+		commandID,
+	).Scan(&sagaID, &step, &kind, &commandType, &attempts, &traceparent, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if reply != nil {
+		o.observeReply(step, kind, reply.Success, createdAt)
+	}
+
+	sc, ok := tracing.ParseTraceparent(traceparent.String)
+	if !ok {
+		return nil
+	}
+
+	name := "saga.step " + step
+	switch kind {
+	case CommandKindCompensation:
+		name = "saga.compensate " + step
+	case CommandKindRefund:
+		name = "saga.refund " + step
+	}
+
+	span := &tracing.Span{
+		Name:    name,
+		Kind:    tracing.SpanKindClient,
+		Context: sc,
+		Parent:  rootSpanID(sagaID),
+		Start:   createdAt,
+		End:     time.Now(),
+	}
+	span.SetAttribute("saga.id", sagaID)
+	span.SetAttribute("saga.step", step)
+	span.SetAttribute("saga.command_kind", kind)
+	span.SetAttribute("saga.command_type", commandType)
+	span.SetAttribute("saga.command_id", commandID)
+	span.SetAttribute("saga.attempts", attempts)
+	switch {
+	case reply == nil:
+		span.SetError("timeout")
+	case !reply.Success:
+		span.SetError(reply.Message)
+	}
+
+	o.recordSpan(span)
+	return nil
+}
+
+// finishSagaSpan exporta o span raiz quando a SAGA chega a um estado final
+func (o *Orchestrator) finishSagaSpan(event *SagaEvent) error {
+	root, err := o.sagaSpanContext(event.SagaID)
+	if err != nil || !root.IsValid() {
+		return err
+	}
+
+	var orderID string
+	var startedAt time.Time
+	err = o.db.QueryRow(
+		"SELECT order_id, created_at FROM saga_events WHERE saga_id = $1 ORDER BY id LIMIT 1",
+		event.SagaID,
+	).Scan(&orderID, &startedAt)
+	if err != nil {
+		return err
+	}
+
+	span := &tracing.Span{
+		Name:    fmt.Sprintf("saga %s", o.definition.Name),
+		Kind:    tracing.SpanKindServer,
+		Context: root,
+		Start:   startedAt,
+		End:     time.Now(),
+	}
+	span.SetAttribute("saga.id", event.SagaID)
+	span.SetAttribute("saga.order_id", orderID)
+	span.SetAttribute("saga.state", string(event.State))
+	if event.State != StateCompleted {
+		message := event.Error
+		if message == "" {
+			message = string(event.State)
+		}
+		span.SetError(message)
+	}
+
+	o.recordSpan(span)
+	return nil
+}
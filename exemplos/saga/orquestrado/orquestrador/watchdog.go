@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Status de um prazo registrado para um comando
+const (
+	DeadlinePending = "PENDING"
+	DeadlineReplied = "REPLIED"
+	DeadlineExpired = "EXPIRED"
+	// DeadlineScheduled indica um comando aguardando o backoff para ser enviado
+	DeadlineScheduled = "SCHEDULED"
+)
+
+// defaultStepTimeout é usado quando a etapa não declara timeout_seconds
+const defaultStepTimeout = 30 * time.Second
+
+// registerDeadline registra o comando emitido e o seu prazo de resposta
+func (o *Orchestrator) registerDeadline(step SagaStep, kind string, cmd *Command) error {
+	return o.insertDeadline(step, kind, cmd, DeadlinePending, 1, step.Timeout())
+}
+
+// insertDeadline registra um comando com status, tentativa e prazo explícitos
+func (o *Orchestrator) insertDeadline(step SagaStep, kind string, cmd *Command, status string, attempts int, delay time.Duration) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	traceparent, err := o.commandTraceparent(cmd.SagaID)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.db.Exec(
+		`INSERT INTO saga_deadlines (command_id, saga_id, order_id, step, kind, topic, command, status, attempts, deadline, traceparent)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, CURRENT_TIMESTAMP + ($10 * INTERVAL '1 second'), NULLIF($11, ''))`,
+		cmd.CommandID, cmd.SagaID, cmd.OrderID, step.Name, kind, step.CommandTopic, data,
+		status, attempts, delay.Seconds(), traceparent,
+	)
+	return err
+}
+
+// resolveDeadline marca o prazo do comando como respondido, guardando o
+// resultado do reply. Retorna false se o comando já não estava pendente.
+func (o *Orchestrator) resolveDeadline(commandID string, success bool, message string) (bool, error) {
+	result, err := o.db.Exec(
+		`UPDATE saga_deadlines SET status = $1, success = $2, result_message = $3
+		 WHERE command_id = $4 AND status = $5`,
+		DeadlineReplied, success, message, commandID, DeadlinePending,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// expiredDeadline representa um comando cujo prazo de resposta passou
+type expiredDeadline struct {
+	CommandID string
+	SagaID    string
+	OrderID   string
+	Step      string
+	Kind      string
+	Status    string
+	Topic     string
+	Command   []byte
+	Attempts  int
+}
+
+// watchDeadlines verifica periodicamente os comandos sem resposta dentro do prazo
+func (o *Orchestrator) watchDeadlines(ctx context.Context) {
+	interval, err := time.ParseDuration(getEnv("WATCHDOG_INTERVAL", "5s"))
+	if err != nil {
+		log.Printf("WATCHDOG_INTERVAL inválido, usando 5s: %v", err)
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Watchdog de prazos iniciado (intervalo: %s)", interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := o.checkDeadlines(); err != nil {
+				log.Printf("Erro ao verificar prazos: %v", err)
+			}
+		}
+	}
+}
+
+func (o *Orchestrator) checkDeadlines() error {
+	rows, err := o.db.Query(
+		`SELECT command_id, saga_id, COALESCE(order_id, ''), step, kind, status, topic, command, attempts
+		 FROM saga_deadlines
+		 WHERE status IN ($1, $2) AND deadline < CURRENT_TIMESTAMP
+		 ORDER BY deadline`,
+		DeadlinePending, DeadlineScheduled,
+	)
+	if err != nil {
+		return err
+	}
+
+	var expired []expiredDeadline
+	for rows.Next() {
+		var d expiredDeadline
+		if err := rows.Scan(&d.CommandID, &d.SagaID, &d.OrderID, &d.Step, &d.Kind, &d.Status, &d.Topic, &d.Command, &d.Attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range expired {
+		err := o.withTx(func(o *Orchestrator) error {
+			return o.handleExpired(d)
+		})
+		if err != nil {
+			log.Printf("Erro ao tratar prazo expirado do comando %s: %v", d.CommandID, err)
+		}
+	}
+	return nil
+}
+
+// handleExpired trata um prazo vencido de acordo com o tipo do comando
+func (o *Orchestrator) handleExpired(d expiredDeadline) error {
+	if err := o.lockSaga(d.SagaID); err != nil {
+		return err
+	}
+
+	step, ok := o.definition.StepByName(d.Step)
+	if !ok {
+		return fmt.Errorf("etapa desconhecida: %s", d.Step)
+	}
+
+	if d.Status == DeadlineScheduled {
+		return o.dispatchScheduled(d, step)
+	}
+
+	if d.Kind == CommandKindCompensation {
+		return o.handleExpiredCompensation(d, step)
+	}
+
+	if d.Kind == CommandKindRefund {
+		return o.handleExpiredRefund(d, step)
+	}
+
+	return o.handleExpiredStep(d, step)
+}
+
+// handleExpiredStep reenvia o comando enquanto houver tentativas disponíveis
+// e, esgotadas as tentativas, registra TIMED_OUT e inicia a compensação a
+// partir da própria etapa. Em um ramo paralelo a decisão fica para o fan-in
+// do grupo.
+func (o *Orchestrator) handleExpiredStep(d expiredDeadline, step SagaStep) error {
+	if d.Attempts <= step.MaxRetries {
+		return o.retryStep(d, step, step.MaxRetries)
+	}
+
+	expired, err := o.expireDeadline(d.CommandID)
+	if err != nil || !expired {
+		return err
+	}
+
+	if err := o.finishCommand(d.CommandID, nil); err != nil {
+		return err
+	}
+
+	if index := o.definition.StepIndex(step.Name); o.definition.Steps[index].IsGroup() {
+		log.Printf("SAGA %s: ramo %s sem resposta após %d tentativa(s)", d.SagaID, step.Name, d.Attempts)
+		return o.joinGroup(d.SagaID, d.OrderID, index)
+	}
+
+	if _, err := o.getCurrentState(d.SagaID); err != nil {
+		return err
+	}
+
+	errorMsg := fmt.Sprintf("Timeout aguardando resposta da etapa %s após %d tentativa(s)", step.Name, d.Attempts)
+	log.Printf("SAGA %s: %s", d.SagaID, errorMsg)
+
+	if err := o.saveEvent(&SagaEvent{
+		SagaID:    d.SagaID,
+		OrderID:   d.OrderID,
+		State:     StateTimedOut,
+		Data:      map[string]interface{}{"command_id": d.CommandID, "step": step.Name, "attempts": d.Attempts},
+		Error:     errorMsg,
+		Timestamp: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	// A etapa expirada também é compensada
+	return o.startCompensationFrom(d.SagaID, o.definition.StepIndex(step.Name), CompensationCauseTimeout, errorMsg)
+}
+
+// handleExpiredCompensation reenvia a compensação sem resposta e, esgotadas
+// as tentativas, marca a SAGA como COMPENSATION_FAILED
+func (o *Orchestrator) handleExpiredCompensation(d expiredDeadline, step SagaStep) error {
+	if d.Attempts <= o.definition.CompensationMaxRetries {
+		return o.retryStep(d, step, o.definition.CompensationMaxRetries)
+	}
+
+	expired, err := o.expireDeadline(d.CommandID)
+	if err != nil || !expired {
+		return err
+	}
+
+	if err := o.finishCommand(d.CommandID, nil); err != nil {
+		return err
+	}
+
+	return o.failCompensation(d.SagaID, step, d.Attempts, "sem resposta do participante")
+}
+
+// expireDeadline marca o comando como expirado apenas se o reply não chegou
+// nesse meio tempo
+func (o *Orchestrator) expireDeadline(commandID string) (bool, error) {
+	result, err := o.db.Exec(
+		"UPDATE saga_deadlines SET status = $1 WHERE command_id = $2 AND status = $3",
+		DeadlineExpired, commandID, DeadlinePending,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// dispatchScheduled envia um comando cujo backoff terminou
+func (o *Orchestrator) dispatchScheduled(d expiredDeadline, step SagaStep) error {
+	result, err := o.db.Exec(
+		`UPDATE saga_deadlines
+		 SET status = $1, deadline = CURRENT_TIMESTAMP + ($2 * INTERVAL '1 second')
+		 WHERE command_id = $3 AND status = $4`,
+		DeadlinePending, step.Timeout().Seconds(), d.CommandID, DeadlineScheduled,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil
+	}
+
+	var cmd Command
+	if err := json.Unmarshal(d.Command, &cmd); err != nil {
+		return err
+	}
+
+	return o.sendCommand(d.Topic, &cmd)
+}
+
+// retryStep reenvia o mesmo comando (mesmo command_id) e renova o prazo
+func (o *Orchestrator) retryStep(d expiredDeadline, step SagaStep, maxRetries int) error {
+	result, err := o.db.Exec(
+		`UPDATE saga_deadlines
+		 SET attempts = attempts + 1, deadline = CURRENT_TIMESTAMP + ($1 * INTERVAL '1 second')
+		 WHERE command_id = $2 AND status = $3 AND attempts = $4`,
+		step.Timeout().Seconds(), d.CommandID, DeadlinePending, d.Attempts,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil
+	}
+
+	var cmd Command
+	if err := json.Unmarshal(d.Command, &cmd); err != nil {
+		return err
+	}
+
+	log.Printf("Prazo do comando %s da etapa %s expirado (SAGA %s). Reenviando (tentativa %d/%d)",
+		d.Kind, step.Name, d.SagaID, d.Attempts+1, maxRetries+1)
+
+	return o.sendCommand(d.Topic, &cmd)
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+// TestExpiredStepIsCompensated esgota as tentativas do comando de validação e
+// confere que a própria etapa expirada é compensada: sem reply não se sabe se
+// o participante executou o comando, então CANCEL_ORDER precisa ser enviado.
+func TestExpiredStepIsCompensated(t *testing.T) {
+	db := testDB(t)
+	broker := newMemBroker(3)
+	o := newTestOrchestrator(t, db, &fakeProducer{broker: broker})
+
+	validate := startTestSaga(t, o, broker)
+	step, _ := o.definition.StepByName("validar-pedido")
+
+	err := o.withTx(func(o *Orchestrator) error {
+		return o.handleExpired(expiredDeadline{
+			CommandID: validate.CommandID,
+			SagaID:    validate.SagaID,
+			OrderID:   validate.OrderID,
+			Step:      step.Name,
+			Kind:      CommandKindStep,
+			Status:    DeadlinePending,
+			Attempts:  step.MaxRetries + 1,
+		})
+	})
+	if err != nil {
+		t.Fatalf("erro ao tratar prazo expirado: %v", err)
+	}
+	if err := o.flushOutbox(); err != nil {
+		t.Fatalf("erro ao publicar outbox: %v", err)
+	}
+
+	var cancelled int
+	for _, cmd := range broker.commands(t, "pedidos-commands") {
+		if cmd.CommandType == step.CompensationCommandType {
+			cancelled++
+		}
+	}
+	if cancelled != 1 {
+		t.Errorf("compensação %s da etapa expirada enviada %d vez(es)", step.CompensationCommandType, cancelled)
+	}
+
+	state, _, err := o.sagaStateVersion(validate.SagaID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != StateCompensating {
+		t.Errorf("estado da SAGA %s, esperava %s", state, StateCompensating)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"saga/ids"
+	"saga/participant"
+)
+
+// PaymentGateway é a fronteira com o adquirente/gateway de pagamento. O
+// serviço só conhece esta interface; o adaptador é escolhido na inicialização.
+type PaymentGateway interface {
+	// Authorize retém o valor no cartão e retorna o id da autorização
+	Authorize(ctx context.Context, req AuthorizeRequest) (string, error)
+	// Capture cobra o valor autorizado e retorna o id da captura
+	Capture(ctx context.Context, authorizationID string, amount float64) (string, error)
+	// Void cancela uma autorização ainda não capturada
+	Void(ctx context.Context, authorizationID string) error
+	// Refund estorna uma captura e retorna o id do estorno
+	Refund(ctx context.Context, captureID string, amount float64) (string, error)
+}
+
+// AuthorizeRequest contém os dados enviados na autorização
+type AuthorizeRequest struct {
+	CardNumber string  `json:"card_number"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency"`
+	Reference  string  `json:"reference"`
+}
+
+// DeclinedError indica que o gateway recusou a operação. É uma resposta
+// definitiva: repetir o comando não muda o resultado.
+type DeclinedError struct {
+	Reason string
+}
+
+func (e *DeclinedError) Error() string {
+	return fmt.Sprintf("Pagamento recusado pelo gateway: %s", e.Reason)
+}
+
+// errGatewayUnavailable indica timeout ou erro do gateway. O resultado da
+// operação é desconhecido, então o comando fica sem reply e o watchdog do
+// orquestrador o reenvia.
+var errGatewayUnavailable = errors.New("gateway de pagamento indisponível")
+
+// newGateway escolhe o adaptador: HTTP quando PAYMENT_GATEWAY_URL é informado
+// ou o gateway simulado em memória, que aprova todas as operações
+func newGateway() (PaymentGateway, error) {
+	url := participant.Env("PAYMENT_GATEWAY_URL", "")
+	if url == "" {
+		log.Println("PAYMENT_GATEWAY_URL não informado, usando gateway simulado")
+		return &simulatedGateway{}, nil
+	}
+
+	timeout, err := time.ParseDuration(participant.Env("PAYMENT_GATEWAY_TIMEOUT", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("PAYMENT_GATEWAY_TIMEOUT inválido: %w", err)
+	}
+
+	log.Printf("Gateway de pagamento HTTP: %s (timeout: %s)", url, timeout)
+	return newHTTPGateway(url, timeout), nil
+}
+
+// simulatedGateway aprova tudo sem depender de um processo externo. Recusas
+// são simuladas pela injeção de falhas (FAULTS_FILE).
+type simulatedGateway struct{}
+
+func (g *simulatedGateway) Authorize(_ context.Context, _ AuthorizeRequest) (string, error) {
+	return ids.NewWithPrefix("AUTH"), nil
+}
+
+func (g *simulatedGateway) Capture(_ context.Context, _ string, _ float64) (string, error) {
+	return ids.NewWithPrefix("CAP"), nil
+}
+
+func (g *simulatedGateway) Void(_ context.Context, _ string) error {
+	return nil
+}
+
+func (g *simulatedGateway) Refund(_ context.Context, _ string, _ float64) (string, error) {
+	return ids.NewWithPrefix("REF"), nil
+}
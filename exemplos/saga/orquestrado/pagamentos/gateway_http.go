@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpGateway fala com um gateway de pagamento via HTTP/JSON (por exemplo o
+// gateway-fake deste projeto)
+type httpGateway struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newHTTPGateway(baseURL string, timeout time.Duration) *httpGateway {
+	return &httpGateway{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// gatewayResponse é o corpo das respostas do gateway
+type gatewayResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+func (g *httpGateway) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
+	resp, err := g.post(ctx, "/authorizations", req)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (g *httpGateway) Capture(ctx context.Context, authorizationID string, amount float64) (string, error) {
+	resp, err := g.post(ctx, "/authorizations/"+url.PathEscape(authorizationID)+"/capture",
+		map[string]float64{"amount": amount})
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (g *httpGateway) Void(ctx context.Context, authorizationID string) error {
+	_, err := g.post(ctx, "/authorizations/"+url.PathEscape(authorizationID)+"/void", nil)
+	return err
+}
+
+func (g *httpGateway) Refund(ctx context.Context, captureID string, amount float64) (string, error) {
+	resp, err := g.post(ctx, "/captures/"+url.PathEscape(captureID)+"/refund",
+		map[string]float64{"amount": amount})
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// post envia a requisição e traduz a resposta: 2xx é sucesso, 402 e demais
+// 4xx são recusas definitivas e timeouts ou 5xx deixam o resultado desconhecido
+func (g *httpGateway) post(ctx context.Context, path string, body interface{}) (*gatewayResponse, error) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+path, &payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		log.Printf("❌ Erro na chamada ao gateway %s: %v", path, err)
+		return nil, errGatewayUnavailable
+	}
+	defer resp.Body.Close()
+
+	var result gatewayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode < 500 {
+		return nil, fmt.Errorf("resposta inválida do gateway (%d): %w", resp.StatusCode, err)
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		log.Printf("❌ Gateway respondeu %d em %s: %s", resp.StatusCode, path, result.Error)
+		return nil, errGatewayUnavailable
+	case resp.StatusCode >= 400:
+		reason := result.Reason
+		if reason == "" {
+			reason = result.Error
+		}
+		return nil, &DeclinedError{Reason: reason}
+	}
+
+	return &result, nil
+}
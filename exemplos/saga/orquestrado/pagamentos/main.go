@@ -3,39 +3,30 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
-	"github.com/IBM/sarama"
-	_ "github.com/lib/pq"
+	"saga/ids"
+	"saga/participant"
+	"saga/protocol"
 )
 
-// Command representa um comando recebido do orquestrador
-type Command struct {
-	CommandID   string                 `json:"command_id"`
-	SagaID      string                 `json:"saga_id"`
-	OrderID     string                 `json:"order_id"`
-	CommandType string                 `json:"command_type"`
-	Payload     map[string]interface{} `json:"payload"`
-	Timestamp   time.Time              `json:"timestamp"`
-}
+// Command e Reply são as mensagens do protocolo da SAGA
+type (
+	Command = protocol.Command
+	Reply   = protocol.Reply
+)
 
-// Reply representa uma resposta para o orquestrador
-type Reply struct {
-	ReplyID   string                 `json:"reply_id"`
-	CommandID string                 `json:"command_id"`
-	SagaID    string                 `json:"saga_id"`
-	Success   bool                   `json:"success"`
-	Message   string                 `json:"message"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
-}
+// Status de um pagamento. A autorização apenas reserva o valor no cartão; a
+// cobrança acontece na captura, depois que a entrega foi agendada.
+const (
+	PaymentAuthorized = "AUTHORIZED"
+	PaymentCaptured   = "CAPTURED"
+	PaymentVoided     = "VOIDED"
+	PaymentRefunded   = "REFUNDED"
+)
 
 // Payment representa um pagamento
 type Payment struct {
@@ -45,91 +36,44 @@ type Payment struct {
 	Amount        float64   `json:"amount"`
 	Status        string    `json:"status"`
 	TransactionID string    `json:"transaction_id"`
+	CaptureID     string    `json:"capture_id,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
-// PaymentService gerencia pagamentos
+// PaymentService gerencia pagamentos. As escritas são feitas na transação
+// de cada comando, aberta pela biblioteca dos participantes.
 type PaymentService struct {
-	db       *sql.DB
-	producer sarama.SyncProducer
-	consumer sarama.ConsumerGroup
+	gateway PaymentGateway
 }
 
 func main() {
 	log.Println("Iniciando Serviço de Pagamentos...")
 
-	// Conectar ao banco de dados
-	db, err := connectDB()
+	// Banco, Kafka, idempotência, tracing e métricas ficam com a biblioteca
+	p, err := participant.New(participant.Config{Name: "pagamentos", EchoPayload: true})
 	if err != nil {
-		log.Fatal("Erro ao conectar no banco:", err)
+		log.Fatal("Erro ao iniciar participante:", err)
 	}
-	defer db.Close()
 
 	// Inicializar schema
-	if err := initSchema(db); err != nil {
+	if err := initSchema(p.DB); err != nil {
 		log.Fatal("Erro ao inicializar schema:", err)
 	}
 
-	// Configurar Kafka Producer
-	producer, err := setupProducer()
-	if err != nil {
-		log.Fatal("Erro ao configurar producer:", err)
-	}
-	defer producer.Close()
-
-	// Configurar Kafka Consumer
-	consumer, err := setupConsumer()
+	// Configurar gateway de pagamento
+	gateway, err := newGateway()
 	if err != nil {
-		log.Fatal("Erro ao configurar consumer:", err)
+		log.Fatal("Erro ao configurar gateway de pagamento:", err)
 	}
-	defer consumer.Close()
-
-	service := &PaymentService{
-		db:       db,
-		producer: producer,
-		consumer: consumer,
-	}
-
-	// Iniciar consumo de comandos
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go service.consumeCommands(ctx)
-
-	// Aguardar sinal de término
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-	<-sigterm
-
-	log.Println("Encerrando Serviço de Pagamentos...")
-}
 
-func connectDB() (*sql.DB, error) {
-	host := getEnv("DB_HOST", "localhost")
-	port := getEnv("DB_PORT", "5432")
-	user := getEnv("DB_USER", "postgres")
-	password := getEnv("DB_PASSWORD", "postgres")
-	dbname := getEnv("DB_NAME", "pagamentos")
+	service := &PaymentService{gateway: gateway}
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+	p.Handle(protocol.CommandProcessPayment, gatewayCall(service.handleProcessPayment))
+	p.Handle(protocol.CommandCapturePayment, gatewayCall(service.handleCapturePayment))
+	p.Compensate(protocol.CommandCancelPayment, gatewayCall(service.handleCancelPayment))
+	p.Handle(protocol.CommandRefundPayment, gatewayCall(service.handleRefundPayment))
 
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	// Tentar conectar com retry
-	for i := 0; i < 30; i++ {
-		if err = db.Ping(); err == nil {
-			log.Println("Conectado ao banco de dados")
-			return db, nil
-		}
-		log.Printf("Aguardando banco de dados... (%d/30)", i+1)
-		time.Sleep(2 * time.Second)
-	}
-
-	return nil, fmt.Errorf("timeout ao conectar no banco")
+	p.Run()
 }
 
 func initSchema(db *sql.DB) error {
@@ -145,6 +89,25 @@ func initSchema(db *sql.DB) error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_saga_id ON payments(saga_id);
+
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS capture_id VARCHAR(100);
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS captured_at TIMESTAMP;
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+	-- Estornos de pagamentos já capturados; um estorno (total) por pagamento
+	CREATE TABLE IF NOT EXISTS payment_refunds (
+		id VARCHAR(100) PRIMARY KEY,
+		payment_id VARCHAR(100) NOT NULL UNIQUE REFERENCES payments(id),
+		saga_id VARCHAR(100) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	ALTER TABLE payment_refunds ADD COLUMN IF NOT EXISTS reason TEXT;
+
+	-- IDs devolvidos pelo gateway identificam uma única operação
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_transaction_id ON payments(transaction_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_capture_id ON payments(capture_id);
 	`
 
 	_, err := db.Exec(schema)
@@ -156,163 +119,119 @@ func initSchema(db *sql.DB) error {
 	return nil
 }
 
-func setupProducer() (sarama.SyncProducer, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
+// gatewayCall traduz as respostas do gateway: uma recusa é definitiva e vira
+// reply de falha; com o gateway indisponível o resultado da operação é
+// desconhecido, então o comando fica sem reply e o orquestrador o reenvia
+func gatewayCall(handler participant.Handler) participant.Handler {
+	return func(ctx context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+		result, err := handler(ctx, tx, cmd)
+		var declined *DeclinedError
+		switch {
+		case errors.Is(err, errGatewayUnavailable):
+			return nil, participant.NoReply(err)
+		case errors.As(err, &declined):
+			return nil, participant.Reject(err)
+		}
+		return result, err
+	}
+}
 
-	config := sarama.NewConfig()
-	config.Producer.Return.Successes = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Retry.Max = 5
+// handleProcessPayment autoriza o pagamento: o valor fica retido até a captura
+func (s *PaymentService) handleProcessPayment(ctx context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	var payload protocol.ProcessPayment
+	if err := protocol.Decode(cmd, &payload); err != nil {
+		return nil, err
+	}
 
-	producer, err := sarama.NewSyncProducer(brokers, config)
+	payment, err := s.authorizePayment(ctx, tx, cmd, &payload)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Kafka Producer configurado")
-	return producer, nil
+	log.Printf("Pagamento autorizado: R$ %.2f (Transaction: %s)", payment.Amount, payment.TransactionID)
+	return &participant.Result{
+		Message: "Pagamento autorizado com sucesso",
+		Data: protocol.PaymentAuthorized{
+			PaymentID:     payment.ID,
+			TransactionID: payment.TransactionID,
+		},
+	}, nil
 }
 
-func setupConsumer() (sarama.ConsumerGroup, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
-
-	config := sarama.NewConfig()
-	config.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
-
-	consumer, err := sarama.NewConsumerGroup(brokers, "pagamentos-group", config)
+// handleCapturePayment captura o valor autorizado após o agendamento da entrega
+func (s *PaymentService) handleCapturePayment(ctx context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	payment, err := s.capturePayment(ctx, tx, cmd.SagaID)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Kafka Consumer configurado")
-	return consumer, nil
+	log.Printf("Pagamento capturado: R$ %.2f (SAGA: %s)", payment.Amount, cmd.SagaID)
+	return &participant.Result{
+		Message: "Pagamento capturado com sucesso",
+		Data: protocol.PaymentCaptured{
+			CaptureID:      payment.CaptureID,
+			CapturedAmount: payment.Amount,
+		},
+	}, nil
 }
 
-// consumeCommands consome comandos do orquestrador
-func (s *PaymentService) consumeCommands(ctx context.Context) {
-	topics := []string{"pagamentos-commands"}
-	handler := &ConsumerHandler{service: s}
-
-	for {
-		if err := s.consumer.Consume(ctx, topics, handler); err != nil {
-			log.Printf("Erro ao consumir mensagens: %v", err)
-		}
-
-		if ctx.Err() != nil {
-			return
-		}
+// handleCancelPayment compensa o pagamento: void antes da captura, estorno depois dela
+func (s *PaymentService) handleCancelPayment(ctx context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	action, err := s.cancelPayment(ctx, tx, cmd.SagaID)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// ConsumerHandler implementa sarama.ConsumerGroupHandler
-type ConsumerHandler struct {
-	service *PaymentService
-}
-
-func (h *ConsumerHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
-func (h *ConsumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
-
-func (h *ConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		var cmd Command
-		if err := json.Unmarshal(message.Value, &cmd); err != nil {
-			log.Printf("Erro ao deserializar comando: %v", err)
-			session.MarkMessage(message, "")
-			continue
-		}
 
-		log.Printf("Comando recebido: %s (SAGA: %s)", cmd.CommandType, cmd.SagaID)
-
-		// Processar comando
-		reply := h.service.processCommand(&cmd)
-
-		// Enviar resposta
-		if err := h.service.sendReply(reply); err != nil {
-			log.Printf("Erro ao enviar reply: %v", err)
-		}
-
-		session.MarkMessage(message, "")
-	}
-	return nil
+	log.Printf("Pagamento cancelado (SAGA: %s, ação: %s)", cmd.SagaID, action)
+	return &participant.Result{
+		Message: "Pagamento cancelado com sucesso",
+		Data:    protocol.PaymentCancelled{Compensation: action},
+	}, nil
 }
 
-// processCommand processa um comando e retorna uma resposta
-func (s *PaymentService) processCommand(cmd *Command) *Reply {
-	reply := &Reply{
-		ReplyID:   generateID(),
-		CommandID: cmd.CommandID,
-		SagaID:    cmd.SagaID,
-		Timestamp: time.Now(),
-		Data:      make(map[string]interface{}),
-	}
-	
-	// Copiar payload para Data se existir
-	if cmd.Payload != nil {
-		for k, v := range cmd.Payload {
-			reply.Data[k] = v
-		}
+// handleRefundPayment estorna o pagamento após a conclusão da SAGA (ex: entrega devolvida)
+func (s *PaymentService) handleRefundPayment(ctx context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	var payload protocol.RefundPayment
+	if err := protocol.Decode(cmd, &payload); err != nil {
+		return nil, err
 	}
 
-	switch cmd.CommandType {
-	case "PROCESS_PAYMENT":
-		// Processar pagamento (mockado com chance de falha)
-		payment := s.processPayment(cmd)
-		if payment != nil {
-			reply.Success = true
-			reply.Message = "Pagamento processado com sucesso"
-			reply.Data["payment_id"] = payment.ID
-			reply.Data["transaction_id"] = payment.TransactionID
-			log.Printf("Pagamento processado: R$ %.2f (Transaction: %s)",
-				payment.Amount, payment.TransactionID)
-		} else {
-			reply.Success = false
-			reply.Message = "Falha no processamento do pagamento"
-			log.Printf("Falha no processamento do pagamento")
-		}
-
-	case "CANCEL_PAYMENT":
-		// Cancelar pagamento (compensação)
-		if err := s.cancelPayment(cmd.SagaID); err != nil {
-			reply.Success = false
-			reply.Message = fmt.Sprintf("Erro ao cancelar pagamento: %v", err)
-			log.Printf("❌ Erro ao cancelar pagamento: %v", err)
-		} else {
-			reply.Success = true
-			reply.Message = "Pagamento cancelado com sucesso"
-			log.Printf("Pagamento cancelado (SAGA: %s)", cmd.SagaID)
-		}
-
-	default:
-		reply.Success = false
-		reply.Message = fmt.Sprintf("Comando desconhecido: %s", cmd.CommandType)
-		log.Printf("Comando desconhecido: %s", cmd.CommandType)
+	refundID, amount, err := s.refundPayment(ctx, tx, cmd.SagaID, payload.Reason)
+	if err != nil {
+		return nil, err
 	}
 
-	return reply
+	log.Printf("Pagamento estornado: R$ %.2f (SAGA: %s, motivo: %s)", amount, cmd.SagaID, payload.Reason)
+	return &participant.Result{
+		Message: "Pagamento estornado com sucesso",
+		Data:    protocol.PaymentRefunded{RefundID: refundID, RefundedAmount: amount},
+	}, nil
 }
 
-// processPayment processa um pagamento (mockado)
-func (s *PaymentService) processPayment(cmd *Command) *Payment {
-	// Simulação de processamento de pagamento
-	// 5% de chance de falha para demonstrar compensação
-	if rand.Intn(100) < 5 {
-		log.Println("Simulando falha no gateway de pagamento")
-		return nil
+// authorizePayment autoriza no gateway o valor do pedido
+func (s *PaymentService) authorizePayment(ctx context.Context, tx *sql.Tx, cmd *Command, payload *protocol.ProcessPayment) (*Payment, error) {
+	payment := &Payment{
+		ID:        ids.New(),
+		SagaID:    cmd.SagaID,
+		OrderID:   payload.OrderID,
+		Amount:    payload.Amount(),
+		Status:    PaymentAuthorized,
+		CreatedAt: time.Now(),
 	}
 
-	payment := &Payment{
-		ID:            generateID(),
-		SagaID:        cmd.SagaID,
-		OrderID:       getStringFromPayload(cmd.Payload, "order_id", ""),
-		Amount:        getFloatFromPayload(cmd.Payload, "total_amount", 0.0),
-		Status:        "APPROVED",
-		TransactionID: fmt.Sprintf("TXN-%d", time.Now().Unix()),
-		CreatedAt:     time.Now(),
+	authorizationID, err := s.gateway.Authorize(ctx, AuthorizeRequest{
+		CardNumber: payload.CardNumber,
+		Amount:     payment.Amount,
+		Currency:   payload.Currency,
+		Reference:  cmd.SagaID,
+	})
+	if err != nil {
+		return nil, err
 	}
+	payment.TransactionID = authorizationID
 
 	// Persistir no banco
-	_, err := s.db.Exec(
+	_, err = tx.Exec(
 		`INSERT INTO payments (id, saga_id, order_id, amount, status, transaction_id)
 		 VALUES ($1, $2, $3, $4, $5, $6)`,
 		payment.ID, payment.SagaID, payment.OrderID,
@@ -320,69 +239,177 @@ func (s *PaymentService) processPayment(cmd *Command) *Payment {
 	)
 
 	if err != nil {
+		// Sem o registro a autorização ficaria retida no gateway sem que
+		// nenhuma compensação a encontrasse: ela é cancelada antes da recusa.
+		// Com o gateway indisponível o comando fica sem reply e, no reenvio,
+		// o gateway devolve a mesma autorização pela referência.
 		log.Printf("❌ Erro ao salvar pagamento: %v", err)
-		return nil
+		if err := s.gateway.Void(ctx, authorizationID); errors.Is(err, errGatewayUnavailable) {
+			return nil, err
+		} else if err != nil {
+			log.Printf("❌ Erro ao cancelar autorização %s: %v", authorizationID, err)
+		}
+		return nil, participant.Reject(fmt.Errorf("Falha no processamento do pagamento"))
 	}
 
-	return payment
+	return payment, nil
 }
 
-// cancelPayment cancela um pagamento
-func (s *PaymentService) cancelPayment(sagaID string) error {
-	_, err := s.db.Exec(
-		"UPDATE payments SET status = 'CANCELLED' WHERE saga_id = $1",
+// capturePayment cobra no gateway o valor autorizado da SAGA. Capturar um
+// pagamento já capturado devolve a captura existente.
+func (s *PaymentService) capturePayment(ctx context.Context, tx *sql.Tx, sagaID string) (*Payment, error) {
+	var payment Payment
+	var captureID sql.NullString
+	err := tx.QueryRow(
+		`SELECT id, amount, status, transaction_id, capture_id FROM payments
+		 WHERE saga_id = $1 ORDER BY created_at DESC LIMIT 1 FOR UPDATE`,
 		sagaID,
-	)
-	return err
-}
+	).Scan(&payment.ID, &payment.Amount, &payment.Status, &payment.TransactionID, &captureID)
 
-// sendReply envia uma resposta para o orquestrador
-func (s *PaymentService) sendReply(reply *Reply) error {
-	data, err := json.Marshal(reply)
+	if err == sql.ErrNoRows {
+		return nil, participant.Reject(fmt.Errorf("nenhuma autorização para a SAGA %s", sagaID))
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msg := &sarama.ProducerMessage{
-		Topic: "pagamentos-reply",
-		Value: sarama.ByteEncoder(data),
+	if payment.Status == PaymentCaptured {
+		payment.CaptureID = captureID.String
+		return &payment, nil
+	}
+	if payment.Status != PaymentAuthorized {
+		return nil, participant.Reject(fmt.Errorf("pagamento %s no status %s não pode ser capturado", payment.ID, payment.Status))
 	}
 
-	_, _, err = s.producer.SendMessage(msg)
+	payment.CaptureID, err = s.gateway.Capture(ctx, payment.TransactionID, payment.Amount)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	payment.Status = PaymentCaptured
 
-	log.Printf("Reply enviado: Success=%t, Message=%s", reply.Success, reply.Message)
-	return nil
-}
+	if _, err := tx.Exec(
+		`UPDATE payments SET status = $1, capture_id = $2, captured_at = CURRENT_TIMESTAMP,
+		 updated_at = CURRENT_TIMESTAMP WHERE id = $3`,
+		payment.Status, payment.CaptureID, payment.ID,
+	); err != nil {
+		return nil, err
+	}
 
-// Funções auxiliares
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	return &payment, nil
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// cancelPayment compensa os pagamentos da SAGA: autorizações são canceladas
+// (void) e capturas são estornadas (refund) com registro em payment_refunds.
+// Retorna a ação aplicada: VOID, REFUND ou NONE.
+func (s *PaymentService) cancelPayment(ctx context.Context, tx *sql.Tx, sagaID string) (string, error) {
+	rows, err := tx.Query(
+		`SELECT id, amount, status, transaction_id, COALESCE(capture_id, '') FROM payments
+		 WHERE saga_id = $1 AND status IN ($2, $3) FOR UPDATE`,
+		sagaID, PaymentAuthorized, PaymentCaptured,
+	)
+	if err != nil {
+		return "", err
 	}
-	return defaultValue
-}
 
-func getStringFromPayload(payload map[string]interface{}, key, defaultValue string) string {
-	if val, ok := payload[key]; ok {
-		if strVal, ok := val.(string); ok {
-			return strVal
+	var payments []Payment
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.Amount, &p.Status, &p.TransactionID, &p.CaptureID); err != nil {
+			rows.Close()
+			return "", err
 		}
+		payments = append(payments, p)
 	}
-	return defaultValue
-}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	action := "NONE"
+	for _, p := range payments {
+		status := PaymentVoided
+		action = "VOID"
+
+		if p.Status == PaymentCaptured {
+			status = PaymentRefunded
+			action = "REFUND"
+
+			refundID, err := s.gateway.Refund(ctx, p.CaptureID, p.Amount)
+			if err != nil {
+				return "", err
+			}
+
+			if _, err := tx.Exec(
+				`INSERT INTO payment_refunds (id, payment_id, saga_id, amount)
+				 VALUES ($1, $2, $3, $4) ON CONFLICT (payment_id) DO NOTHING`,
+				refundID, p.ID, sagaID, p.Amount,
+			); err != nil {
+				return "", err
+			}
+		} else if err := s.gateway.Void(ctx, p.TransactionID); err != nil {
+			return "", err
+		}
 
-func getFloatFromPayload(payload map[string]interface{}, key string, defaultValue float64) float64 {
-	if val, ok := payload[key]; ok {
-		if floatVal, ok := val.(float64); ok {
-			return floatVal
+		if _, err := tx.Exec(
+			"UPDATE payments SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+			status, p.ID,
+		); err != nil {
+			return "", err
 		}
 	}
-	return defaultValue
+
+	return action, nil
+}
+
+// refundPayment estorna o pagamento capturado da SAGA. Estornar um pagamento
+// já estornado devolve o estorno existente; pagamentos não capturados não
+// podem ser estornados.
+func (s *PaymentService) refundPayment(ctx context.Context, tx *sql.Tx, sagaID, reason string) (string, float64, error) {
+	var payment Payment
+	var captureID sql.NullString
+	err := tx.QueryRow(
+		`SELECT id, amount, status, capture_id FROM payments
+		 WHERE saga_id = $1 ORDER BY created_at DESC LIMIT 1 FOR UPDATE`,
+		sagaID,
+	).Scan(&payment.ID, &payment.Amount, &payment.Status, &captureID)
+
+	if err == sql.ErrNoRows {
+		return "", 0, participant.Reject(fmt.Errorf("nenhum pagamento para a SAGA %s", sagaID))
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	if payment.Status == PaymentRefunded {
+		var refundID string
+		err := tx.QueryRow(
+			"SELECT id FROM payment_refunds WHERE payment_id = $1", payment.ID,
+		).Scan(&refundID)
+		return refundID, payment.Amount, err
+	}
+	if payment.Status != PaymentCaptured {
+		return "", 0, participant.Reject(fmt.Errorf("pagamento %s no status %s não pode ser estornado", payment.ID, payment.Status))
+	}
+
+	refundID, err := s.gateway.Refund(ctx, captureID.String, payment.Amount)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO payment_refunds (id, payment_id, saga_id, amount, reason)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		refundID, payment.ID, sagaID, payment.Amount, reason,
+	); err != nil {
+		return "", 0, err
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE payments SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		PaymentRefunded, payment.ID,
+	); err != nil {
+		return "", 0, err
+	}
+
+	return refundID, payment.Amount, nil
 }
@@ -4,132 +4,89 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
-	"github.com/IBM/sarama"
-	_ "github.com/lib/pq"
+	"saga/deadletter"
+	"saga/ids"
+	"saga/participant"
+	"saga/protocol"
 )
 
-// Command representa um comando recebido do orquestrador
-type Command struct {
-	CommandID   string                 `json:"command_id"`
-	SagaID      string                 `json:"saga_id"`
-	OrderID     string                 `json:"order_id"`
-	CommandType string                 `json:"command_type"`
-	Payload     map[string]interface{} `json:"payload"`
-	Timestamp   time.Time              `json:"timestamp"`
+// Command e Reply são as mensagens do protocolo da SAGA
+type (
+	Command = protocol.Command
+	Reply   = protocol.Reply
+)
+
+// Order representa um pedido
+type Order struct {
+	ID          string                `json:"id"`
+	SagaID      string                `json:"saga_id"`
+	CustomerID  string                `json:"customer_id"`
+	Items       []protocol.PricedItem `json:"items"`
+	TotalAmount float64               `json:"total_amount"`
+	Status      string                `json:"status"`
+	CreatedAt   time.Time             `json:"created_at"`
 }
 
-// Reply representa uma resposta para o orquestrador
-type Reply struct {
-	ReplyID   string                 `json:"reply_id"`
-	CommandID string                 `json:"command_id"`
-	SagaID    string                 `json:"saga_id"`
-	Success   bool                   `json:"success"`
-	Message   string                 `json:"message"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
+// AmountCents retorna o valor do pedido em centavos, somado a partir dos itens
+func (o *Order) AmountCents() int64 {
+	var total int64
+	for _, item := range o.Items {
+		total += item.Total()
+	}
+	return total
 }
 
-// Order representa um pedido
-type Order struct {
-	ID          string    `json:"id"`
-	SagaID      string    `json:"saga_id"`
-	CustomerID  string    `json:"customer_id"`
-	ProductID   string    `json:"product_id"`
-	Quantity    int       `json:"quantity"`
-	TotalAmount float64   `json:"total_amount"`
-	Status      string    `json:"status"`
-	CreatedAt   time.Time `json:"created_at"`
+// CatalogProduct é um produto do catálogo de preços
+type CatalogProduct struct {
+	ID         string
+	Name       string
+	PriceCents int64
 }
 
+// seedCatalog é o catálogo inicial de preços. O valor do pedido é sempre
+// calculado a partir dele, nunca informado pelo cliente.
+var seedCatalog = []CatalogProduct{
+	{ID: "PROD-001", Name: "Notebook", PriceCents: 349900},
+	{ID: "PROD-002", Name: "Monitor", PriceCents: 89990},
+	{ID: "PROD-003", Name: "Teclado", PriceCents: 9999},
+	{ID: "PROD-004", Name: "Mouse", PriceCents: 4990},
+	{ID: "PROD-005", Name: "Headset", PriceCents: 29999},
+}
+
+// Tópico dos eventos do ciclo de vida das entregas
+const deliveryEventsTopic = "entregas-events"
+
 // OrderService gerencia pedidos
 type OrderService struct {
-	db       *sql.DB
-	producer sarama.SyncProducer
-	consumer sarama.ConsumerGroup
+	db *sql.DB
 }
 
 func main() {
 	log.Println("Iniciando Serviço de Pedidos...")
 
-	// Conectar ao banco de dados
-	db, err := connectDB()
+	// Banco, Kafka, idempotência, tracing e métricas ficam com a biblioteca
+	p, err := participant.New(participant.Config{Name: "pedidos"})
 	if err != nil {
-		log.Fatal("Erro ao conectar no banco:", err)
+		log.Fatal("Erro ao iniciar participante:", err)
 	}
-	defer db.Close()
 
 	// Inicializar schema
-	if err := initSchema(db); err != nil {
+	if err := initSchema(p.DB); err != nil {
 		log.Fatal("Erro ao inicializar schema:", err)
 	}
 
-	// Configurar Kafka Producer
-	producer, err := setupProducer()
-	if err != nil {
-		log.Fatal("Erro ao configurar producer:", err)
-	}
-	defer producer.Close()
+	service := &OrderService{db: p.DB}
 
-	// Configurar Kafka Consumer
-	consumer, err := setupConsumer()
-	if err != nil {
-		log.Fatal("Erro ao configurar consumer:", err)
-	}
-	defer consumer.Close()
-
-	service := &OrderService{
-		db:       db,
-		producer: producer,
-		consumer: consumer,
-	}
-
-	// Iniciar consumo de comandos
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go service.consumeCommands(ctx)
-
-	// Aguardar sinal de término
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-	<-sigterm
+	p.Handle(protocol.CommandValidateOrder, service.handleValidateOrder)
+	p.Compensate(protocol.CommandCancelOrder, service.handleCancelOrder)
+	p.Subscribe(deliveryEventsTopic, service.handleDeliveryEvent)
 
-	log.Println("Encerrando Serviço de Pedidos...")
-}
-
-func connectDB() (*sql.DB, error) {
-	host := getEnv("DB_HOST", "localhost")
-	port := getEnv("DB_PORT", "5432")
-	user := getEnv("DB_USER", "postgres")
-	password := getEnv("DB_PASSWORD", "postgres")
-	dbname := getEnv("DB_NAME", "pedidos")
-
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	// Tentar conectar com retry
-	for i := 0; i < 30; i++ {
-		if err = db.Ping(); err == nil {
-			log.Println("Conectado ao banco de dados")
-			return db, nil
-		}
-		log.Printf("⏳ Aguardando banco de dados... (%d/30)", i+1)
-		time.Sleep(2 * time.Second)
-	}
-
-	return nil, fmt.Errorf("timeout ao conectar no banco")
+	p.Run()
 }
 
 func initSchema(db *sql.DB) error {
@@ -146,6 +103,29 @@ func initSchema(db *sql.DB) error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_saga_id ON orders(saga_id);
+
+	-- Pedidos com vários itens: produto e quantidade ficam em order_items
+	ALTER TABLE orders ALTER COLUMN product_id DROP NOT NULL;
+	ALTER TABLE orders ALTER COLUMN quantity DROP NOT NULL;
+
+	CREATE TABLE IF NOT EXISTS order_items (
+		order_id VARCHAR(100) NOT NULL REFERENCES orders(id),
+		product_id VARCHAR(100) NOT NULL,
+		quantity INTEGER NOT NULL CHECK (quantity > 0),
+		unit_price DECIMAL(10,2) NOT NULL,
+		PRIMARY KEY (order_id, product_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS catalog (
+		id VARCHAR(100) PRIMARY KEY,
+		name VARCHAR(200) NOT NULL,
+		price DECIMAL(10,2) NOT NULL CHECK (price > 0)
+	);
+
+	-- Status da entrega, atualizado pelos eventos do serviço de entregas
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_status VARCHAR(50);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS tracking_number VARCHAR(100);
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_updated_at TIMESTAMP;
 	`
 
 	_, err := db.Exec(schema)
@@ -153,238 +133,156 @@ func initSchema(db *sql.DB) error {
 		return err
 	}
 
+	// Cadastrar o catálogo inicial sem sobrescrever preços já existentes
+	for _, p := range seedCatalog {
+		_, err := db.Exec(
+			"INSERT INTO catalog (id, name, price) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
+			p.ID, p.Name, float64(p.PriceCents)/100,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Println("Schema do banco inicializado")
 	return nil
 }
 
-func setupProducer() (sarama.SyncProducer, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
-
-	config := sarama.NewConfig()
-	config.Producer.Return.Successes = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Retry.Max = 5
-
-	producer, err := sarama.NewSyncProducer(brokers, config)
-	if err != nil {
+// handleValidateOrder valida o pedido e calcula o valor a partir do catálogo
+func (s *OrderService) handleValidateOrder(_ context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	var payload protocol.ValidateOrder
+	if err := protocol.Decode(cmd, &payload); err != nil {
 		return nil, err
 	}
 
-	log.Println("Kafka Producer configurado")
-	return producer, nil
-}
-
-func setupConsumer() (sarama.ConsumerGroup, error) {
-	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
-
-	config := sarama.NewConfig()
-	config.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
-
-	consumer, err := sarama.NewConsumerGroup(brokers, "pedidos-group", config)
+	order, err := s.validateOrder(tx, cmd, &payload)
 	if err != nil {
+		log.Printf("Falha ao validar pedido (SAGA: %s): %v", cmd.SagaID, err)
+		var unknown *errUnknownProduct
+		if errors.As(err, &unknown) {
+			return nil, participant.Reject(err)
+		}
 		return nil, err
 	}
 
-	log.Println("Kafka Consumer configurado")
-	return consumer, nil
+	log.Printf("Pedido %s validado: %d item(ns), R$ %.2f", order.ID, len(order.Items), order.TotalAmount)
+	return &participant.Result{
+		Message: "Pedido validado com sucesso",
+		Data: protocol.OrderValidated{
+			OrderID:     order.ID,
+			CustomerID:  order.CustomerID,
+			Items:       order.Items,
+			TotalAmount: order.TotalAmount,
+			AmountCents: order.AmountCents(),
+			Currency:    "BRL",
+			CardNumber:  payload.CardNumber,
+			Address:     payload.Address,
+		},
+	}, nil
 }
 
-// consumeCommands consome comandos do orquestrador
-func (s *OrderService) consumeCommands(ctx context.Context) {
-	topics := []string{"pedidos-commands"}
-	handler := &ConsumerHandler{service: s}
-
-	for {
-		if err := s.consumer.Consume(ctx, topics, handler); err != nil {
-			log.Printf("Erro ao consumir mensagens: %v", err)
-		}
-
-		if ctx.Err() != nil {
-			return
-		}
+// handleCancelOrder cancela o pedido (compensação)
+func (s *OrderService) handleCancelOrder(_ context.Context, tx *sql.Tx, cmd *Command) (*participant.Result, error) {
+	if err := s.cancelOrder(tx, cmd.SagaID); err != nil {
+		return nil, fmt.Errorf("Erro ao cancelar pedido: %w", err)
 	}
-}
 
-// ConsumerHandler implementa sarama.ConsumerGroupHandler
-type ConsumerHandler struct {
-	service *OrderService
+	log.Printf("Pedido cancelado (SAGA: %s)", cmd.SagaID)
+	return &participant.Result{Message: "Pedido cancelado com sucesso"}, nil
 }
 
-func (h *ConsumerHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
-func (h *ConsumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
-
-func (h *ConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		var cmd Command
-		if err := json.Unmarshal(message.Value, &cmd); err != nil {
-			log.Printf("Erro ao deserializar comando: %v", err)
-			session.MarkMessage(message, "")
-			continue
-		}
-
-		log.Printf("Comando recebido: %s (SAGA: %s)", cmd.CommandType, cmd.SagaID)
-
-		// Processar comando
-		reply := h.service.processCommand(&cmd)
-
-		// Enviar resposta
-		if err := h.service.sendReply(reply); err != nil {
-			log.Printf("❌ Erro ao enviar reply: %v", err)
-		}
+// errUnknownProduct indica um item cujo produto não está no catálogo
+type errUnknownProduct struct {
+	ProductID string
+}
 
-		session.MarkMessage(message, "")
-	}
-	return nil
+func (e *errUnknownProduct) Error() string {
+	return fmt.Sprintf("Produto %s não cadastrado no catálogo", e.ProductID)
 }
 
-// processCommand processa um comando e retorna uma resposta
-func (s *OrderService) processCommand(cmd *Command) *Reply {
-	reply := &Reply{
-		ReplyID:   generateID(),
-		CommandID: cmd.CommandID,
-		SagaID:    cmd.SagaID,
-		Timestamp: time.Now(),
-		Data:      make(map[string]interface{}),
+// validateOrder valida os itens contra o catálogo, calcula o valor do pedido
+// e o grava com os itens
+func (s *OrderService) validateOrder(tx *sql.Tx, cmd *Command, payload *protocol.ValidateOrder) (*Order, error) {
+	order := &Order{
+		ID:         ids.New(),
+		SagaID:     cmd.SagaID,
+		CustomerID: payload.CustomerID,
+		Status:     "VALIDATED",
+		CreatedAt:  time.Now(),
 	}
 
-	switch cmd.CommandType {
-	case "VALIDATE_ORDER":
-		// Validar pedido (mockado)
-		order := s.validateOrder(cmd)
-		if order != nil {
-			reply.Success = true
-			reply.Message = "Pedido validado com sucesso"
-			reply.Data["order_id"] = order.ID
-			reply.Data["customer_id"] = order.CustomerID
-			reply.Data["product_id"] = order.ProductID
-			reply.Data["quantity"] = order.Quantity
-			reply.Data["total_amount"] = order.TotalAmount
-			log.Printf("Pedido %s validado", order.ID)
-		} else {
-			reply.Success = false
-			reply.Message = "Falha ao validar pedido"
-			log.Printf("Falha ao validar pedido")
+	// Preço de cada item vem do catálogo
+	for _, item := range payload.Items {
+		var price float64
+		err := tx.QueryRow("SELECT price FROM catalog WHERE id = $1", item.ProductID).Scan(&price)
+		if err == sql.ErrNoRows {
+			return nil, &errUnknownProduct{ProductID: item.ProductID}
 		}
-
-	case "CANCEL_ORDER":
-		// Cancelar pedido (compensação)
-		if err := s.cancelOrder(cmd.SagaID); err != nil {
-			reply.Success = false
-			reply.Message = fmt.Sprintf("Erro ao cancelar pedido: %v", err)
-			log.Printf("❌ Erro ao cancelar pedido: %v", err)
-		} else {
-			reply.Success = true
-			reply.Message = "Pedido cancelado com sucesso"
-			log.Printf("Pedido cancelado (SAGA: %s)", cmd.SagaID)
+		if err != nil {
+			return nil, err
 		}
 
-	default:
-		reply.Success = false
-		reply.Message = fmt.Sprintf("Comando desconhecido: %s", cmd.CommandType)
-		log.Printf("Comando desconhecido: %s", cmd.CommandType)
-	}
-
-	return reply
-}
-
-// validateOrder valida e cria um pedido (mockado)
-func (s *OrderService) validateOrder(cmd *Command) *Order {
-	// Simulação de validação de negócio
-	// Em um cenário real, validaria dados do cliente, produto, etc.
-
-	order := &Order{
-		ID:          generateID(),
-		SagaID:      cmd.SagaID,
-		CustomerID:  getStringFromPayload(cmd.Payload, "customer_id", "CUST-001"),
-		ProductID:   getStringFromPayload(cmd.Payload, "product_id", "PROD-001"),
-		Quantity:    getIntFromPayload(cmd.Payload, "quantity", 1),
-		TotalAmount: getFloatFromPayload(cmd.Payload, "total_amount", 100.00),
-		Status:      "VALIDATED",
-		CreatedAt:   time.Now(),
+		order.Items = append(order.Items, protocol.PricedItem{
+			ProductID:      item.ProductID,
+			Quantity:       item.Quantity,
+			UnitPriceCents: protocol.ToCents(price),
+		})
 	}
+	order.TotalAmount = float64(order.AmountCents()) / 100
 
-	// Persistir no banco
-	_, err := s.db.Exec(
-		`INSERT INTO orders (id, saga_id, customer_id, product_id, quantity, total_amount, status)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		order.ID, order.SagaID, order.CustomerID, order.ProductID,
-		order.Quantity, order.TotalAmount, order.Status,
+	// Persistir o pedido e seus itens
+	_, err := tx.Exec(
+		`INSERT INTO orders (id, saga_id, customer_id, total_amount, status)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		order.ID, order.SagaID, order.CustomerID, order.TotalAmount, order.Status,
 	)
-
 	if err != nil {
-		log.Printf("❌ Erro ao salvar pedido: %v", err)
-		return nil
+		return nil, fmt.Errorf("erro ao salvar pedido: %w", err)
 	}
 
-	return order
+	for _, item := range order.Items {
+		_, err := tx.Exec(
+			"INSERT INTO order_items (order_id, product_id, quantity, unit_price) VALUES ($1, $2, $3, $4)",
+			order.ID, item.ProductID, item.Quantity, float64(item.UnitPriceCents)/100,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("erro ao salvar item %s: %w", item.ProductID, err)
+		}
+	}
+	return order, nil
 }
 
 // cancelOrder cancela um pedido
-func (s *OrderService) cancelOrder(sagaID string) error {
-	_, err := s.db.Exec(
+func (s *OrderService) cancelOrder(tx *sql.Tx, sagaID string) error {
+	_, err := tx.Exec(
 		"UPDATE orders SET status = 'CANCELLED' WHERE saga_id = $1",
 		sagaID,
 	)
 	return err
 }
 
-// sendReply envia uma resposta para o orquestrador
-func (s *OrderService) sendReply(reply *Reply) error {
-	data, err := json.Marshal(reply)
-	if err != nil {
-		return err
+// handleDeliveryEvent registra no pedido o status da entrega. Eventos
+// repetidos ou mais antigos que o último aplicado não alteram o pedido.
+func (s *OrderService) handleDeliveryEvent(data []byte) error {
+	var event protocol.DeliveryEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return deadletter.Permanent(fmt.Errorf("evento de entrega inválido: %w", err))
 	}
-
-	msg := &sarama.ProducerMessage{
-		Topic: "pedidos-reply",
-		Value: sarama.ByteEncoder(data),
+	if event.SagaID == "" {
+		return deadletter.Permanent(fmt.Errorf("evento de entrega %s sem saga_id", event.EventID))
 	}
 
-	_, _, err = s.producer.SendMessage(msg)
+	result, err := s.db.Exec(
+		`UPDATE orders SET delivery_status = $1, tracking_number = NULLIF($2, ''), delivery_updated_at = $3
+		 WHERE saga_id = $4 AND (delivery_updated_at IS NULL OR delivery_updated_at < $3)`,
+		event.Status, event.TrackingNumber, event.OccurredAt, event.SagaID,
+	)
 	if err != nil {
-		return err
-	}
-
-	log.Printf("Reply enviado: Success=%t, Message=%s", reply.Success, reply.Message)
-	return nil
-}
-
-// Funções auxiliares
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-func getStringFromPayload(payload map[string]interface{}, key, defaultValue string) string {
-	if val, ok := payload[key]; ok {
-		if strVal, ok := val.(string); ok {
-			return strVal
-		}
-	}
-	return defaultValue
-}
-
-func getIntFromPayload(payload map[string]interface{}, key string, defaultValue int) int {
-	if val, ok := payload[key]; ok {
-		if intVal, ok := val.(float64); ok {
-			return int(intVal)
-		}
+		return fmt.Errorf("erro ao atualizar entrega do pedido da SAGA %s: %w", event.SagaID, err)
 	}
-	return defaultValue
-}
 
-func getFloatFromPayload(payload map[string]interface{}, key string, defaultValue float64) float64 {
-	if val, ok := payload[key]; ok {
-		if floatVal, ok := val.(float64); ok {
-			return floatVal
-		}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		log.Printf("Pedido da SAGA %s: entrega %s", event.SagaID, event.Status)
 	}
-	return defaultValue
+	return nil
 }
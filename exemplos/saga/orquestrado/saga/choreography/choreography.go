@@ -0,0 +1,493 @@
+// Package choreography reúne o que os serviços da versão coreografada da SAGA
+// têm em comum: conexão com o banco, producer e consumer group do Kafka,
+// publicação dos eventos, idempotência pelos eventos já processados, novas
+// tentativas com dead-letter, injeção de falhas e encerramento gracioso.
+//
+// O serviço cria o seu reator, registra uma reação por tipo de evento e
+// chama Run:
+//
+//	r, err := choreography.New(choreography.Config{Name: "estoque"})
+//	...
+//	r.React("pedidos-events", "OrderCreated", choreography.Step{
+//		Command:      protocol.CommandReserveStock,
+//		FailureEvent: "StockReservationFailed",
+//	}, service.reserveStock)
+//	r.Run()
+package choreography
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"saga/deadletter"
+	"saga/faults"
+	"saga/ids"
+	"saga/participant"
+	"saga/protocol"
+)
+
+// Event representa um evento de domínio publicado por um serviço. Não há
+// orquestrador: cada serviço reage aos eventos dos demais.
+type Event struct {
+	EventID     string                 `json:"event_id"`
+	EventType   string                 `json:"event_type"`
+	SagaID      string                 `json:"saga_id"`
+	OrderID     string                 `json:"order_id"`
+	CausationID string                 `json:"causation_id,omitempty"`
+	Source      string                 `json:"source"`
+	Message     string                 `json:"message,omitempty"`
+	Data        map[string]interface{} `json:"data"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+// NewEvent cria o evento publicado em reação a outro, mantendo a SAGA, o
+// pedido e os dados acumulados e apontando para o evento que o causou. O
+// source é preenchido com o nome do serviço na publicação.
+func NewEvent(eventType string, cause *Event, message string) *Event {
+	data := make(map[string]interface{})
+	for k, v := range cause.Data {
+		data[k] = v
+	}
+
+	return &Event{
+		EventID:     ids.New(),
+		EventType:   eventType,
+		SagaID:      cause.SagaID,
+		OrderID:     cause.OrderID,
+		CausationID: cause.EventID,
+		Message:     message,
+		Data:        data,
+		Timestamp:   time.Now(),
+	}
+}
+
+// Reaction trata um evento consumido. As escritas são feitas em tx, a mesma
+// transação que registra o evento como processado: ou a reação é aplicada e
+// registrada, ou nada fica gravado. O evento retornado (nil para nenhum) é
+// publicado depois do commit.
+//
+// Recusas de negócio são eventos de falha (ex.: StockReservationFailed). Um
+// erro é tratado como falha de infraestrutura: as escritas são desfeitas e a
+// mensagem é tentada de novo e, esgotadas as tentativas, desviada para o
+// dead-letter.
+type Reaction func(tx *sql.Tx, cause *Event) (*Event, error)
+
+// Step associa uma reação à etapa equivalente da versão orquestrada. As
+// falhas de FAULTS_FILE são decididas pelo CommandType da etapa e pelo
+// order_id, então as tags de pedido do simulador reproduzem os mesmos
+// cenários nas duas versões.
+type Step struct {
+	// Command é o CommandType da etapa na versão orquestrada. Vazio, a
+	// reação não recebe falhas injetadas.
+	Command string
+	// FailureEvent é publicado no lugar da reação quando a falha injetada
+	// recusa a etapa. Vazio, a recusa é tratada como erro e a mensagem é
+	// tentada de novo.
+	FailureEvent string
+}
+
+// Handler trata as mensagens de um tópico que não traz eventos de domínio,
+// como os pedidos do simulador. Erros seguem as mesmas novas tentativas e
+// dead-letter das reações.
+type Handler func(data []byte) error
+
+// Config descreve o serviço. Apenas Name é obrigatório: o tópico de eventos,
+// o consumer group e o banco padrão derivam dele.
+type Config struct {
+	// Name identifica o serviço nos logs e no source dos eventos
+	Name string
+	// EventsTopic recebe os eventos publicados (padrão "<Name>-events")
+	EventsTopic string
+	// Group é o consumer group, que também dá nome ao tópico de dead-letter
+	// (padrão "<Name>-group")
+	Group string
+}
+
+// Reactor consome os eventos dos demais serviços e os despacha às reações
+// registradas
+type Reactor struct {
+	// DB é a conexão com o banco do serviço, que também guarda os eventos processados
+	DB *sql.DB
+	// Producer pode ser usado pelo serviço para publicar em outros tópicos
+	Producer sarama.SyncProducer
+
+	config   Config
+	consumer sarama.ConsumerGroup
+	// deadLetters recebe as mensagens que falharam em todas as tentativas
+	deadLetters *deadletter.Queue
+
+	// faults decide as falhas injetadas em cada etapa
+	faults *faults.Config
+
+	reactions map[string]map[string]reaction
+	handlers  map[string]Handler
+	forwards  map[string]func(*Event) error
+}
+
+// New conecta ao banco e ao Kafka e prepara a tabela de eventos processados.
+// A configuração do ambiente (DB_*, KAFKA_BROKERS, DLQ_*) é a mesma dos
+// participantes da versão orquestrada.
+func New(config Config) (*Reactor, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("serviço sem nome")
+	}
+	if config.EventsTopic == "" {
+		config.EventsTopic = config.Name + "-events"
+	}
+	if config.Group == "" {
+		config.Group = config.Name + "-group"
+	}
+
+	r := &Reactor{
+		config:    config,
+		reactions: make(map[string]map[string]reaction),
+		handlers:  make(map[string]Handler),
+		forwards:  make(map[string]func(*Event) error),
+	}
+
+	var err error
+	defer func() {
+		if err != nil {
+			r.close()
+		}
+	}()
+
+	if r.faults, err = faults.Load(); err != nil {
+		return nil, fmt.Errorf("erro ao carregar injeção de falhas: %w", err)
+	}
+
+	// Conectar ao banco de dados
+	if r.DB, err = participant.ConnectDB(config.Name); err != nil {
+		return nil, fmt.Errorf("erro ao conectar no banco: %w", err)
+	}
+	if err = initProcessedEvents(r.DB); err != nil {
+		return nil, fmt.Errorf("erro ao criar tabela de eventos processados: %w", err)
+	}
+
+	// Configurar Kafka Producer e Consumer
+	if r.Producer, err = participant.NewProducer(); err != nil {
+		return nil, fmt.Errorf("erro ao configurar producer: %w", err)
+	}
+	if r.consumer, err = participant.NewConsumerGroup(config.Group); err != nil {
+		return nil, fmt.Errorf("erro ao configurar consumer: %w", err)
+	}
+
+	r.deadLetters = deadletter.NewQueue(r.Producer, config.Group)
+	return r, nil
+}
+
+// reaction é uma reação registrada com a sua etapa
+type reaction struct {
+	step  Step
+	react Reaction
+}
+
+// React registra a reação a um tipo de evento publicado no tópico. Os demais
+// eventos do tópico são ignorados.
+func (r *Reactor) React(topic, eventType string, step Step, react Reaction) {
+	if r.reactions[topic] == nil {
+		r.reactions[topic] = make(map[string]reaction)
+	}
+	r.reactions[topic][eventType] = reaction{step: step, react: react}
+}
+
+// Handle consome também um tópico de mensagens que não são eventos de domínio
+func (r *Reactor) Handle(topic string, handler Handler) {
+	r.handlers[topic] = handler
+}
+
+// Forward executa fn depois que um evento do tipo informado é publicado (ex.:
+// repassar a conclusão do pedido no formato da versão orquestrada). Um erro
+// faz a mensagem que causou o evento ser tentada de novo, e o evento é
+// republicado.
+func (r *Reactor) Forward(eventType string, fn func(*Event) error) {
+	r.forwards[eventType] = fn
+}
+
+// Run consome os eventos até receber SIGINT ou SIGTERM e então encerra o
+// consumo e as conexões
+func (r *Reactor) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.consume(ctx)
+	}()
+
+	// Aguardar sinal de término
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	<-sigterm
+
+	log.Printf("Encerrando serviço %s...", r.config.Name)
+
+	// A mensagem em processamento termina antes do consumo parar
+	cancel()
+	wg.Wait()
+
+	r.close()
+}
+
+// close libera o que New conseguiu abrir
+func (r *Reactor) close() {
+	if r.consumer != nil {
+		if err := r.consumer.Close(); err != nil {
+			log.Printf("Erro ao encerrar consumer: %v", err)
+		}
+	}
+	if r.Producer != nil {
+		if err := r.Producer.Close(); err != nil {
+			log.Printf("Erro ao encerrar producer: %v", err)
+		}
+	}
+	if r.DB != nil {
+		r.DB.Close()
+	}
+}
+
+// consume consome os tópicos com reações ou handlers até o contexto ser cancelado
+func (r *Reactor) consume(ctx context.Context) {
+	var topics []string
+	for topic := range r.reactions {
+		topics = append(topics, topic)
+	}
+	for topic := range r.handlers {
+		topics = append(topics, topic)
+	}
+	handler := &consumerHandler{reactor: r}
+
+	for {
+		if err := r.consumer.Consume(ctx, topics, handler); err != nil {
+			log.Printf("Erro ao consumir mensagens: %v", err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// consumerHandler implementa sarama.ConsumerGroupHandler
+type consumerHandler struct {
+	reactor *Reactor
+}
+
+func (h *consumerHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
+func (h *consumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
+
+func (h *consumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	r := h.reactor
+	for message := range claim.Messages() {
+		// A mensagem só é confirmada depois que o evento de resposta foi
+		// publicado ou, esgotadas as tentativas, desviado para o dead-letter
+		err := r.deadLetters.Handle(session, message, func() error {
+			if handler, ok := r.handlers[message.Topic]; ok {
+				return handler(message.Value)
+			}
+			return r.handleEvent(message)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleEvent decodifica o evento consumido e o entrega à reação registrada
+func (r *Reactor) handleEvent(message *sarama.ConsumerMessage) error {
+	var event Event
+	if err := json.Unmarshal(message.Value, &event); err != nil {
+		return deadletter.Permanent(fmt.Errorf("erro ao deserializar evento: %w", err))
+	}
+
+	registered, ok := r.reactions[message.Topic][event.EventType]
+	if !ok {
+		return nil
+	}
+
+	log.Printf("Evento recebido: %s de %s (SAGA: %s)", event.EventType, event.Source, event.SagaID)
+	return r.Process(&event, registered.step, registered.react)
+}
+
+// Process aplica a reação ao evento uma única vez e publica o resultado. O
+// evento é reivindicado em processed_events na transação da reação; numa
+// reentrega, ou numa nova tentativa depois de uma falha na publicação, o
+// resultado registrado é republicado sem executar a reação de novo. As falhas
+// injetadas na etapa são aplicadas como nos participantes da versão
+// orquestrada.
+func (r *Reactor) Process(cause *Event, step Step, react Reaction) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("erro ao iniciar transação do evento %s: %w", cause.EventID, err)
+	}
+	defer tx.Rollback()
+
+	// Uma execução concorrente do mesmo evento espera aqui até a outra
+	// terminar e então recebe o resultado registrado por ela
+	result, claimed, err := claimEvent(tx, cause)
+	if err != nil {
+		return fmt.Errorf("erro ao verificar evento %s: %w", cause.EventID, err)
+	}
+
+	if !claimed {
+		log.Printf("Evento %s já processado, republicando o resultado registrado", cause.EventID)
+		tx.Rollback()
+	} else {
+		// As falhas são decididas como para o comando equivalente
+		cmd := &protocol.Command{
+			CommandID:   cause.EventID,
+			CommandType: step.Command,
+			SagaID:      cause.SagaID,
+			OrderID:     cause.OrderID,
+		}
+		var fault faults.Fault
+		if step.Command != "" {
+			fault = r.faults.Decide(cmd)
+		}
+		fault.Wait()
+
+		// Processar o evento, a menos que a falha seja injetada
+		if fault.Fail {
+			if result, err = injectedFailure(step, fault, cmd, cause); err != nil {
+				return err
+			}
+		} else if result, err = react(tx, cause); err != nil {
+			return fmt.Errorf("erro ao tratar evento %s: %w", cause.EventID, err)
+		}
+		if result != nil && result.Source == "" {
+			result.Source = r.config.Name
+		}
+
+		// O resultado é registrado no commit das escritas da reação
+		if err := saveResult(tx, cause, result); err != nil {
+			return fmt.Errorf("erro ao registrar evento processado %s: %w", cause.EventID, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("erro ao registrar evento processado %s: %w", cause.EventID, err)
+		}
+
+		fault.Crash(cmd)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return r.Publish(result)
+}
+
+// injectedFailure monta o evento de falha da etapa recusada pela injeção de
+// falhas. Sem evento de falha, a recusa volta como erro.
+func injectedFailure(step Step, fault faults.Fault, cmd *protocol.Command, cause *Event) (*Event, error) {
+	reply := fault.Reply(cmd)
+	if step.FailureEvent == "" {
+		return nil, fmt.Errorf("falha injetada no evento %s: %s", cause.EventID, reply.Message)
+	}
+
+	event := NewEvent(step.FailureEvent, cause, reply.Message)
+	event.Data["injected_fault"] = fault.Rule
+	return event, nil
+}
+
+// Publish publica um evento do serviço e executa o Forward do tipo do evento
+func (r *Reactor) Publish(event *Event) error {
+	if event.Source == "" {
+		event.Source = r.config.Name
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// A chave mantém os eventos da SAGA na mesma partição do tópico
+	msg := &sarama.ProducerMessage{
+		Topic: r.config.EventsTopic,
+		Key:   sarama.StringEncoder(event.SagaID),
+		Value: sarama.ByteEncoder(data),
+	}
+
+	if _, _, err := r.Producer.SendMessage(msg); err != nil {
+		return fmt.Errorf("erro ao publicar evento %s: %w", event.EventType, err)
+	}
+	log.Printf("Evento publicado: %s (SAGA: %s)", event.EventType, event.SagaID)
+
+	if forward, ok := r.forwards[event.EventType]; ok {
+		return forward(event)
+	}
+	return nil
+}
+
+// initProcessedEvents cria a tabela com o resultado de cada evento
+// processado. O resultado é nulo quando a reação não publicou nenhum evento.
+func initProcessedEvents(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS processed_events (
+		event_id VARCHAR(100) PRIMARY KEY,
+		saga_id VARCHAR(100) NOT NULL,
+		event_type VARCHAR(50) NOT NULL,
+		result JSONB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	return err
+}
+
+// claimEvent registra o evento como processado na transação. Se ele já foi
+// processado, retorna false e o evento publicado em resposta, se houver.
+func claimEvent(tx *sql.Tx, event *Event) (*Event, bool, error) {
+	result, err := tx.Exec(
+		`INSERT INTO processed_events (event_id, saga_id, event_type)
+		 VALUES ($1, $2, $3) ON CONFLICT (event_id) DO NOTHING`,
+		event.EventID, event.SagaID, event.EventType,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 1 {
+		return nil, err == nil, err
+	}
+
+	var data []byte
+	err = tx.QueryRow(
+		"SELECT result FROM processed_events WHERE event_id = $1",
+		event.EventID,
+	).Scan(&data)
+	if err != nil || data == nil {
+		return nil, false, err
+	}
+
+	var published Event
+	if err := json.Unmarshal(data, &published); err != nil {
+		return nil, false, err
+	}
+	return &published, false, nil
+}
+
+// saveResult registra o evento publicado em resposta ao evento reivindicado
+func saveResult(tx *sql.Tx, event *Event, result *Event) error {
+	if result == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE processed_events SET result = $2 WHERE event_id = $1",
+		event.EventID, data,
+	)
+	return err
+}
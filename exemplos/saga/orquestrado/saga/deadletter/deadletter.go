@@ -0,0 +1,116 @@
+// Package deadletter define o formato das mensagens enviadas aos tópicos de
+// dead-letter dos consumers da SAGA, a política de novas tentativas aplicada
+// antes de uma mensagem ser desviada para eles e o desvio em si (Queue).
+//
+// A mensagem desviada mantém os bytes e os headers originais; os dados da
+// falha vão em headers com o prefixo "dlq.". Para republicar basta enviar o
+// mesmo valor ao tópico original sem esses headers.
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Headers acrescentados à mensagem desviada
+const (
+	HeaderPrefix            = "dlq."
+	HeaderOriginalTopic     = "dlq.original_topic"
+	HeaderOriginalPartition = "dlq.original_partition"
+	HeaderOriginalOffset    = "dlq.original_offset"
+	HeaderConsumerGroup     = "dlq.consumer_group"
+	HeaderError             = "dlq.error"
+	HeaderAttempts          = "dlq.attempts"
+	HeaderFailedAt          = "dlq.failed_at"
+)
+
+// TopicSuffix é acrescentado ao consumer group para formar o tópico de dead-letter
+const TopicSuffix = "-dlq"
+
+// Topic retorna o tópico de dead-letter do consumer group
+func Topic(group string) string {
+	return group + TopicSuffix
+}
+
+// IsDeadLetterHeader indica se o header foi acrescentado no desvio
+func IsDeadLetterHeader(key string) bool {
+	return strings.HasPrefix(key, HeaderPrefix)
+}
+
+// Policy limita as tentativas de processar uma mensagem. O intervalo entre
+// elas dobra a cada falha, a partir de Backoff, até MaxBackoff.
+type Policy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultPolicy é usada quando o serviço não configura outra
+var DefaultPolicy = Policy{
+	MaxAttempts: 3,
+	Backoff:     200 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+}
+
+// Delay retorna a espera antes da tentativa seguinte à tentativa informada
+func (p Policy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// permanentError marca um erro que não adianta tentar de novo
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marca err como definitivo: a mensagem vai direto para o
+// dead-letter, sem novas tentativas (ex: JSON que não pode ser decodificado)
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent indica se err foi marcado com Permanent
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Retry executa process até que tenha sucesso, falhe com um erro permanente
+// ou esgote as tentativas da política. Retorna o número de tentativas feitas
+// e o último erro. Se ctx for cancelado durante a espera, retorna ctx.Err():
+// a mensagem não deve ser desviada nem confirmada, pois será reentregue.
+func Retry(ctx context.Context, policy Policy, process func() error) (int, error) {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := process()
+		if err == nil || IsPermanent(err) || attempt >= maxAttempts {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(policy.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
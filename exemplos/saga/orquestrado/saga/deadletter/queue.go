@@ -0,0 +1,102 @@
+package deadletter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Queue desvia para o tópico de dead-letter do consumer group as mensagens
+// que não puderam ser processadas depois das novas tentativas
+type Queue struct {
+	producer sarama.SyncProducer
+	group    string
+	topic    string
+	policy   Policy
+}
+
+// NewQueue cria o dead-letter do consumer group. As tentativas e o backoff
+// inicial podem ser ajustados por DLQ_MAX_ATTEMPTS e DLQ_BACKOFF_MS.
+func NewQueue(producer sarama.SyncProducer, group string) *Queue {
+	policy := DefaultPolicy
+	if n, err := strconv.Atoi(os.Getenv("DLQ_MAX_ATTEMPTS")); err == nil && n > 0 {
+		policy.MaxAttempts = n
+	}
+	if ms, err := strconv.Atoi(os.Getenv("DLQ_BACKOFF_MS")); err == nil && ms > 0 {
+		policy.Backoff = time.Duration(ms) * time.Millisecond
+	}
+
+	return &Queue{
+		producer: producer,
+		group:    group,
+		topic:    Topic(group),
+		policy:   policy,
+	}
+}
+
+// Handle processa a mensagem com novas tentativas e a confirma quando foi
+// processada ou desviada para o dead-letter. Se nem o desvio foi possível,
+// ou se a sessão foi encerrada, retorna erro sem confirmar: o consumo da
+// partição deve parar para que a mensagem seja reentregue.
+func (q *Queue) Handle(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, process func() error) error {
+	attempts, err := Retry(session.Context(), q.policy, func() error {
+		err := process()
+		if err != nil {
+			log.Printf("Falha ao processar mensagem %s[%d]@%d: %v",
+				message.Topic, message.Partition, message.Offset, err)
+		}
+		return err
+	})
+	if err != nil {
+		if ctxErr := session.Context().Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		log.Printf("⚠️  Mensagem %s[%d]@%d enviada para %s após %d tentativa(s): %v",
+			message.Topic, message.Partition, message.Offset, q.topic, attempts, err)
+		if err := q.publish(message, err, attempts); err != nil {
+			return fmt.Errorf("erro ao publicar no dead-letter %s: %w", q.topic, err)
+		}
+	}
+
+	session.MarkMessage(message, "")
+	return nil
+}
+
+// publish envia ao dead-letter os bytes e headers originais da mensagem,
+// acrescidos dos headers que descrevem a falha
+func (q *Queue) publish(message *sarama.ConsumerMessage, cause error, attempts int) error {
+	headers := make([]sarama.RecordHeader, 0, len(message.Headers)+7)
+	for _, h := range message.Headers {
+		if h != nil && !IsDeadLetterHeader(string(h.Key)) {
+			headers = append(headers, *h)
+		}
+	}
+
+	header := func(key, value string) {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	header(HeaderOriginalTopic, message.Topic)
+	header(HeaderOriginalPartition, strconv.Itoa(int(message.Partition)))
+	header(HeaderOriginalOffset, strconv.FormatInt(message.Offset, 10))
+	header(HeaderConsumerGroup, q.group)
+	header(HeaderError, cause.Error())
+	header(HeaderAttempts, strconv.Itoa(attempts))
+	header(HeaderFailedAt, time.Now().UTC().Format(time.RFC3339Nano))
+
+	msg := &sarama.ProducerMessage{
+		Topic:   q.topic,
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	}
+	if message.Key != nil {
+		msg.Key = sarama.ByteEncoder(message.Key)
+	}
+
+	_, _, err := q.producer.SendMessage(msg)
+	return err
+}
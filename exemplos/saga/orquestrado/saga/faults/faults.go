@@ -0,0 +1,186 @@
+// Package faults injeta falhas nos comandos consumidos pelos participantes
+// da SAGA: recusas, latência e queda do processo depois das gravações. As
+// falhas vêm de FAULTS_FILE (arquivo JSON) ou de FAULTS (JSON inline).
+package faults
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	"saga/ids"
+	"saga/protocol"
+)
+
+// Tipos de falha das regras de injeção
+const (
+	KindFail            = "fail"
+	KindLatency         = "latency"
+	KindCrashAfterWrite = "crash_after_write"
+)
+
+// Config descreve as falhas injetadas nos participantes. O mesmo arquivo é
+// compartilhado por todos os serviços: cada um só aplica as entradas dos
+// comandos que consome.
+type Config struct {
+	// Seed muda o sorteio determinístico das taxas de falha
+	Seed     string                   `json:"seed"`
+	Commands map[string]CommandFaults `json:"commands"`
+	Rules    []Rule                   `json:"rules"`
+}
+
+// CommandFaults são as falhas aplicadas a todos os comandos de um tipo
+type CommandFaults struct {
+	FailureRate         float64 `json:"failure_rate"`
+	LatencyMs           int     `json:"latency_ms"`
+	CrashAfterWriteRate float64 `json:"crash_after_write_rate"`
+}
+
+// Rule força uma falha nos pedidos cujo order_id casa com o padrão.
+// Command vazio aplica a regra a todos os comandos do serviço.
+type Rule struct {
+	Name           string `json:"name"`
+	OrderIDPattern string `json:"order_id_pattern"`
+	Command        string `json:"command,omitempty"`
+	Fault          string `json:"fault"`
+	LatencyMs      int    `json:"latency_ms,omitempty"`
+	Message        string `json:"message,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Fault é a decisão para um comando específico
+type Fault struct {
+	Rule            string
+	Fail            bool
+	Message         string
+	Latency         time.Duration
+	CrashAfterWrite bool
+}
+
+// Load lê a configuração de FAULTS_FILE (caminho de um arquivo JSON) ou de
+// FAULTS (JSON inline). Sem nenhuma das duas não há falhas.
+func Load() (*Config, error) {
+	var data []byte
+	if path := os.Getenv("FAULTS_FILE"); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	} else if inline := os.Getenv("FAULTS"); inline != "" {
+		data = []byte(inline)
+	} else {
+		return &Config{}, nil
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		switch rule.Fault {
+		case KindFail, KindLatency, KindCrashAfterWrite:
+		default:
+			return nil, fmt.Errorf("regra %s: fault inválido %q", rule.Name, rule.Fault)
+		}
+
+		pattern, err := regexp.Compile(rule.OrderIDPattern)
+		if err != nil {
+			return nil, fmt.Errorf("regra %s: order_id_pattern inválido: %w", rule.Name, err)
+		}
+		rule.pattern = pattern
+	}
+
+	log.Printf("Injeção de falhas: %d tipo(s) de comando e %d regra(s)", len(config.Commands), len(config.Rules))
+	return &config, nil
+}
+
+// Decide calcula as falhas do comando. As regras são avaliadas antes das
+// taxas; as taxas são sorteadas a partir do order_id, então o mesmo pedido
+// tem sempre o mesmo resultado.
+func (c *Config) Decide(cmd *protocol.Command) Fault {
+	var fault Fault
+
+	for _, rule := range c.Rules {
+		if rule.Command != "" && rule.Command != cmd.CommandType {
+			continue
+		}
+		if !rule.pattern.MatchString(cmd.OrderID) {
+			continue
+		}
+
+		fault.Rule = rule.Name
+		switch rule.Fault {
+		case KindFail:
+			fault.Fail = true
+			fault.Message = rule.Message
+		case KindLatency:
+			fault.Latency = time.Duration(rule.LatencyMs) * time.Millisecond
+		case KindCrashAfterWrite:
+			fault.CrashAfterWrite = true
+		}
+		return fault
+	}
+
+	faults, ok := c.Commands[cmd.CommandType]
+	if !ok {
+		return fault
+	}
+
+	fault.Latency = time.Duration(faults.LatencyMs) * time.Millisecond
+	fault.Fail = c.roll(cmd, "fail") < faults.FailureRate
+	fault.CrashAfterWrite = !fault.Fail && c.roll(cmd, "crash") < faults.CrashAfterWriteRate
+	if fault.Fail || fault.CrashAfterWrite {
+		fault.Rule = "commands." + cmd.CommandType
+	}
+	return fault
+}
+
+// roll devolve um número em [0, 1) derivado do pedido e do comando
+func (c *Config) roll(cmd *protocol.Command, kind string) float64 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%s:%s:%s", c.Seed, cmd.OrderID, cmd.CommandType, kind)
+	return float64(h.Sum32()%10000) / 10000
+}
+
+// Wait aplica a latência configurada antes de processar o comando
+func (f Fault) Wait() {
+	if f.Latency > 0 {
+		log.Printf("Injeção de falhas (%s): atrasando o comando em %s", f.Rule, f.Latency)
+		time.Sleep(f.Latency)
+	}
+}
+
+// Reply monta o reply de falha sem executar o comando
+func (f Fault) Reply(cmd *protocol.Command) *protocol.Reply {
+	message := f.Message
+	if message == "" {
+		message = fmt.Sprintf("Falha injetada em %s", cmd.CommandType)
+	}
+
+	log.Printf("Injeção de falhas (%s): %s (SAGA: %s, pedido: %s)", f.Rule, message, cmd.SagaID, cmd.OrderID)
+	return &protocol.Reply{
+		ReplyID:   ids.New(),
+		CommandID: cmd.CommandID,
+		SagaID:    cmd.SagaID,
+		Success:   false,
+		Message:   message,
+		Data:      map[string]interface{}{"injected_fault": f.Rule},
+		Timestamp: time.Now(),
+	}
+}
+
+// Crash encerra o processo depois das gravações no banco e antes do envio do
+// reply. O Kafka reentrega o comando ao reiniciar e o reply registrado é reenviado.
+func (f Fault) Crash(cmd *protocol.Command) {
+	if f.CrashAfterWrite {
+		log.Printf("Injeção de falhas (%s): encerrando antes de enviar o reply do comando %s", f.Rule, cmd.CommandID)
+		os.Exit(1)
+	}
+}
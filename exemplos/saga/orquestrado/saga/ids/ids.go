@@ -0,0 +1,147 @@
+// Package ids gera os identificadores usados pelos serviços da SAGA: SAGAs,
+// comandos, replies e entidades de domínio (pedidos, reservas, pagamentos,
+// entregas).
+//
+// Os IDs seguem o formato ULID: 26 caracteres em base32 de Crockford, com os
+// 48 bits iniciais para o horário em milissegundos e 80 bits aleatórios. A
+// parte aleatória torna a colisão entre instâncias improvável, e a ordem
+// lexicográfica dos IDs segue a ordem em que foram gerados. Dentro de um
+// processo os IDs gerados no mesmo milissegundo são estritamente crescentes.
+package ids
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Length é o tamanho de um ID sem prefixo
+const Length = 26
+
+// encoding é o alfabeto base32 de Crockford, sem I, L, O e U
+const encoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// maxTime é o maior horário representável em 48 bits (ano 10889)
+const maxTime = 1<<48 - 1
+
+// ErrInvalid indica uma string que não é um ID válido
+var ErrInvalid = errors.New("ids: ID inválido")
+
+var generator = &monotonic{}
+
+// New gera um novo ID
+func New() string {
+	return generator.next(time.Now())
+}
+
+// NewWithPrefix gera um ID precedido de um prefixo legível, como "TRK" em
+// "TRK-01J9Z3K8X6V2Q4R7T0M5N8P1WC"
+func NewWithPrefix(prefix string) string {
+	return prefix + "-" + New()
+}
+
+// Time retorna o horário, com precisão de milissegundos, em que o ID foi gerado
+func Time(id string) (time.Time, error) {
+	if i := strings.LastIndexByte(id, '-'); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) != Length {
+		return time.Time{}, ErrInvalid
+	}
+
+	// O primeiro caractere carrega apenas 3 bits do horário
+	if strings.IndexByte("01234567", id[0]) < 0 {
+		return time.Time{}, ErrInvalid
+	}
+
+	var ms int64
+	for i := 0; i < 10; i++ {
+		v := strings.IndexByte(encoding, id[i])
+		if v < 0 {
+			return time.Time{}, ErrInvalid
+		}
+		ms = ms<<5 | int64(v)
+	}
+	for i := 10; i < Length; i++ {
+		if strings.IndexByte(encoding, id[i]) < 0 {
+			return time.Time{}, ErrInvalid
+		}
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// monotonic guarda o último horário e a última parte aleatória usados. No
+// mesmo milissegundo a parte aleatória é incrementada em vez de sorteada, o
+// que garante IDs crescentes mesmo com várias goroutines gerando ao mesmo tempo.
+type monotonic struct {
+	mu      sync.Mutex
+	lastMs  int64
+	entropy [10]byte
+}
+
+func (m *monotonic) next(now time.Time) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ms := now.UnixMilli()
+	if ms < m.lastMs {
+		// Relógio voltou: continuamos no último horário para manter a ordem
+		ms = m.lastMs
+	}
+	if ms > maxTime {
+		panic("ids: horário fora do intervalo do ULID")
+	}
+
+	if ms == m.lastMs && m.increment() {
+		return encode(ms, m.entropy)
+	}
+
+	// Novo milissegundo, ou a parte aleatória esgotou no mesmo milissegundo
+	if ms == m.lastMs {
+		ms++
+	}
+	if _, err := rand.Read(m.entropy[:]); err != nil {
+		panic("ids: falha ao ler bytes aleatórios: " + err.Error())
+	}
+	m.lastMs = ms
+	return encode(ms, m.entropy)
+}
+
+// increment soma um à parte aleatória; retorna false se ela transbordar
+func (m *monotonic) increment() bool {
+	for i := len(m.entropy) - 1; i >= 0; i-- {
+		m.entropy[i]++
+		if m.entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encode escreve os 128 bits (48 de horário e 80 aleatórios) em 26
+// caracteres de 5 bits, do mais significativo para o menos significativo
+func encode(ms int64, entropy [10]byte) string {
+	var raw [16]byte
+	for i := 0; i < 6; i++ {
+		raw[i] = byte(ms >> (8 * (5 - i)))
+	}
+	copy(raw[6:], entropy[:])
+
+	var out [Length]byte
+	// 128 bits não são múltiplo de 5: o primeiro caractere usa só 3 bits
+	var acc uint32
+	bits := 2
+	pos := 0
+	for _, b := range raw {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = encoding[(acc>>uint(bits))&31]
+			pos++
+		}
+	}
+	return string(out[:])
+}
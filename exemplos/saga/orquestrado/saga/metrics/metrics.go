@@ -0,0 +1,278 @@
+// Package metrics expõe as métricas dos serviços da SAGA no formato de
+// texto do Prometheus, em GET /metrics.
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBuckets são os limites (em segundos) dos histogramas de latência
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Sample é um valor calculado no momento da coleta por um GaugeFunc
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type metric interface {
+	write(b *strings.Builder)
+}
+
+// Registry guarda as métricas do serviço na ordem em que foram criadas
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// NewRegistry cria um registro vazio
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP escreve todas as métricas no formato de exposição do Prometheus
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// Serve expõe /metrics em um servidor HTTP próprio, para os serviços que não
+// têm API
+func (r *Registry) Serve(port string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", r)
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		log.Printf("Métricas disponíveis em %s/metrics", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Erro no servidor de métricas: %v", err)
+		}
+	}()
+
+	return server
+}
+
+// CounterVec é um contador monotônico por combinação de labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec registra um contador com os labels informados
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// Inc soma 1 ao contador dos valores de label informados
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add soma delta ao contador dos valores de label informados
+func (c *CounterVec) Add(delta float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(b, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(key), "", ""), formatValue(c.values[key]))
+	}
+}
+
+// HistogramVec acumula observações em buckets por combinação de labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registra um histograma com os buckets padrão de latência
+func (r *Registry) NewHistogramVec(name, help string, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: defaultBuckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe registra uma observação, em segundos
+func (h *HistogramVec) Observe(seconds float64, values ...string) {
+	key := labelKey(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, limit := range h.buckets {
+		if seconds <= limit {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += seconds
+}
+
+// ObserveSince registra o tempo decorrido desde start
+func (h *HistogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(b, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		values := splitKey(key)
+		for i, limit := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(limit)), v.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), v.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values, "", ""), formatValue(v.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, values, "", ""), v.count)
+	}
+}
+
+// GaugeFunc é um gauge calculado a cada coleta
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() ([]Sample, error)
+}
+
+// NewGaugeFunc registra um gauge cujos valores vêm de collect
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func() ([]Sample, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(b *strings.Builder) {
+	samples, err := g.collect()
+	if err != nil {
+		log.Printf("Erro ao coletar a métrica %s: %v", g.name, err)
+		return
+	}
+
+	writeHeader(b, g.name, g.help, "gauge")
+	for _, s := range samples {
+		fmt.Fprintf(b, "%s%s %s\n", g.name, formatLabels(g.labels, s.Labels, "", ""), formatValue(s.Value))
+	}
+}
+
+func writeHeader(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+}
+
+// labelKey junta os valores de label em uma chave de mapa
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func splitKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Escapes do formato de texto do Prometheus: nos valores de label apenas a
+// barra invertida, as aspas e a quebra de linha; no HELP, sem as aspas. Os
+// demais caracteres, inclusive os acentos, vão como UTF-8.
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// formatLabels monta {a="x",b="y"}, com um label extra opcional (le dos histogramas)
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,39 @@
+package participant
+
+import (
+	"time"
+
+	"saga/metrics"
+)
+
+// Resultados de um comando nas métricas
+const (
+	CommandResultSuccess  = "success"
+	CommandResultFailure  = "failure"
+	CommandResultReplayed = "replayed"
+	CommandResultError    = "error"
+)
+
+// commandMetrics conta os comandos recebidos e mede o processamento por CommandType
+type commandMetrics struct {
+	registry *metrics.Registry
+	total    *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+func newCommandMetrics() *commandMetrics {
+	registry := metrics.NewRegistry()
+	return &commandMetrics{
+		registry: registry,
+		total: registry.NewCounterVec("saga_commands_total",
+			"Comandos recebidos por tipo e resultado", "command_type", "result"),
+		duration: registry.NewHistogramVec("saga_command_duration_seconds",
+			"Tempo de processamento do comando, do recebimento ao envio do reply", "command_type"),
+	}
+}
+
+// observe registra o resultado e a duração de um comando recebido em start
+func (m *commandMetrics) observe(cmd *Command, result string, start time.Time) {
+	m.total.Inc(cmd.CommandType, result)
+	m.duration.ObserveSince(start, cmd.CommandType)
+}
@@ -0,0 +1,366 @@
+package participant
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+	"saga/deadletter"
+	"saga/ids"
+	"saga/protocol"
+	"saga/tracing"
+)
+
+// Handler executa um comando. O Result vira um reply de sucesso. Apenas as
+// recusas de negócio viram reply de falha: erros criados com Reject ou Fail e
+// erros de payload (protocol.Decode), que levam o error_code do protocolo.
+// Qualquer outro erro (banco, rede, transportadora) é tratado como falha de
+// infraestrutura: nada é registrado e a mensagem é tentada de novo e,
+// esgotadas as tentativas, desviada para o dead-letter. Com NoReply o comando
+// também não é registrado, mas a mensagem é confirmada.
+//
+// As escritas do comando são feitas em tx, a mesma transação que registra o
+// comando como processado: ou o comando é executado e registrado, ou nada
+// fica gravado. O handler não faz commit nem rollback; se ele retornar erro,
+// as escritas que fez em tx são desfeitas.
+type Handler func(ctx context.Context, tx *sql.Tx, cmd *Command) (*Result, error)
+
+// Result é o resultado de um comando executado com sucesso
+type Result struct {
+	Message string
+	// Data é o payload tipado do reply (ex.: protocol.StockReserved),
+	// mesclado nos dados do reply
+	Data interface{}
+}
+
+// commandHandler é um handler registrado e o papel do comando na SAGA
+type commandHandler struct {
+	handle       Handler
+	compensation bool
+}
+
+// rejection é uma recusa de negócio: repetir o comando não muda o resultado
+type rejection struct {
+	err error
+}
+
+func (r *rejection) Error() string { return r.err.Error() }
+func (r *rejection) Unwrap() error { return r.err }
+
+// Reject recusa o comando (ex.: pagamento recusado, produto não cadastrado).
+// O reply de falha é registrado e reenviado nas novas entregas do comando.
+func Reject(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &rejection{err: err}
+}
+
+// failure é uma recusa que leva dados adicionais no reply
+type failure struct {
+	err  error
+	data interface{}
+}
+
+func (f *failure) Error() string { return f.err.Error() }
+func (f *failure) Unwrap() error { return f.err }
+
+// Fail recusa o comando informando dados adicionais no reply, como o item
+// que faltou no estoque
+func Fail(err error, data interface{}) error {
+	return &failure{err: err, data: data}
+}
+
+// isRejection indica se err é uma recusa de negócio, que vira reply de falha
+func isRejection(err error) bool {
+	var rejected *rejection
+	var failed *failure
+	var payloadErr *protocol.PayloadError
+	return errors.As(err, &rejected) || errors.As(err, &failed) || errors.As(err, &payloadErr)
+}
+
+// noReply é um resultado que o participante não sabe responder
+type noReply struct {
+	err error
+}
+
+func (e *noReply) Error() string { return e.err.Error() }
+func (e *noReply) Unwrap() error { return e.err }
+
+// NoReply indica que o resultado do comando é desconhecido (ex.: gateway sem
+// resposta). Nenhum reply é enviado nem registrado: o watchdog do orquestrador
+// reenvia o comando e o handler é executado de novo.
+func NoReply(err error) error {
+	return &noReply{err: err}
+}
+
+// handleCommand processa um comando consumido. Erros são tentados de novo
+// e, esgotadas as tentativas, a mensagem vai para o dead-letter.
+func (p *Participant) handleCommand(ctx context.Context, message *sarama.ConsumerMessage) error {
+	var cmd Command
+	if err := json.Unmarshal(message.Value, &cmd); err != nil {
+		return deadletter.Permanent(fmt.Errorf("erro ao deserializar comando: %w", err))
+	}
+
+	log.Printf("Comando recebido: %s (SAGA: %s)", cmd.CommandType, cmd.SagaID)
+	start := time.Now()
+
+	// Span do processamento, filho do span do comando no orquestrador
+	span := p.tracer.Start("process "+cmd.CommandType, tracing.SpanKindConsumer, tracing.FromHeaders(message.Headers))
+	span.SetAttribute("saga.id", cmd.SagaID)
+	span.SetAttribute("saga.order_id", cmd.OrderID)
+	span.SetAttribute("saga.command_id", cmd.CommandID)
+	span.SetAttribute("messaging.source", message.Topic)
+	if p.handlers[cmd.CommandType].compensation {
+		span.SetAttribute("saga.compensation", true)
+	}
+
+	// fail encerra o processamento com erro: a mensagem não é confirmada e
+	// será tentada de novo
+	fail := func(err error) error {
+		span.SetError(err.Error())
+		span.Finish()
+		p.metrics.observe(&cmd, CommandResultError, start)
+		return err
+	}
+
+	// O contexto do consumo não é usado na transação: no encerramento o
+	// comando em processamento termina antes de o consumo parar
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return fail(fmt.Errorf("erro ao iniciar transação do comando %s: %w", cmd.CommandID, err))
+	}
+	defer tx.Rollback()
+
+	// Reivindicar o comando (reentrega do Kafka ou retry do orquestrador).
+	// Uma execução concorrente do mesmo comando espera aqui até a outra
+	// terminar e então recebe o reply registrado por ela.
+	reply, err := p.claimCommand(tx, &cmd)
+	if err != nil {
+		// Sem garantia de idempotência não processamos: a mensagem será tentada de novo
+		return fail(fmt.Errorf("erro ao verificar comando %s: %w", cmd.CommandID, err))
+	}
+
+	result := CommandResultSuccess
+	if reply != nil {
+		log.Printf("Comando %s já processado, reenviando reply registrado", cmd.CommandID)
+		span.SetAttribute("saga.replayed", true)
+		result = CommandResultReplayed
+		tx.Rollback()
+	} else {
+		fault := p.faults.Decide(&cmd)
+		fault.Wait()
+		if fault.Rule != "" {
+			span.SetAttribute("saga.injected_fault", fault.Rule)
+		}
+
+		// Processar comando, a menos que a falha seja injetada
+		if fault.Fail {
+			reply = fault.Reply(&cmd)
+		} else if reply, err = p.execute(ctx, tx, &cmd); err != nil {
+			var skip *noReply
+			if !errors.As(err, &skip) {
+				return fail(fmt.Errorf("erro ao executar comando %s: %w", cmd.CommandID, err))
+			}
+			// Resultado desconhecido: a reivindicação é desfeita junto com a
+			// transação e, sem reply, o orquestrador reenvia o comando
+			log.Printf("Comando %s sem reply, aguardando reenvio: %v", cmd.CommandID, skip.err)
+			span.SetError(skip.err.Error())
+			span.Finish()
+			p.metrics.observe(&cmd, CommandResultError, start)
+			return nil
+		}
+
+		// O reply é registrado no commit das escritas do handler
+		if err := p.saveProcessedReply(tx, &cmd, reply); err != nil {
+			return fail(fmt.Errorf("erro ao registrar comando processado %s: %w", cmd.CommandID, err))
+		}
+		if err := tx.Commit(); err != nil {
+			return fail(fmt.Errorf("erro ao registrar comando processado %s: %w", cmd.CommandID, err))
+		}
+
+		fault.Crash(&cmd)
+	}
+
+	if !reply.Success {
+		span.SetError(reply.Message)
+		if result == CommandResultSuccess {
+			result = CommandResultFailure
+		}
+	}
+
+	// Enviar resposta; na nova tentativa o reply registrado é reenviado
+	if err := p.sendReply(reply, span.Context); err != nil {
+		return fail(fmt.Errorf("erro ao enviar reply do comando %s: %w", cmd.CommandID, err))
+	}
+	span.Finish()
+	p.metrics.observe(&cmd, result, start)
+	return nil
+}
+
+// execute chama o handler do comando e monta o reply. Retorna erro quando o
+// handler pediu para não responder (NoReply), quando falhou sem ser uma
+// recusa ou quando o savepoint que isola as escritas do handler falha.
+func (p *Participant) execute(ctx context.Context, tx *sql.Tx, cmd *Command) (*Reply, error) {
+	reply := &Reply{
+		ReplyID:   ids.New(),
+		CommandID: cmd.CommandID,
+		SagaID:    cmd.SagaID,
+		Timestamp: time.Now(),
+		Data:      make(map[string]interface{}),
+	}
+
+	// Copiar payload para Data se existir
+	if p.config.EchoPayload {
+		for k, v := range cmd.Payload {
+			reply.Data[k] = v
+		}
+	}
+
+	// Uma recusa desfaz as escritas do handler, mas não a reivindicação do comando
+	if _, err := tx.Exec("SAVEPOINT command"); err != nil {
+		return nil, err
+	}
+
+	var result *Result
+	var err error
+	if handler, ok := p.handlers[cmd.CommandType]; ok {
+		result, err = handler.handle(ctx, tx, cmd)
+	} else {
+		err = Reject(fmt.Errorf("Comando desconhecido: %s", cmd.CommandType))
+	}
+
+	var skip *noReply
+	if errors.As(err, &skip) {
+		return nil, skip
+	}
+	if err != nil && !isRejection(err) {
+		// Falha de infraestrutura: a transação inteira, com a reivindicação do
+		// comando, é desfeita e a mensagem é tentada de novo
+		return nil, err
+	}
+	if err != nil {
+		if _, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT command"); rollbackErr != nil {
+			return nil, rollbackErr
+		}
+		reply.Reject(err)
+		var failed *failure
+		if errors.As(err, &failed) && failed.data != nil {
+			reply.SetData(failed.data)
+		}
+		log.Printf("❌ Falha no comando %s (SAGA: %s): %v", cmd.CommandType, cmd.SagaID, err)
+		return reply, nil
+	}
+
+	reply.Success = true
+	if result != nil {
+		reply.Message = result.Message
+		if result.Data != nil {
+			reply.SetData(result.Data)
+		}
+	}
+	return reply, nil
+}
+
+// sendReply envia uma resposta para o orquestrador, propagando o trace do comando
+func (p *Participant) sendReply(reply *Reply, sc tracing.SpanContext) error {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	// A chave mantém as mensagens da SAGA na mesma partição do tópico
+	msg := &sarama.ProducerMessage{
+		Topic:   p.config.ReplyTopic,
+		Key:     sarama.StringEncoder(reply.SagaID),
+		Value:   sarama.ByteEncoder(data),
+		Headers: tracing.Headers(sc),
+	}
+
+	_, _, err = p.Producer.SendMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reply enviado: Success=%t, Message=%s", reply.Success, reply.Message)
+	return nil
+}
+
+// initProcessedCommands cria a tabela com o reply de cada comando processado.
+// O reply é nulo apenas dentro da transação que reivindicou o comando.
+func initProcessedCommands(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS processed_commands (
+		command_id VARCHAR(100) PRIMARY KEY,
+		saga_id VARCHAR(100) NOT NULL,
+		command_type VARCHAR(50) NOT NULL,
+		reply JSONB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	ALTER TABLE processed_commands ALTER COLUMN reply DROP NOT NULL;
+	`)
+	return err
+}
+
+// claimCommand registra o comando como em processamento na transação. Se o
+// comando já foi processado, retorna o reply registrado. Comandos sem
+// command_id não são deduplicados.
+func (p *Participant) claimCommand(tx *sql.Tx, cmd *Command) (*Reply, error) {
+	if cmd.CommandID == "" {
+		return nil, nil
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO processed_commands (command_id, saga_id, command_type)
+		 VALUES ($1, $2, $3) ON CONFLICT (command_id) DO NOTHING`,
+		cmd.CommandID, cmd.SagaID, cmd.CommandType,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 1 {
+		return nil, err
+	}
+
+	var data []byte
+	err = tx.QueryRow(
+		"SELECT reply FROM processed_commands WHERE command_id = $1",
+		cmd.CommandID,
+	).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("comando %s registrado sem reply", cmd.CommandID)
+	}
+
+	var reply Reply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// saveProcessedReply registra o reply produzido para o comando reivindicado
+func (p *Participant) saveProcessedReply(tx *sql.Tx, cmd *Command, reply *Reply) error {
+	if cmd.CommandID == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE processed_commands SET reply = $2 WHERE command_id = $1",
+		cmd.CommandID, data,
+	)
+	return err
+}
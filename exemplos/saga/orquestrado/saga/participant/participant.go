@@ -0,0 +1,343 @@
+// Package participant reúne o que os serviços participantes da SAGA têm em
+// comum: conexão com o banco, producer e consumer group do Kafka, envio dos
+// replies, idempotência pelos comandos já processados, novas tentativas com
+// dead-letter, injeção de falhas, tracing, métricas e encerramento gracioso.
+//
+// O serviço cria o participante, registra um handler por CommandType e chama
+// Run:
+//
+//	p, err := participant.New(participant.Config{Name: "estoque"})
+//	...
+//	p.Handle(protocol.CommandReserveStock, service.reserveStock)
+//	p.Compensate(protocol.CommandReleaseStock, service.releaseStock)
+//	p.Run()
+package participant
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	_ "github.com/lib/pq"
+	"saga/deadletter"
+	"saga/faults"
+	"saga/protocol"
+	"saga/tracing"
+)
+
+// Command e Reply são as mensagens do protocolo da SAGA
+type (
+	Command = protocol.Command
+	Reply   = protocol.Reply
+)
+
+// Config descreve o participante. Apenas Name é obrigatório: os tópicos, o
+// consumer group e o banco padrão derivam dele.
+type Config struct {
+	// Name identifica o serviço nos logs, nos spans e nas métricas
+	Name string
+	// CommandTopic recebe os comandos do orquestrador (padrão "<Name>-commands")
+	CommandTopic string
+	// ReplyTopic recebe os replies enviados ao orquestrador (padrão "<Name>-reply")
+	ReplyTopic string
+	// Group é o consumer group, que também dá nome ao tópico de dead-letter
+	// (padrão "<Name>-group")
+	Group string
+	// EchoPayload copia o payload do comando nos dados do reply. O
+	// orquestrador acumula os dados dos replies e os repassa às etapas seguintes.
+	EchoPayload bool
+}
+
+// Participant consome os comandos de um serviço e os despacha aos handlers
+// registrados
+type Participant struct {
+	// DB é a conexão com o banco do serviço, que também guarda os comandos processados
+	DB *sql.DB
+	// Producer pode ser usado pelo serviço para publicar os próprios eventos
+	Producer sarama.SyncProducer
+
+	config   Config
+	consumer sarama.ConsumerGroup
+	faults   *faults.Config
+	tracer   *tracing.Tracer
+	metrics  *commandMetrics
+	// deadLetters recebe as mensagens que falharam em todas as tentativas
+	deadLetters *deadletter.Queue
+
+	handlers map[string]commandHandler
+	events   map[string]EventHandler
+	workers  []func(ctx context.Context)
+}
+
+// EventHandler trata as mensagens de um tópico de eventos assinado com
+// Subscribe. Erros seguem as mesmas novas tentativas e dead-letter dos comandos.
+type EventHandler func(data []byte) error
+
+// New conecta ao banco e ao Kafka e prepara a tabela de comandos processados.
+// A configuração do ambiente (DB_*, KAFKA_BROKERS, FAULTS*, OTEL_*, DLQ_*) é
+// a mesma de antes da biblioteca.
+func New(config Config) (*Participant, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("participante sem nome")
+	}
+	if config.CommandTopic == "" {
+		config.CommandTopic = config.Name + "-commands"
+	}
+	if config.ReplyTopic == "" {
+		config.ReplyTopic = config.Name + "-reply"
+	}
+	if config.Group == "" {
+		config.Group = config.Name + "-group"
+	}
+
+	p := &Participant{
+		config:   config,
+		metrics:  newCommandMetrics(),
+		handlers: make(map[string]commandHandler),
+		events:   make(map[string]EventHandler),
+	}
+
+	var err error
+	defer func() {
+		if err != nil {
+			p.close()
+		}
+	}()
+
+	// Conectar ao banco de dados
+	if p.DB, err = ConnectDB(config.Name); err != nil {
+		return nil, fmt.Errorf("erro ao conectar no banco: %w", err)
+	}
+	if err = initProcessedCommands(p.DB); err != nil {
+		return nil, fmt.Errorf("erro ao criar tabela de comandos processados: %w", err)
+	}
+
+	// Configurar Kafka Producer e Consumer
+	if p.Producer, err = NewProducer(); err != nil {
+		return nil, fmt.Errorf("erro ao configurar producer: %w", err)
+	}
+	if p.consumer, err = NewConsumerGroup(config.Group); err != nil {
+		return nil, fmt.Errorf("erro ao configurar consumer: %w", err)
+	}
+
+	// Carregar configuração de injeção de falhas
+	if p.faults, err = faults.Load(); err != nil {
+		return nil, fmt.Errorf("erro ao carregar configuração de falhas: %w", err)
+	}
+
+	// Configurar exportação dos traces
+	if p.tracer, err = tracing.New(config.Name); err != nil {
+		return nil, fmt.Errorf("erro ao configurar tracing: %w", err)
+	}
+
+	p.deadLetters = deadletter.NewQueue(p.Producer, config.Group)
+	return p, nil
+}
+
+// Handle registra o handler de um CommandType
+func (p *Participant) Handle(commandType string, handler Handler) {
+	p.handlers[commandType] = commandHandler{handle: handler}
+}
+
+// Compensate registra o handler de um comando de compensação. A compensação
+// pode chegar mais de uma vez e para uma etapa que não chegou a ser
+// executada, então o handler deve ser idempotente.
+func (p *Participant) Compensate(commandType string, handler Handler) {
+	p.handlers[commandType] = commandHandler{handle: handler, compensation: true}
+}
+
+// Subscribe consome também um tópico de eventos, no mesmo consumer group
+func (p *Participant) Subscribe(topic string, handler EventHandler) {
+	p.events[topic] = handler
+}
+
+// Go executa uma tarefa em segundo plano durante Run. O contexto é cancelado
+// no encerramento e Run espera a tarefa retornar.
+func (p *Participant) Go(worker func(ctx context.Context)) {
+	p.workers = append(p.workers, worker)
+}
+
+// Run consome os comandos até receber SIGINT ou SIGTERM e então encerra o
+// consumo, as tarefas, o servidor de métricas e as conexões
+func (p *Participant) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.consume(ctx)
+	}()
+	for _, worker := range p.workers {
+		wg.Add(1)
+		go func(worker func(ctx context.Context)) {
+			defer wg.Done()
+			worker(ctx)
+		}(worker)
+	}
+
+	// Expor métricas para o Prometheus
+	metricsServer := p.metrics.registry.Serve(Env("METRICS_PORT", "9100"))
+
+	// Aguardar sinal de término
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	<-sigterm
+
+	log.Printf("Encerrando serviço %s...", p.config.Name)
+
+	// A mensagem em processamento termina antes do consumo parar
+	cancel()
+	wg.Wait()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Erro ao encerrar servidor de métricas: %v", err)
+	}
+
+	p.close()
+}
+
+// close libera o que New conseguiu abrir
+func (p *Participant) close() {
+	if p.consumer != nil {
+		if err := p.consumer.Close(); err != nil {
+			log.Printf("Erro ao encerrar consumer: %v", err)
+		}
+	}
+	p.tracer.Shutdown()
+	if p.Producer != nil {
+		if err := p.Producer.Close(); err != nil {
+			log.Printf("Erro ao encerrar producer: %v", err)
+		}
+	}
+	if p.DB != nil {
+		p.DB.Close()
+	}
+}
+
+// consume consome os comandos e os tópicos assinados até o contexto ser cancelado
+func (p *Participant) consume(ctx context.Context) {
+	topics := []string{p.config.CommandTopic}
+	for topic := range p.events {
+		topics = append(topics, topic)
+	}
+	handler := &consumerHandler{participant: p}
+
+	for {
+		if err := p.consumer.Consume(ctx, topics, handler); err != nil {
+			log.Printf("Erro ao consumir mensagens: %v", err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// consumerHandler implementa sarama.ConsumerGroupHandler
+type consumerHandler struct {
+	participant *Participant
+}
+
+func (h *consumerHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
+func (h *consumerHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
+
+func (h *consumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	p := h.participant
+	for message := range claim.Messages() {
+		err := p.deadLetters.Handle(session, message, func() error {
+			if handler, ok := p.events[message.Topic]; ok {
+				return handler(message.Value)
+			}
+			return p.handleCommand(session.Context(), message)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectDB conecta ao Postgres configurado por DB_* (DB_NAME padrão: name),
+// esperando o banco ficar disponível. Também é usado pelos serviços da
+// versão coreografada.
+func ConnectDB(name string) (*sql.DB, error) {
+	host := Env("DB_HOST", "localhost")
+	port := Env("DB_PORT", "5432")
+	user := Env("DB_USER", "postgres")
+	password := Env("DB_PASSWORD", "postgres")
+	dbname := Env("DB_NAME", name)
+
+	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tentar conectar com retry
+	for i := 0; i < 30; i++ {
+		if err = db.Ping(); err == nil {
+			log.Println("Conectado ao banco de dados")
+			return db, nil
+		}
+		log.Printf("⏳ Aguardando banco de dados... (%d/30)", i+1)
+		time.Sleep(2 * time.Second)
+	}
+
+	db.Close()
+	return nil, fmt.Errorf("timeout ao conectar no banco")
+}
+
+// NewProducer cria o producer síncrono do Kafka de KAFKA_BROKERS
+func NewProducer() (sarama.SyncProducer, error) {
+	brokers := []string{Env("KAFKA_BROKERS", "localhost:9092")}
+
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 5
+
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Kafka Producer configurado")
+	return producer, nil
+}
+
+// NewConsumerGroup cria o consumer group do Kafka de KAFKA_BROKERS
+func NewConsumerGroup(group string) (sarama.ConsumerGroup, error) {
+	brokers := []string{Env("KAFKA_BROKERS", "localhost:9092")}
+
+	config := sarama.NewConfig()
+	config.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	consumer, err := sarama.NewConsumerGroup(brokers, group, config)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Kafka Consumer configurado")
+	return consumer, nil
+}
+
+// Env retorna a variável de ambiente ou o valor padrão, se ela estiver vazia
+func Env(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
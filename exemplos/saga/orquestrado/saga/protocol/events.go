@@ -0,0 +1,41 @@
+package protocol
+
+import "time"
+
+// Status do ciclo de vida de uma entrega. SCHEDULED é o status após o
+// agendamento; DELIVERED e RETURNED são finais.
+const (
+	DeliveryStatusScheduled  = "SCHEDULED"
+	DeliveryStatusDispatched = "DISPATCHED"
+	DeliveryStatusDelivered  = "DELIVERED"
+	DeliveryStatusReturned   = "RETURNED"
+	DeliveryStatusCancelled  = "CANCELLED"
+)
+
+// DeliveryEvent é publicado pelo serviço de entregas a cada mudança de status
+// de uma entrega. A entrega é at-least-once: o mesmo evento pode chegar mais
+// de uma vez e EventID (entrega + status) permite descartar as repetições.
+type DeliveryEvent struct {
+	EventID        string `json:"event_id"`
+	DeliveryID     string `json:"delivery_id"`
+	SagaID         string `json:"saga_id"`
+	OrderID        string `json:"order_id"`
+	Status         string `json:"status"`
+	TrackingNumber string `json:"tracking_number"`
+	Carrier        string `json:"carrier"`
+	// Reason explica devoluções e recusas da transportadora
+	Reason     string    `json:"reason,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// NewDeliveryEvent monta o evento do status informado
+func NewDeliveryEvent(deliveryID, sagaID, orderID, status string) *DeliveryEvent {
+	return &DeliveryEvent{
+		EventID:    deliveryID + ":" + status,
+		DeliveryID: deliveryID,
+		SagaID:     sagaID,
+		OrderID:    orderID,
+		Status:     status,
+		OccurredAt: time.Now().UTC(),
+	}
+}
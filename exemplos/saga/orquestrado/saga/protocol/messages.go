@@ -0,0 +1,96 @@
+// Package protocol define as mensagens trocadas entre o orquestrador e os
+// participantes da SAGA: o envelope de comandos e replies e os payloads
+// tipados e versionados de cada tipo de comando.
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Tipos de comando da SAGA de pedidos
+const (
+	CommandValidateOrder    = "VALIDATE_ORDER"
+	CommandCancelOrder      = "CANCEL_ORDER"
+	CommandReserveStock     = "RESERVE_STOCK"
+	CommandReleaseStock     = "RELEASE_STOCK"
+	CommandProcessPayment   = "PROCESS_PAYMENT"
+	CommandCapturePayment   = "CAPTURE_PAYMENT"
+	CommandCancelPayment    = "CANCEL_PAYMENT"
+	CommandRefundPayment    = "REFUND_PAYMENT"
+	CommandScheduleDelivery = "SCHEDULE_DELIVERY"
+	CommandCancelDelivery   = "CANCEL_DELIVERY"
+)
+
+// Command é o comando enviado pelo orquestrador a um participante. O Payload
+// acumula os dados das etapas anteriores; cada participante lê dele o payload
+// tipado do seu comando com Decode.
+type Command struct {
+	CommandID   string `json:"command_id"`
+	SagaID      string `json:"saga_id"`
+	OrderID     string `json:"order_id"`
+	CommandType string `json:"command_type"`
+	// PayloadVersion é a versão do schema do payload; ausente equivale a 1
+	PayloadVersion int                    `json:"payload_version,omitempty"`
+	Payload        map[string]interface{} `json:"payload"`
+	Timestamp      time.Time              `json:"timestamp"`
+}
+
+// Version retorna a versão do payload, tratando a ausência como versão 1
+func (c *Command) Version() int {
+	if c.PayloadVersion == 0 {
+		return 1
+	}
+	return c.PayloadVersion
+}
+
+// Reply é a resposta do participante ao orquestrador
+type Reply struct {
+	ReplyID   string                 `json:"reply_id"`
+	CommandID string                 `json:"command_id"`
+	SagaID    string                 `json:"saga_id"`
+	Success   bool                   `json:"success"`
+	Message   string                 `json:"message"`
+	Data      map[string]interface{} `json:"data"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// SetData copia os campos de v (um struct de reply tipado) para Data,
+// preservando os dados já acumulados
+func (r *Reply) SetData(v interface{}) error {
+	fields, err := toMap(v)
+	if err != nil {
+		return err
+	}
+
+	if r.Data == nil {
+		r.Data = make(map[string]interface{}, len(fields))
+	}
+	for k, value := range fields {
+		r.Data[k] = value
+	}
+	return nil
+}
+
+// toMap converte um struct no mapa equivalente ao seu JSON
+func toMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// fromMap preenche v a partir do mapa, como se ele tivesse vindo em JSON
+func fromMap(fields map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
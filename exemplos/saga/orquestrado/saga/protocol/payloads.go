@@ -0,0 +1,279 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Payload é o payload tipado de um comando, na versão atual do schema
+type Payload interface {
+	Validate() error
+}
+
+// LineItem é um item do pedido: produto e quantidade
+type LineItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+// PricedItem é um item do pedido com o preço unitário do catálogo
+type PricedItem struct {
+	ProductID      string `json:"product_id"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+}
+
+// Total retorna o valor do item em centavos
+func (i PricedItem) Total() int64 {
+	return i.UnitPriceCents * int64(i.Quantity)
+}
+
+// ValidateOrder é o payload de VALIDATE_ORDER (v2): o pedido recebido. O
+// valor não vem do cliente; ele é calculado a partir dos itens.
+type ValidateOrder struct {
+	OrderID    string     `json:"order_id,omitempty"`
+	CustomerID string     `json:"customer_id"`
+	Items      []LineItem `json:"items"`
+	CardNumber string     `json:"card_number"`
+	Address    string     `json:"address"`
+}
+
+func (p *ValidateOrder) Validate() error {
+	var errs fieldErrors
+	errs.required("customer_id", p.CustomerID)
+	errs.items(p.Items)
+	errs.required("card_number", p.CardNumber)
+	errs.required("address", p.Address)
+	return errs.err()
+}
+
+// upgradeSingleItemV1 converte product_id/quantity da v1 em uma lista com um
+// único item (VALIDATE_ORDER e RESERVE_STOCK). Um comando v1 cujo payload já
+// traz items (dados de um pedidos atualizado) é mantido como está.
+func upgradeSingleItemV1(fields map[string]interface{}) (map[string]interface{}, error) {
+	if _, ok := fields["product_id"]; !ok && fields["items"] != nil {
+		return fields, nil
+	}
+
+	var v1 LineItem
+	if err := fromMap(fields, &v1); err != nil {
+		return nil, err
+	}
+
+	upgraded := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		upgraded[k] = v
+	}
+	upgraded["items"] = []interface{}{
+		map[string]interface{}{"product_id": v1.ProductID, "quantity": v1.Quantity},
+	}
+	return upgraded, nil
+}
+
+// OrderValidated são os dados do reply de VALIDATE_ORDER: os itens com os
+// preços do catálogo e o valor calculado a partir deles. Leva total_amount
+// (PROCESS_PAYMENT v1) e amount_cents/currency (v2) enquanto as duas versões
+// estiverem em uso.
+type OrderValidated struct {
+	OrderID     string       `json:"order_id"`
+	CustomerID  string       `json:"customer_id"`
+	Items       []PricedItem `json:"items"`
+	TotalAmount float64      `json:"total_amount"`
+	AmountCents int64        `json:"amount_cents"`
+	Currency    string       `json:"currency"`
+	CardNumber  string       `json:"card_number"`
+	Address     string       `json:"address"`
+}
+
+// ReserveStock é o payload de RESERVE_STOCK (v2). A v1 trazia um único
+// product_id/quantity e é convertida em uma lista com um item.
+type ReserveStock struct {
+	Items []LineItem `json:"items"`
+}
+
+func (p *ReserveStock) Validate() error {
+	var errs fieldErrors
+	errs.items(p.Items)
+	return errs.err()
+}
+
+// StockReserved são os dados do reply de RESERVE_STOCK bem-sucedido: uma
+// reserva por item
+type StockReserved struct {
+	ReservationIDs []string `json:"reservation_ids"`
+}
+
+// StockShortage são os dados do reply de RESERVE_STOCK sem saldo
+type StockShortage struct {
+	ShortItem ShortItem `json:"short_item"`
+}
+
+// ShortItem descreve o item que impediu a reserva
+type ShortItem struct {
+	ProductID string `json:"product_id"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// ProcessPayment é o payload de PROCESS_PAYMENT (v2). A v1 trazia o valor
+// em total_amount (reais, ponto flutuante) e é convertida para centavos.
+type ProcessPayment struct {
+	OrderID     string `json:"order_id"`
+	AmountCents int64  `json:"amount_cents"`
+	Currency    string `json:"currency"`
+	CardNumber  string `json:"card_number"`
+}
+
+func (p *ProcessPayment) Validate() error {
+	var errs fieldErrors
+	errs.required("order_id", p.OrderID)
+	errs.positive("amount_cents", float64(p.AmountCents))
+	errs.check(len(p.Currency) == 3, "currency deve ser um código ISO 4217")
+	errs.required("card_number", p.CardNumber)
+	return errs.err()
+}
+
+// Amount retorna o valor em reais
+func (p *ProcessPayment) Amount() float64 {
+	return float64(p.AmountCents) / 100
+}
+
+// processPaymentV1 é o formato antigo de PROCESS_PAYMENT
+type processPaymentV1 struct {
+	TotalAmount float64 `json:"total_amount"`
+}
+
+// upgradeProcessPaymentV1 converte total_amount em amount_cents (BRL)
+func upgradeProcessPaymentV1(fields map[string]interface{}) (map[string]interface{}, error) {
+	var v1 processPaymentV1
+	if err := fromMap(fields, &v1); err != nil {
+		return nil, err
+	}
+
+	var errs fieldErrors
+	errs.positive("total_amount", v1.TotalAmount)
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+
+	upgraded := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		upgraded[k] = v
+	}
+	upgraded["amount_cents"] = ToCents(v1.TotalAmount)
+	upgraded["currency"] = "BRL"
+	return upgraded, nil
+}
+
+// PaymentAuthorized são os dados do reply de PROCESS_PAYMENT
+type PaymentAuthorized struct {
+	PaymentID     string `json:"payment_id"`
+	TransactionID string `json:"transaction_id"`
+}
+
+// PaymentCaptured são os dados do reply de CAPTURE_PAYMENT
+type PaymentCaptured struct {
+	CaptureID      string  `json:"capture_id"`
+	CapturedAmount float64 `json:"captured_amount"`
+}
+
+// PaymentCancelled são os dados do reply de CANCEL_PAYMENT
+type PaymentCancelled struct {
+	// Compensation é a ação aplicada: VOID, REFUND ou NONE
+	Compensation string `json:"compensation"`
+}
+
+// RefundPayment é o payload de REFUND_PAYMENT (v1): estorno de um pagamento
+// já capturado, pedido depois da conclusão da SAGA (ex: entrega devolvida)
+type RefundPayment struct {
+	Reason     string `json:"reason"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+}
+
+func (p *RefundPayment) Validate() error {
+	var errs fieldErrors
+	errs.required("reason", p.Reason)
+	return errs.err()
+}
+
+// PaymentRefunded são os dados do reply de REFUND_PAYMENT
+type PaymentRefunded struct {
+	RefundID       string  `json:"refund_id"`
+	RefundedAmount float64 `json:"refunded_amount"`
+}
+
+// ScheduleDelivery é o payload de SCHEDULE_DELIVERY (v1)
+type ScheduleDelivery struct {
+	OrderID string `json:"order_id"`
+	Address string `json:"address"`
+}
+
+func (p *ScheduleDelivery) Validate() error {
+	var errs fieldErrors
+	errs.required("order_id", p.OrderID)
+	errs.required("address", p.Address)
+	return errs.err()
+}
+
+// DeliveryScheduled são os dados do reply de SCHEDULE_DELIVERY
+type DeliveryScheduled struct {
+	DeliveryID     string `json:"delivery_id"`
+	TrackingNumber string `json:"tracking_number"`
+	ScheduledDate  string `json:"scheduled_date"`
+}
+
+// ErrorCodeAwaitingReturn identifica a recusa de CANCEL_DELIVERY de uma
+// entrega já despachada: a transportadora a devolve ao remetente e o
+// cancelamento deve ser repetido depois da devolução
+const ErrorCodeAwaitingReturn = "awaiting_return"
+
+// DeliveryAwaitingReturn são os dados do reply de CANCEL_DELIVERY recusado
+// enquanto a entrega despachada volta ao remetente
+type DeliveryAwaitingReturn struct {
+	ErrorCode      string `json:"error_code"`
+	DeliveryID     string `json:"delivery_id"`
+	TrackingNumber string `json:"tracking_number"`
+}
+
+// ToCents converte um valor em reais para centavos, arredondando
+func ToCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// fieldErrors acumula os problemas encontrados na validação de um payload
+type fieldErrors []string
+
+func (e *fieldErrors) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*e = append(*e, fmt.Sprintf(format, args...))
+	}
+}
+
+func (e *fieldErrors) required(field, value string) {
+	e.check(strings.TrimSpace(value) != "", "%s é obrigatório", field)
+}
+
+func (e *fieldErrors) positive(field string, value float64) {
+	e.check(value > 0, "%s deve ser maior que zero", field)
+}
+
+// items exige ao menos um item, sem produtos repetidos
+func (e *fieldErrors) items(items []LineItem) {
+	e.check(len(items) > 0, "items deve ter ao menos um item")
+
+	seen := make(map[string]bool, len(items))
+	for i, item := range items {
+		e.required(fmt.Sprintf("items[%d].product_id", i), item.ProductID)
+		e.positive(fmt.Sprintf("items[%d].quantity", i), float64(item.Quantity))
+		e.check(!seen[item.ProductID], "items[%d]: produto %s repetido", i, item.ProductID)
+		seen[item.ProductID] = true
+	}
+}
+
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(e, "; "))
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Regras de compatibilidade entre versões de um payload:
+//   - uma nova versão ganha o número seguinte e vira a versão atual do tipo;
+//   - o participante decodifica qualquer versão entre 1 e a atual, convertendo
+//     as antigas com as funções de upgrade, e rejeita versões futuras;
+//   - o orquestrador só envia a nova versão (payload_version na definição da
+//     SAGA) depois que todos os participantes do comando foram atualizados;
+//   - quem produz os dados de um payload (o reply da etapa anterior) passa a
+//     enviar os campos novos sem remover os antigos até o fim da migração.
+
+// ErrorCodeInvalidPayload identifica nos dados do reply a rejeição do payload
+const ErrorCodeInvalidPayload = "invalid_payload"
+
+// schema descreve as versões aceitas de um tipo de comando
+type schema struct {
+	latest int
+	// upgrades[n] converte o payload da versão n para a versão n+1
+	upgrades map[int]upgradeFunc
+}
+
+// upgradeFunc converte os campos de um payload para a versão seguinte
+type upgradeFunc func(map[string]interface{}) (map[string]interface{}, error)
+
+var schemas = map[string]schema{
+	CommandValidateOrder: {
+		latest:   2,
+		upgrades: map[int]upgradeFunc{1: upgradeSingleItemV1},
+	},
+	CommandCancelOrder: {latest: 1},
+	CommandReserveStock: {
+		latest:   2,
+		upgrades: map[int]upgradeFunc{1: upgradeSingleItemV1},
+	},
+	CommandReleaseStock: {latest: 1},
+	CommandProcessPayment: {
+		latest:   2,
+		upgrades: map[int]upgradeFunc{1: upgradeProcessPaymentV1},
+	},
+	CommandCapturePayment:   {latest: 1},
+	CommandCancelPayment:    {latest: 1},
+	CommandRefundPayment:    {latest: 1},
+	CommandScheduleDelivery: {latest: 1},
+	CommandCancelDelivery:   {latest: 1},
+}
+
+// LatestVersion retorna a versão atual do payload do tipo de comando
+func LatestVersion(commandType string) (int, bool) {
+	s, ok := schemas[commandType]
+	return s.latest, ok
+}
+
+// PayloadError indica um payload que não pode ser processado
+type PayloadError struct {
+	CommandType string
+	Version     int
+	Reason      string
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("payload inválido para %s v%d: %s", e.CommandType, e.Version, e.Reason)
+}
+
+// Decode lê o payload do comando em v, convertendo versões antigas para a
+// atual e validando o resultado
+func Decode(cmd *Command, v Payload) error {
+	version := cmd.Version()
+	fail := func(reason string) error {
+		return &PayloadError{CommandType: cmd.CommandType, Version: version, Reason: reason}
+	}
+
+	s, ok := schemas[cmd.CommandType]
+	if !ok {
+		return fail("tipo de comando desconhecido")
+	}
+	if version < 1 || version > s.latest {
+		return fail(fmt.Sprintf("versão não suportada (aceitas: 1 a %d)", s.latest))
+	}
+
+	fields := cmd.Payload
+	for n := version; n < s.latest; n++ {
+		var err error
+		if fields, err = s.upgrades[n](fields); err != nil {
+			return fail(err.Error())
+		}
+	}
+
+	if err := fromMap(fields, v); err != nil {
+		return fail(err.Error())
+	}
+	if err := v.Validate(); err != nil {
+		return fail(err.Error())
+	}
+	return nil
+}
+
+// Reject marca o reply como falho pelo erro informado. Payloads inválidos
+// levam error_code para que a falha seja distinguível de uma recusa de negócio.
+func (r *Reply) Reject(err error) {
+	r.Success = false
+	r.Message = err.Error()
+
+	var payloadErr *PayloadError
+	if errors.As(err, &payloadErr) {
+		if r.Data == nil {
+			r.Data = make(map[string]interface{})
+		}
+		r.Data["error_code"] = ErrorCodeInvalidPayload
+	}
+}
@@ -0,0 +1,425 @@
+// Package tracing implementa o rastreamento distribuído da SAGA no formato
+// W3C Trace Context. O contexto viaja no header "traceparent" das mensagens
+// do Kafka e os spans são exportados via OTLP/HTTP (JSON), no stdout ou em
+// arquivo, conforme OTEL_TRACES_EXPORTER.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const traceparentHeader = "traceparent"
+
+// SpanKind segue a numeração do OTLP
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+	SpanKindProducer SpanKind = 4
+	SpanKindConsumer SpanKind = 5
+)
+
+// TraceID identifica um trace (16 bytes)
+type TraceID [16]byte
+
+// SpanID identifica um span dentro do trace (8 bytes)
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool   { return s != SpanID{} }
+
+// NewTraceID gera um trace ID aleatório
+func NewTraceID() TraceID {
+	var t TraceID
+	rand.Read(t[:])
+	return t
+}
+
+// NewSpanID gera um span ID aleatório
+func NewSpanID() SpanID {
+	var s SpanID
+	rand.Read(s[:])
+	return s
+}
+
+// ParseTraceID lê um trace ID em hexadecimal
+func ParseTraceID(value string) (TraceID, bool) {
+	var t TraceID
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != len(t) {
+		return t, false
+	}
+	copy(t[:], b)
+	return t, t.IsValid()
+}
+
+// ParseSpanID lê um span ID em hexadecimal
+func ParseSpanID(value string) (SpanID, bool) {
+	var s SpanID
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != len(s) {
+		return s, false
+	}
+	copy(s[:], b)
+	return s, s.IsValid()
+}
+
+// SpanContext é a parte do span propagada entre serviços
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent formata o contexto no header W3C (sempre amostrado)
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceparent lê o header W3C "versão-traceid-spanid-flags"
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+
+	traceID, ok := ParseTraceID(parts[1])
+	if !ok {
+		return SpanContext{}, false
+	}
+	spanID, ok := ParseSpanID(parts[2])
+	if !ok {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: traceID, SpanID: spanID}, true
+}
+
+// Headers monta os headers Kafka que propagam o contexto
+func Headers(sc SpanContext) []sarama.RecordHeader {
+	if !sc.IsValid() {
+		return nil
+	}
+	return []sarama.RecordHeader{{Key: []byte(traceparentHeader), Value: []byte(sc.Traceparent())}}
+}
+
+// FromHeaders extrai o contexto de uma mensagem consumida
+func FromHeaders(headers []*sarama.RecordHeader) SpanContext {
+	for _, h := range headers {
+		if h != nil && string(h.Key) == traceparentHeader {
+			sc, _ := ParseTraceparent(string(h.Value))
+			return sc
+		}
+	}
+	return SpanContext{}
+}
+
+// Span é uma operação com início e fim dentro de um trace
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+
+	tracer *Tracer
+}
+
+// SetAttribute registra um atributo (texto, número ou booleano)
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marca o span como falho
+func (s *Span) SetError(message string) {
+	s.Error = message
+}
+
+// Finish encerra o span e o entrega ao exportador
+func (s *Span) Finish() {
+	if s.End.IsZero() {
+		s.End = time.Now()
+	}
+	if s.tracer != nil {
+		s.tracer.Record(s)
+	}
+}
+
+// spanExporter envia um lote de spans para o destino configurado
+type spanExporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// Tracer cria spans e os exporta em lotes, em segundo plano
+type Tracer struct {
+	service  string
+	exporter spanExporter
+	queue    chan *Span
+	done     chan struct{}
+	once     sync.Once
+}
+
+// New configura o exportador a partir das variáveis OTEL_*:
+//   - OTEL_TRACES_EXPORTER: otlp, console, file ou none (padrão)
+//   - OTEL_EXPORTER_OTLP_ENDPOINT: coletor OTLP/HTTP (padrão http://localhost:4318)
+//   - OTEL_TRACES_FILE: arquivo do exportador file (padrão traces.jsonl)
+//   - OTEL_SERVICE_NAME: nome do serviço nos spans
+func New(service string) (*Tracer, error) {
+	t := &Tracer{
+		service: getEnv("OTEL_SERVICE_NAME", service),
+		queue:   make(chan *Span, 1024),
+		done:    make(chan struct{}),
+	}
+
+	switch kind := getEnv("OTEL_TRACES_EXPORTER", "none"); kind {
+	case "none":
+		close(t.done)
+		return t, nil
+	case "otlp":
+		endpoint := getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+			strings.TrimRight(getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"), "/")+"/v1/traces")
+		t.exporter = &otlpExporter{endpoint: endpoint, client: &http.Client{Timeout: 5 * time.Second}}
+		log.Printf("Tracing: exportando spans via OTLP para %s", endpoint)
+	case "console":
+		t.exporter = &jsonLinesExporter{w: os.Stdout}
+		log.Println("Tracing: exportando spans no stdout")
+	case "file":
+		path := getEnv("OTEL_TRACES_FILE", "traces.jsonl")
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		t.exporter = &jsonLinesExporter{w: f}
+		log.Printf("Tracing: exportando spans em %s", path)
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER inválido: %s", kind)
+	}
+
+	go t.run()
+	return t, nil
+}
+
+// Start inicia um span filho de parent ou, sem parent, a raiz de um novo trace
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext) *Span {
+	span := &Span{
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if parent.IsValid() {
+		span.Context = SpanContext{TraceID: parent.TraceID, SpanID: NewSpanID()}
+		span.Parent = parent.SpanID
+	} else {
+		span.Context = SpanContext{TraceID: NewTraceID(), SpanID: NewSpanID()}
+	}
+	return span
+}
+
+// Record entrega um span já encerrado ao exportador. Spans excedentes são
+// descartados para não bloquear o processamento das mensagens.
+func (t *Tracer) Record(span *Span) {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		log.Printf("Tracing: fila cheia, span %s descartado", span.Name)
+	}
+}
+
+// Shutdown exporta os spans pendentes e encerra o exportador
+func (t *Tracer) Shutdown() {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	t.once.Do(func() { close(t.queue) })
+
+	select {
+	case <-t.done:
+	case <-time.After(5 * time.Second):
+		log.Println("Tracing: timeout ao exportar os spans pendentes")
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.service, batch); err != nil {
+			log.Printf("Tracing: erro ao exportar %d span(s): %v", len(batch), err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= 100 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// jsonLinesExporter grava um span por linha, para uso sem coletor
+type jsonLinesExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *jsonLinesExporter) Export(service string, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		line := map[string]interface{}{
+			"service":     service,
+			"trace_id":    s.Context.TraceID.String(),
+			"span_id":     s.Context.SpanID.String(),
+			"name":        s.Name,
+			"kind":        s.Kind,
+			"start":       s.Start.Format(time.RFC3339Nano),
+			"duration_ms": float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			"attributes":  s.Attributes,
+		}
+		if s.Parent.IsValid() {
+			line["parent_span_id"] = s.Parent.String()
+		}
+		if s.Error != "" {
+			line["error"] = s.Error
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter envia os spans no formato OTLP/HTTP com codificação JSON
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch val := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": val}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(val)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": val}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+	return kvs
+}
+
+func (e *otlpExporter) Export(service string, spans []*Span) error {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           s.Context.TraceID.String(),
+			"spanId":            s.Context.SpanID.String(),
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+		if s.Parent.IsValid() {
+			span["parentSpanId"] = s.Parent.String()
+		}
+		if s.Error != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.Error}
+		}
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": service}),
+			},
+			"scopeSpans": []map[string]interface{}{{
+				"scope": map[string]interface{}{"name": "saga"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("coletor respondeu %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
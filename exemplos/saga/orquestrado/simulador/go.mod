@@ -2,7 +2,10 @@ module simulador
 
 go 1.23
 
-require github.com/IBM/sarama v1.43.0
+require (
+	github.com/IBM/sarama v1.43.0
+	saga v0.0.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -24,3 +27,6 @@ require (
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/net v0.22.0 // indirect
 )
+
+// Pacotes compartilhados entre os serviços da SAGA
+replace saga => ../saga
@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/IBM/sarama"
+	"saga/ids"
 )
 
 // Cores ANSI para output colorido
@@ -42,25 +45,76 @@ type Reply struct {
 	Timestamp time.Time              `json:"timestamp"`
 }
 
+// monitoredMessage cobre os replies da versão orquestrada e os eventos de
+// domínio da versão coreografada
+type monitoredMessage struct {
+	Reply
+	EventType string `json:"event_type"`
+	Source    string `json:"source"`
+	Status    string `json:"status"`
+}
+
+// defaultMonitorTopics são os tópicos de reply da versão orquestrada
+const defaultMonitorTopics = "pedido-saga-pedido-processado,pedidos-reply,estoque-reply,pagamentos-reply,entregas-reply"
+
+// faultScenario é um cenário de falha do faults.json, ativado pelo prefixo
+// do order_id
+type faultScenario struct {
+	Tag         string
+	Description string
+}
+
+// faultScenarios acompanham as regras do faults.json da stack
+var faultScenarios = []faultScenario{
+	{"FAIL-ORDER", "Falha na validação do pedido"},
+	{"FAIL-STOCK", "Falha na reserva de estoque (pagamento é cancelado)"},
+	{"FAIL-PAYMENT", "Falha no pagamento (estoque é liberado)"},
+	{"FAIL-DELIVERY", "Falha no agendamento da entrega (compensa estoque e pagamento)"},
+	{"FAIL-COMPENSATION", "Falha no estoque e no cancelamento do pagamento (COMPENSATION_FAILED)"},
+	{"SLOW-DELIVERY", "Entrega responde após o timeout (reenvio pelo watchdog)"},
+	{"CRASH-STOCK", "Estoque cai após gravar e antes de responder (reentrega do Kafka)"},
+}
+
 // Simulator gerencia a simulação de testes da SAGA
 type Simulator struct {
 	producer sarama.SyncProducer
 	brokers  []string
+	// orderTag prefixa o order_id de todos os pedidos enviados (ORDER_TAG)
+	orderTag string
 }
 
 func main() {
+	scenarioPath := flag.String("scenario", "", "arquivo de cenário para execução não interativa")
+	flag.Parse()
+
 	printHeader()
 
 	brokers := []string{getEnv("KAFKA_BROKERS", "localhost:9092")}
 
 	sim := &Simulator{
-		brokers: brokers,
+		brokers:  brokers,
+		orderTag: getEnv("ORDER_TAG", ""),
+	}
+
+	if sim.orderTag != "" {
+		fmt.Printf("%sPedidos marcados com o cenário %s%s\n\n", ColorYellow, sim.orderTag, ColorReset)
 	}
 
 	// Configurar producer
 	if err := sim.setupProducer(); err != nil {
+		if *scenarioPath != "" {
+			fmt.Printf("%sErro ao configurar Kafka producer: %v%s\n", ColorRed, err, ColorReset)
+			os.Exit(ExitError)
+		}
 		log.Fatalf("%sErro ao configurar Kafka producer: %v%s\n", ColorRed, err, ColorReset)
 	}
+
+	// Modo não interativo: o código de saída indica se o cenário passou
+	if *scenarioPath != "" {
+		code := sim.runScenario(*scenarioPath)
+		sim.producer.Close()
+		os.Exit(code)
+	}
 	defer sim.producer.Close()
 
 	// Menu principal
@@ -99,8 +153,9 @@ func (s *Simulator) showMenu() {
 		fmt.Println("1) Enviar 1 pedido (alta chance de sucesso)")
 		fmt.Println("2) Enviar 20 pedidos (para forçar falhas)")
 		fmt.Println("3) Enviar N pedidos customizados")
-		fmt.Println("4) Monitorar tópicos de reply")
-		fmt.Println("5) Sair")
+		fmt.Println("4) Enviar pedido de um cenário de falha")
+		fmt.Println("5) Monitorar tópicos de reply")
+		fmt.Println("6) Sair")
 		fmt.Println()
 		fmt.Print("Opção: ")
 
@@ -116,8 +171,10 @@ func (s *Simulator) showMenu() {
 		case 3:
 			s.sendCustomOrders()
 		case 4:
-			s.monitorReplies()
+			s.sendScenarioOrder()
 		case 5:
+			s.monitorReplies()
+		case 6:
 			fmt.Printf("%sEncerrando simulador...%s\n", ColorGreen, ColorReset)
 			return
 		default:
@@ -127,18 +184,24 @@ func (s *Simulator) showMenu() {
 }
 
 func (s *Simulator) sendSingleOrder() {
-	orderID := generateID()
+	s.sendOrder(s.newOrderID(s.orderTag))
+}
+
+// sendOrder envia o pedido padrão com o order_id informado
+func (s *Simulator) sendOrder(orderID string) {
 
 	fmt.Printf("%sEnviando pedido único...%s\n", ColorBlue, ColorReset)
 	fmt.Printf("Order ID: %s%s%s\n\n", ColorPurple, orderID, ColorReset)
 
 	orderData := map[string]interface{}{
-		"order_id":     orderID,
-		"customer_id":  "CUST-001",
-		"product_id":   "PROD-001",
-		"quantity":     1,
-		"total_amount": 299.99,
-		"address":      "Rua Exemplo, 123 - São Paulo/SP",
+		"order_id":    orderID,
+		"customer_id": "CUST-001",
+		"items": []map[string]interface{}{
+			{"product_id": "PROD-001", "quantity": 1},
+			{"product_id": "PROD-004", "quantity": 2},
+		},
+		"card_number": "4111111111111111",
+		"address":     "Rua Exemplo, 123 - São Paulo/SP",
 	}
 
 	if err := s.sendOrderToProcess(orderData); err != nil {
@@ -163,20 +226,32 @@ func (s *Simulator) sendMultipleOrders(count int) {
 	successCount := 0
 
 	for i := 1; i <= count; i++ {
-		orderID := generateID()
+		orderID := s.newOrderID(s.orderTag)
 
 		customerID := fmt.Sprintf("CUST-%03d", (i%10)+1)
-		productID := fmt.Sprintf("PROD-%03d", (i%5)+1)
-		quantity := (i % 5) + 1
-		amount := float64(quantity) * (99.99 + float64(i%20)*10)
+
+		// De 1 a 3 itens de produtos diferentes; o valor é calculado pelo
+		// serviço de pedidos a partir do catálogo
+		var items []map[string]interface{}
+		for j := 0; j <= i%3; j++ {
+			items = append(items, map[string]interface{}{
+				"product_id": fmt.Sprintf("PROD-%03d", (i+j)%5+1),
+				"quantity":   (i+j)%2 + 1,
+			})
+		}
+
+		// A cada 20 pedidos, um cartão que o gateway de pagamento recusa
+		cardNumber := "4111111111111111"
+		if i%20 == 0 {
+			cardNumber = "4000000000000002"
+		}
 
 		orderData := map[string]interface{}{
-			"order_id":     orderID,
-			"customer_id":  customerID,
-			"product_id":   productID,
-			"quantity":     quantity,
-			"total_amount": amount,
-			"address":      fmt.Sprintf("Rua %d, São Paulo/SP", i),
+			"order_id":    orderID,
+			"customer_id": customerID,
+			"items":       items,
+			"card_number": cardNumber,
+			"address":     fmt.Sprintf("Rua %d, São Paulo/SP", i),
 		}
 
 		if err := s.sendOrderToProcess(orderData); err != nil {
@@ -195,8 +270,8 @@ func (s *Simulator) sendMultipleOrders(count int) {
 	fmt.Printf("%s%d/%d pedidos enviados com sucesso!%s\n", ColorGreen, successCount, count, ColorReset)
 	fmt.Println()
 	fmt.Printf("%sDica: Com %d pedidos, estatisticamente:%s\n", ColorYellow, count, ColorReset)
-	fmt.Printf("   - ~2 pedidos devem falhar no Estoque (10%% chance)\n")
-	fmt.Printf("   - ~1 pedido deve falhar no Pagamento (5%% chance)\n")
+	fmt.Printf("   - Pedidos do PROD-005 devem falhar no Estoque quando o saldo acabar\n")
+	fmt.Printf("   - ~1 pedido deve falhar no Pagamento (1 a cada 20 com cartão recusado)\n")
 	fmt.Printf("   - O restante deve ser completado com sucesso\n")
 	fmt.Println()
 	fmt.Println("Monitore os logs para ver compensações:")
@@ -229,11 +304,42 @@ func (s *Simulator) sendCustomOrders() {
 	s.sendMultipleOrders(count)
 }
 
+// sendScenarioOrder envia um pedido marcado com um cenário de falha. O
+// cenário é aplicado pelos participantes conforme o faults.json.
+func (s *Simulator) sendScenarioOrder() {
+	fmt.Printf("%sCenários de falha:%s\n\n", ColorYellow, ColorReset)
+	for i, scenario := range faultScenarios {
+		fmt.Printf("%d) %-18s %s\n", i+1, scenario.Tag, scenario.Description)
+	}
+	fmt.Println()
+	fmt.Print("Cenário: ")
+
+	var option int
+	fmt.Scanln(&option)
+	fmt.Println()
+
+	if option < 1 || option > len(faultScenarios) {
+		fmt.Printf("%sCenário inválido%s\n\n", ColorRed, ColorReset)
+		return
+	}
+
+	s.sendOrder(s.newOrderID(faultScenarios[option-1].Tag))
+}
+
+// newOrderID gera o order_id, prefixado pelo cenário quando houver
+func (s *Simulator) newOrderID(tag string) string {
+	if tag == "" {
+		return ids.New()
+	}
+	return tag + "-" + ids.New()
+}
+
 func (s *Simulator) monitorReplies() {
 	fmt.Printf("%sModo de Monitoramento%s\n", ColorCyan, ColorReset)
 	fmt.Println()
 	fmt.Println("Iniciando consumidor para monitorar replies...")
 	fmt.Println("Pressione Ctrl+C para sair")
+	fmt.Printf("Diagrama de cada SAGA no painel: %shttp://localhost:8080/dashboard%s\n", ColorCyan, ColorReset)
 	fmt.Println()
 
 	config := sarama.NewConfig()
@@ -246,13 +352,8 @@ func (s *Simulator) monitorReplies() {
 	}
 	defer consumer.Close()
 
-	topics := []string{
-		"pedido-saga-pedido-processado", // Tópico de conclusão da SAGA
-		"pedidos-reply",
-		"estoque-reply",
-		"pagamentos-reply",
-		"entregas-reply",
-	}
+	// MONITOR_TOPICS permite acompanhar os eventos da versão coreografada
+	topics := strings.Split(getEnv("MONITOR_TOPICS", defaultMonitorTopics), ",")
 
 	// Criar canais para cada tópico
 	for _, topic := range topics {
@@ -273,14 +374,28 @@ func (s *Simulator) monitorReplies() {
 				defer pc.Close()
 
 				for msg := range pc.Messages() {
-					var reply Reply
+					var reply monitoredMessage
 					if err := json.Unmarshal(msg.Value, &reply); err != nil {
 						continue
 					}
 
 					color := ColorGreen
 					status := "SUCCESS"
-					if !reply.Success {
+					if reply.Status != "" {
+						// Resultado final do pedido publicado pelo orquestrador
+						status = reply.Status
+						if status != "COMPLETED" {
+							color = ColorRed
+						}
+					} else if reply.EventType != "" {
+						// Evento de domínio: falhas e compensações aparecem pelo tipo
+						status = reply.EventType
+						if strings.Contains(status, "Failed") || strings.Contains(status, "Cancelled") ||
+							strings.Contains(status, "Refunded") || strings.Contains(status, "Released") ||
+							strings.Contains(status, "Rejected") {
+							color = ColorRed
+						}
+					} else if !reply.Success {
 						color = ColorRed
 						status = "FAILED"
 					}
@@ -309,15 +424,16 @@ func (s *Simulator) sendOrderToProcess(orderData map[string]interface{}) error {
 		Topic: "pedido-saga-pedido-processar",
 		Value: sarama.ByteEncoder(data),
 	}
+	// A SAGA ainda não existe: o pedido é a chave, e reenvios do mesmo pedido
+	// chegam ao orquestrador em ordem, na mesma partição
+	if orderID, ok := orderData["order_id"].(string); ok {
+		msg.Key = sarama.StringEncoder(orderID)
+	}
 
 	_, _, err = s.producer.SendMessage(msg)
 	return err
 }
 
-func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
-
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
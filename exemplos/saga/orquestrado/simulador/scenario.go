@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Códigos de saída do modo cenário
+const (
+	ExitOK               = 0
+	ExitExpectationsFail = 1
+	ExitError            = 2
+)
+
+// Resultados finais publicados pelo orquestrador em pedido-saga-pedido-processado
+const (
+	OutcomeCompleted          = "COMPLETED"
+	OutcomeFailed             = "FAILED"
+	OutcomeCompensationFailed = "COMPENSATION_FAILED"
+)
+
+const processedTopic = "pedido-saga-pedido-processado"
+
+// Tópicos acompanhados pelo modo cenário para medir a latência de cada comando
+var (
+	scenarioCommandTopics = []string{"pedidos-commands", "estoque-commands", "pagamentos-commands", "entregas-commands"}
+	scenarioReplyTopics   = []string{"pedidos-reply", "estoque-reply", "pagamentos-reply", "entregas-reply"}
+)
+
+// Scenario descreve uma execução não interativa do simulador
+type Scenario struct {
+	Name           string               `json:"name"`
+	Orders         int                  `json:"orders"`
+	RatePerSecond  float64              `json:"rate_per_second"`
+	TimeoutSeconds int                  `json:"timeout_seconds"`
+	Templates      []OrderTemplate      `json:"templates"`
+	Expectations   ScenarioExpectations `json:"expectations"`
+}
+
+// OrderTemplate é um modelo de pedido. Os modelos são usados em rodízio,
+// proporcional ao peso. Em valores texto do payload, {{i}} é trocado pelo
+// número do pedido e {{order_id}} pelo order_id gerado.
+type OrderTemplate struct {
+	Name     string                 `json:"name"`
+	Weight   int                    `json:"weight"`
+	OrderTag string                 `json:"order_tag"`
+	Expect   string                 `json:"expect"`
+	Payload  map[string]interface{} `json:"payload"`
+}
+
+// ScenarioExpectations são os critérios que definem o código de saída.
+// Campos omitidos não são verificados, exceto max_unfinished (padrão 0).
+type ScenarioExpectations struct {
+	MinCompleted  *int               `json:"min_completed"`
+	MaxFailed     *int               `json:"max_failed"`
+	MaxUnfinished int                `json:"max_unfinished"`
+	MaxP95Ms      map[string]float64 `json:"max_p95_ms"`
+}
+
+// sagaRun acompanha um pedido enviado pelo cenário
+type sagaRun struct {
+	OrderID     string
+	SagaID      string
+	Template    string
+	Expect      string
+	SentAt      time.Time
+	Outcome     string
+	Error       string
+	FinishedAt  time.Time
+	LastCommand string
+}
+
+// sentCommand é um comando visto no Kafka aguardando o reply
+type sentCommand struct {
+	CommandType string
+	SeenAt      time.Time
+}
+
+// scenarioRun guarda o que foi observado durante a execução
+type scenarioRun struct {
+	mu        sync.Mutex
+	orders    map[string]*sagaRun
+	commands  map[string]sentCommand
+	latencies map[string][]time.Duration
+	finished  int
+	expected  int
+	done      chan struct{}
+}
+
+// loadScenario lê e valida o arquivo de cenário
+func loadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("cenário inválido: %w", err)
+	}
+
+	if scenario.Orders <= 0 {
+		return nil, fmt.Errorf("cenário %s: orders deve ser maior que zero", scenario.Name)
+	}
+	if len(scenario.Templates) == 0 {
+		return nil, fmt.Errorf("cenário %s: nenhum modelo de pedido em templates", scenario.Name)
+	}
+	if scenario.RatePerSecond <= 0 {
+		scenario.RatePerSecond = 10
+	}
+	if scenario.TimeoutSeconds <= 0 {
+		scenario.TimeoutSeconds = 120
+	}
+
+	for i := range scenario.Templates {
+		t := &scenario.Templates[i]
+		if t.Weight <= 0 {
+			t.Weight = 1
+		}
+		switch t.Expect {
+		case "", OutcomeCompleted, OutcomeFailed, OutcomeCompensationFailed:
+		default:
+			return nil, fmt.Errorf("modelo %s: expect inválido %q", t.Name, t.Expect)
+		}
+	}
+
+	return &scenario, nil
+}
+
+// runScenario envia os pedidos do cenário, aguarda o resultado de cada SAGA
+// e imprime o resumo. Retorna o código de saída do processo.
+func (s *Simulator) runScenario(path string) int {
+	scenario, err := loadScenario(path)
+	if err != nil {
+		fmt.Printf("%sErro ao carregar cenário: %v%s\n", ColorRed, err, ColorReset)
+		return ExitError
+	}
+
+	run := &scenarioRun{
+		orders:    make(map[string]*sagaRun),
+		commands:  make(map[string]sentCommand),
+		latencies: make(map[string][]time.Duration),
+		expected:  scenario.Orders,
+		done:      make(chan struct{}),
+	}
+
+	// Os consumidores começam antes do envio para não perder nenhuma mensagem
+	consumer, err := s.watchScenario(run)
+	if err != nil {
+		fmt.Printf("%sErro ao acompanhar os tópicos: %v%s\n", ColorRed, err, ColorReset)
+		return ExitError
+	}
+	defer consumer.Close()
+
+	fmt.Printf("%sCenário %s: %d pedido(s) a %.1f/s%s\n\n",
+		ColorCyan, scenario.Name, scenario.Orders, scenario.RatePerSecond, ColorReset)
+
+	// Rodízio dos modelos proporcional ao peso
+	var rotation []*OrderTemplate
+	for i := range scenario.Templates {
+		for w := 0; w < scenario.Templates[i].Weight; w++ {
+			rotation = append(rotation, &scenario.Templates[i])
+		}
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / scenario.RatePerSecond))
+	defer ticker.Stop()
+
+	for i := 1; i <= scenario.Orders; i++ {
+		template := rotation[(i-1)%len(rotation)]
+		orderID := s.newOrderID(template.OrderTag)
+
+		orderData := renderPayload(template.Payload, i, orderID)
+		orderData["order_id"] = orderID
+
+		saga := &sagaRun{OrderID: orderID, Template: template.Name, Expect: template.Expect, SentAt: time.Now()}
+		run.mu.Lock()
+		run.orders[orderID] = saga
+		run.mu.Unlock()
+
+		if err := s.sendOrderToProcess(orderData); err != nil {
+			fmt.Printf("%sErro ao enviar pedido %s: %v%s\n", ColorRed, orderID, err, ColorReset)
+			return ExitError
+		}
+
+		if i%10 == 0 || i == scenario.Orders {
+			fmt.Printf("  %d/%d pedidos enviados...\n", i, scenario.Orders)
+		}
+		if i < scenario.Orders {
+			<-ticker.C
+		}
+	}
+
+	fmt.Printf("\nAguardando o resultado das SAGAs (timeout %ds)...\n\n", scenario.TimeoutSeconds)
+
+	select {
+	case <-run.done:
+	case <-time.After(time.Duration(scenario.TimeoutSeconds) * time.Second):
+		fmt.Printf("%sTimeout: nem todas as SAGAs terminaram%s\n\n", ColorYellow, ColorReset)
+	}
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.printSummary(scenario, time.Since(start))
+	if violations := run.check(scenario); len(violations) > 0 {
+		fmt.Printf("%sExpectativas não atendidas:%s\n", ColorRed, ColorReset)
+		for _, v := range violations {
+			fmt.Printf("  %s✗ %s%s\n", ColorRed, v, ColorReset)
+		}
+		fmt.Println()
+		return ExitExpectationsFail
+	}
+
+	fmt.Printf("%s✓ Todas as expectativas foram atendidas%s\n\n", ColorGreen, ColorReset)
+	return ExitOK
+}
+
+// renderPayload copia o payload do modelo substituindo os marcadores
+func renderPayload(payload map[string]interface{}, index int, orderID string) map[string]interface{} {
+	replacer := strings.NewReplacer("{{i}}", fmt.Sprintf("%d", index), "{{order_id}}", orderID)
+
+	data := make(map[string]interface{}, len(payload)+1)
+	for k, v := range payload {
+		if text, ok := v.(string); ok {
+			v = replacer.Replace(text)
+		}
+		data[k] = v
+	}
+	return data
+}
+
+// watchScenario consome os tópicos de comandos, replies e pedidos processados
+// a partir do offset mais recente
+func (s *Simulator) watchScenario(run *scenarioRun) (sarama.Consumer, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+
+	consumer, err := sarama.NewConsumer(s.brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	handlers := map[string]func([]byte){processedTopic: run.handleProcessed}
+	for _, topic := range scenarioCommandTopics {
+		handlers[topic] = run.handleCommand
+	}
+	for _, topic := range scenarioReplyTopics {
+		handlers[topic] = run.handleReply
+	}
+
+	for topic, handle := range handlers {
+		partitions, err := consumer.Partitions(topic)
+		if err != nil {
+			if topic == processedTopic {
+				consumer.Close()
+				return nil, fmt.Errorf("tópico %s indisponível: %w", topic, err)
+			}
+			fmt.Printf("%sAviso: Tópico %s não encontrado, sem latência das etapas dele%s\n", ColorYellow, topic, ColorReset)
+			continue
+		}
+
+		for _, partition := range partitions {
+			pc, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				consumer.Close()
+				return nil, err
+			}
+
+			go func(pc sarama.PartitionConsumer, handle func([]byte)) {
+				for msg := range pc.Messages() {
+					handle(msg.Value)
+				}
+			}(pc, handle)
+		}
+	}
+
+	return consumer, nil
+}
+
+// handleCommand associa a SAGA ao pedido e registra o envio do comando
+func (r *scenarioRun) handleCommand(data []byte) {
+	var cmd Command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	saga, ok := r.orders[cmd.OrderID]
+	if !ok {
+		return
+	}
+	saga.SagaID = cmd.SagaID
+	saga.LastCommand = cmd.CommandType
+
+	// Reenvios do watchdog repetem o command_id: vale o primeiro envio
+	if _, seen := r.commands[cmd.CommandID]; !seen {
+		r.commands[cmd.CommandID] = sentCommand{CommandType: cmd.CommandType, SeenAt: time.Now()}
+	}
+}
+
+// handleReply mede a latência do comando respondido
+func (r *scenarioRun) handleReply(data []byte) {
+	var reply Reply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cmd, ok := r.commands[reply.CommandID]
+	if !ok {
+		return
+	}
+	delete(r.commands, reply.CommandID)
+	r.latencies[cmd.CommandType] = append(r.latencies[cmd.CommandType], time.Since(cmd.SeenAt))
+}
+
+// handleProcessed registra o resultado final da SAGA
+func (r *scenarioRun) handleProcessed(data []byte) {
+	var event struct {
+		SagaID  string `json:"saga_id"`
+		OrderID string `json:"order_id"`
+		Status  string `json:"status"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	saga, ok := r.orders[event.OrderID]
+	if !ok || saga.Outcome != "" {
+		return
+	}
+	saga.SagaID = event.SagaID
+	saga.Outcome = event.Status
+	saga.Error = event.Error
+	saga.FinishedAt = time.Now()
+
+	r.finished++
+	if r.finished == r.expected {
+		close(r.done)
+	}
+}
+
+// count conta as SAGAs com o resultado informado ("" = não finalizadas)
+func (r *scenarioRun) count(outcome string) int {
+	n := 0
+	for _, saga := range r.orders {
+		if saga.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *scenarioRun) printSummary(scenario *Scenario, elapsed time.Duration) {
+	fmt.Printf("%s══════════ Resumo do cenário %s ══════════%s\n\n", ColorCyan, scenario.Name, ColorReset)
+	fmt.Printf("Pedidos enviados:     %d em %s\n", len(r.orders), elapsed.Round(time.Millisecond))
+	fmt.Printf("%sConcluídos:           %d%s\n", ColorGreen, r.count(OutcomeCompleted), ColorReset)
+	fmt.Printf("%sCompensados:          %d%s\n", ColorYellow, r.count(OutcomeFailed), ColorReset)
+	fmt.Printf("%sCompensação falhou:   %d%s\n", ColorRed, r.count(OutcomeCompensationFailed), ColorReset)
+	fmt.Printf("%sNão finalizados:      %d%s\n\n", ColorRed, r.count(""), ColorReset)
+
+	var saga []time.Duration
+	for _, run := range r.orders {
+		if run.Outcome != "" {
+			saga = append(saga, run.FinishedAt.Sub(run.SentAt))
+		}
+	}
+
+	fmt.Printf("%-22s %6s %9s %9s %9s %9s\n", "Latência (ms)", "n", "p50", "p95", "p99", "máx")
+	commandTypes := make([]string, 0, len(r.latencies))
+	for commandType := range r.latencies {
+		commandTypes = append(commandTypes, commandType)
+	}
+	sort.Strings(commandTypes)
+	for _, commandType := range commandTypes {
+		printLatency(commandType, r.latencies[commandType])
+	}
+	printLatency("SAGA completa", saga)
+	fmt.Println()
+
+	var unfinished []*sagaRun
+	for _, run := range r.orders {
+		if run.Outcome == "" {
+			unfinished = append(unfinished, run)
+		}
+	}
+	if len(unfinished) > 0 {
+		sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].SentAt.Before(unfinished[j].SentAt) })
+		fmt.Printf("%sSAGAs não finalizadas:%s\n", ColorRed, ColorReset)
+		for _, run := range unfinished {
+			fmt.Printf("  pedido %s  SAGA %s  último comando %s\n",
+				run.OrderID, valueOr(run.SagaID, "-"), valueOr(run.LastCommand, "-"))
+		}
+		fmt.Println()
+	}
+}
+
+// check compara o resultado com as expectativas do cenário
+func (r *scenarioRun) check(scenario *Scenario) []string {
+	var violations []string
+	exp := scenario.Expectations
+
+	if exp.MinCompleted != nil && r.count(OutcomeCompleted) < *exp.MinCompleted {
+		violations = append(violations, fmt.Sprintf("concluídos: %d, mínimo esperado %d",
+			r.count(OutcomeCompleted), *exp.MinCompleted))
+	}
+	if exp.MaxFailed != nil && r.count(OutcomeFailed) > *exp.MaxFailed {
+		violations = append(violations, fmt.Sprintf("compensados: %d, máximo esperado %d",
+			r.count(OutcomeFailed), *exp.MaxFailed))
+	}
+	if unfinished := r.count(""); unfinished > exp.MaxUnfinished {
+		violations = append(violations, fmt.Sprintf("não finalizados: %d, máximo esperado %d",
+			unfinished, exp.MaxUnfinished))
+	}
+
+	commandTypes := make([]string, 0, len(exp.MaxP95Ms))
+	for commandType := range exp.MaxP95Ms {
+		commandTypes = append(commandTypes, commandType)
+	}
+	sort.Strings(commandTypes)
+	for _, commandType := range commandTypes {
+		durations := r.latencies[commandType]
+		if len(durations) == 0 {
+			violations = append(violations, fmt.Sprintf("%s: nenhum reply observado", commandType))
+			continue
+		}
+		if p95 := milliseconds(percentile(durations, 95)); p95 > exp.MaxP95Ms[commandType] {
+			violations = append(violations, fmt.Sprintf("%s: p95 de %.0fms, máximo esperado %.0fms",
+				commandType, p95, exp.MaxP95Ms[commandType]))
+		}
+	}
+
+	// Resultado esperado por modelo de pedido
+	mismatches := make(map[string]int)
+	for _, run := range r.orders {
+		if run.Expect != "" && run.Outcome != "" && run.Outcome != run.Expect {
+			mismatches[fmt.Sprintf("modelo %s: esperado %s, obtido %s", run.Template, run.Expect, run.Outcome)]++
+		}
+	}
+	for mismatch, n := range mismatches {
+		violations = append(violations, fmt.Sprintf("%s (%d pedido(s))", mismatch, n))
+	}
+
+	return violations
+}
+
+func printLatency(label string, durations []time.Duration) {
+	if len(durations) == 0 {
+		return
+	}
+	fmt.Printf("%-22s %6d %9.0f %9.0f %9.0f %9.0f\n", label, len(durations),
+		milliseconds(percentile(durations, 50)), milliseconds(percentile(durations, 95)),
+		milliseconds(percentile(durations, 99)), milliseconds(percentile(durations, 100)))
+}
+
+// percentile calcula o percentil pelo método nearest-rank
+func percentile(durations []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}